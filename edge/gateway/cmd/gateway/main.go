@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -14,6 +15,7 @@ import (
 	"github.com/tradephantom/axcp-spec/edge/gateway/internal"
 	// gatewaymetrics "github.com/tradephantom/axcp-spec/enterprise/edge/gateway/internal/metrics" // Importazione commentata per risolvere problema con internal package
 	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	axctx "github.com/tradephantom/axcp-spec/sdk/go/axcp/context"
 	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
 	"github.com/tradephantom/axcp-spec/sdk/go/netquic"
 )
@@ -30,6 +32,14 @@ func lookupEnvFloat(key string, defaultVal float64) float64 {
 	return defaultVal
 }
 
+// lookupEnvString legge una variabile d'ambiente come stringa o restituisce il valore di default
+func lookupEnvString(key string, defaultVal string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return defaultVal
+}
+
 // lookupEnvDuration legge una variabile d'ambiente come time.Duration o restituisce il valore di default
 func lookupEnvDuration(key string, defaultVal time.Duration) time.Duration {
 	if val, ok := os.LookupEnv(key); ok {
@@ -49,6 +59,21 @@ func main() {
 	var maxRetryAttempts int
 	var minRetryInterval time.Duration
 	var maxRetryInterval time.Duration
+	var supportedProfiles uint
+	var minProfile uint
+	var allow0RTT bool
+	var stateDB string
+	var snapshotInterval time.Duration
+	var offlineTTL time.Duration
+	var offlineCapacity int
+	var capabilityTrust string
+
+	// Parametri TLS (vuoti = certificato autofirmato, solo per sviluppo)
+	var tlsCertFile string
+	var tlsKeyFile string
+	var tlsCAFile string
+	var tlsRequireClientCert bool
+	var tlsReloadInterval time.Duration
 	
 	// Parametri per il budget DP
 	var epsilonFlag float64
@@ -61,6 +86,19 @@ func main() {
 	flag.IntVar(&maxRetryAttempts, "retry-attempts", 5, "Maximum retry attempts per message")
 	flag.DurationVar(&minRetryInterval, "retry-min-interval", 1*time.Second, "Minimum retry interval")
 	flag.DurationVar(&maxRetryInterval, "retry-max-interval", 5*time.Minute, "Maximum retry interval")
+	flag.UintVar(&supportedProfiles, "profiles", axcp.AllProfiles, "Bitmask of accepted session profiles (bit 0 = Profile-0 … bit 3 = Profile-3)")
+	flag.UintVar(&minProfile, "min-profile", 0, "Lowest session profile accepted during negotiation")
+	flag.BoolVar(&allow0RTT, "allow-0rtt", false, "Accept 0-RTT data from agents resuming a TLS session")
+	flag.StringVar(&stateDB, "state", lookupEnvString("AXCP_STATE_DB", "axcp-gateway.db"), "bbolt file holding the context journal and snapshots (empty keeps contexts in memory only)")
+	flag.DurationVar(&offlineTTL, "offline-ttl", lookupEnvDuration("AXCP_OFFLINE_TTL", 10*time.Minute), "How long context patches are held for offline agents (0 disables store-and-forward)")
+	flag.IntVar(&offlineCapacity, "offline-capacity", 1000, "Maximum context patches held per offline agent")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", lookupEnvDuration("AXCP_SNAPSHOT_INTERVAL", 5*time.Minute), "How often context snapshots are written and the journal truncated")
+	flag.StringVar(&capabilityTrust, "capability-trust", lookupEnvString("AXCP_CAPABILITY_TRUST", ""), "File of ed25519 keys trusted to sign capability bundles, one \"<name> <base64 key>\" per line (empty accepts unsigned offers)")
+	flag.StringVar(&tlsCertFile, "tls-cert", lookupEnvString("AXCP_TLS_CERT", ""), "PEM certificate chain of the gateway")
+	flag.StringVar(&tlsKeyFile, "tls-key", lookupEnvString("AXCP_TLS_KEY", ""), "PEM private key of the gateway")
+	flag.StringVar(&tlsCAFile, "tls-ca", lookupEnvString("AXCP_TLS_CA", ""), "PEM bundle of the CAs trusted to sign agent certificates")
+	flag.BoolVar(&tlsRequireClientCert, "tls-require-client-cert", false, "Require agents to present a certificate signed by -tls-ca (mutual TLS)")
+	flag.DurationVar(&tlsReloadInterval, "tls-reload-interval", netquic.DefaultReloadInterval, "How often certificate files are checked for rotation (negative disables)")
 	
 	// Flag per il budget DP con binding alle variabili d'ambiente
 	flag.Float64Var(&epsilonFlag, "epsilon", lookupEnvFloat("AXCP_DP_EPSILON", 1.0), "Privacy parameter epsilon for differential privacy")
@@ -70,10 +108,27 @@ func main() {
 	// metricsCfg.AddFlags(flag.CommandLine) // Commentato per risolvere problema con internal package
 	flag.Parse()
 
-	tlsConf := netquic.InsecureTLSConfig()
+	// Configurazione TLS: certificati da file con hot-reload, oppure autofirmato
+	var tlsConf *tls.Config
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		log.Printf("ATTENZIONE: nessun certificato configurato, uso un certificato autofirmato (solo sviluppo)")
+		tlsConf = netquic.InsecureTLSConfig()
+	} else {
+		var err error
+		tlsConf, err = netquic.NewServerTLSConfig(netquic.TLSOptions{
+			CertFile:          tlsCertFile,
+			KeyFile:           tlsKeyFile,
+			CAFile:            tlsCAFile,
+			RequireClientCert: tlsRequireClientCert,
+			ReloadInterval:    tlsReloadInterval,
+		})
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+	}
 
 	// Set up context for graceful shutdown
-	_, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	// Initialize metrics
@@ -225,7 +280,51 @@ func main() {
 
 	// Start server
 	log.Printf("Starting AXCP gateway server %s on %s...", BuildVersion, addr)
-	if err := internal.RunQuicServer(addr, tlsConf, handler, telemetryHandler); err != nil {
+	serverConfig := &netquic.Config{
+		SupportedProfiles: uint32(supportedProfiles),
+		MinProfile:        uint32(minProfile),
+		Allow0RTT:         allow0RTT,
+	}
+	// Grafo dei contesti replicato verso gli agenti (SyncSubscribe/SyncRequest),
+	// ricostruito dal journal persistente all'avvio
+	engine := axctx.NewEngine()
+	if stateDB != "" {
+		state, err := internal.NewBuffer(stateDB)
+		if err != nil {
+			log.Fatalf("Failed to open context state %s: %v", stateDB, err)
+		}
+		defer state.Close()
+
+		replayed, err := state.Recover(engine)
+		if err != nil {
+			log.Fatalf("Failed to recover contexts from %s: %v", stateDB, err)
+		}
+		log.Printf("Recovered %d contexts from %s, %d journal patches replayed", len(engine.Contexts()), stateDB, replayed)
+		engine.SetJournal(state)
+		go state.RunSnapshots(ctx, engine, snapshotInterval)
+	} else {
+		log.Println("Context persistence disabled")
+	}
+	contexts := internal.NewContextService(engine)
+	if offlineTTL > 0 {
+		contexts.SetOutbox(internal.NewPatchOutbox(offlineTTL, offlineCapacity))
+	}
+	go contexts.RunExpiry(ctx, time.Second)
+
+	// Tool offerti dagli agenti connessi (CapabilityOffer/Request/Ack)
+	capabilities := internal.NewCapabilityRegistry()
+	if capabilityTrust != "" {
+		trust, err := axcp.LoadTrustStore(capabilityTrust)
+		if err != nil {
+			log.Fatalf("Invalid capability trust file %s: %v", capabilityTrust, err)
+		}
+		capabilities.SetTrust(trust)
+		log.Printf("Capability offers must be bundles signed by one of %d trusted keys", trust.Len())
+	}
+	// Chiamate ai tool instradate verso l'agente che li offre
+	tools := internal.NewToolRouter(capabilities)
+
+	if err := internal.RunQuicServer(addr, tlsConf, serverConfig, handler, telemetryHandler, contexts, capabilities, tools); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
 }
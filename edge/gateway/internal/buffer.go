@@ -1,11 +1,31 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
 	"time"
 
+	axctx "github.com/tradephantom/axcp-spec/sdk/go/axcp/context"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
 	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
 )
 
+var (
+	// patchBucket contiene un sotto-bucket append-only per contesto, con i
+	// patch indicizzati per base_version
+	patchBucket = []byte("patch")
+	// snapshotBucket contiene l'ultimo snapshot di ogni contesto
+	snapshotBucket = []byte("snapshot")
+)
+
+// Buffer persiste il grafo dei contesti su bbolt (spec v0.2 §6.4): ogni
+// patch applicato finisce nel journal prima di avere effetto, gli snapshot
+// periodici troncano il journal e al riavvio Recover ricostruisce lo stato.
+// Implementa axctx.Journal.
 type Buffer struct{ db *bolt.DB }
 
 func NewBuffer(path string) (*Buffer, error) {
@@ -16,12 +36,198 @@ func NewBuffer(path string) (*Buffer, error) {
 
 	// Utilizziamo una funzione di callback con la firma corretta (un solo valore di ritorno error)
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("patch"))
+		if _, err := tx.CreateBucketIfNotExists(patchBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(snapshotBucket)
 		return err
 	})
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return &Buffer{db: db}, nil
 }
+
+// Close chiude il database
+func (b *Buffer) Close() error {
+	return b.db.Close()
+}
+
+// versionKey codifica una versione in modo che l'ordine dei byte segua
+// quello numerico
+func versionKey(v uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, v)
+	return key
+}
+
+// Append aggiunge il patch al journal del suo contesto
+func (b *Buffer) Append(patch *pb.ContextPatch) error {
+	data, err := proto.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		journal, err := tx.Bucket(patchBucket).CreateBucketIfNotExists([]byte(patch.GetContextId()))
+		if err != nil {
+			return err
+		}
+		return journal.Put(versionKey(patch.GetBaseVersion()), data)
+	})
+}
+
+// SaveSnapshot salva lo snapshot e tronca il journal dei patch che contiene
+func (b *Buffer) SaveSnapshot(snap *pb.ContextSnapshot) error {
+	return b.saveSnapshot(snap, false)
+}
+
+// saveSnapshot salva lo snapshot; con reset il journal del contesto viene
+// svuotato del tutto, anche dei patch successivi allo snapshot
+func (b *Buffer) saveSnapshot(snap *pb.ContextSnapshot, reset bool) error {
+	data, err := proto.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	id := []byte(snap.GetVersion().GetContextId())
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(snapshotBucket).Put(id, data); err != nil {
+			return err
+		}
+
+		journal := tx.Bucket(patchBucket).Bucket(id)
+		if journal == nil {
+			return nil
+		}
+		if reset {
+			return tx.Bucket(patchBucket).DeleteBucket(id)
+		}
+		end := versionKey(snap.GetVersion().GetVersion())
+		c := journal.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Snapshot restituisce l'ultimo snapshot salvato del contesto, nil se non
+// ce n'è
+func (b *Buffer) Snapshot(contextID string) (*pb.ContextSnapshot, error) {
+	var snap *pb.ContextSnapshot
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(snapshotBucket).Get([]byte(contextID))
+		if data == nil {
+			return nil
+		}
+		snap = &pb.ContextSnapshot{}
+		return proto.Unmarshal(data, snap)
+	})
+	return snap, err
+}
+
+// Recover ricostruisce in engine lo stato persistito: ripristina gli
+// snapshot e riapplica i patch del journal successivi. Va chiamato prima
+// di engine.SetJournal(b). Restituisce il numero di patch riapplicati.
+func (b *Buffer) Recover(engine *axctx.Engine) (int, error) {
+	replayed := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(snapshotBucket).ForEach(func(k, v []byte) error {
+			snap := &pb.ContextSnapshot{}
+			if err := proto.Unmarshal(v, snap); err != nil {
+				return fmt.Errorf("snapshot di %q illeggibile: %w", k, err)
+			}
+			return engine.Restore(snap)
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(patchBucket).ForEachBucket(func(id []byte) error {
+			return tx.Bucket(patchBucket).Bucket(id).ForEach(func(k, v []byte) error {
+				patch := &pb.ContextPatch{}
+				if err := proto.Unmarshal(v, patch); err != nil {
+					return fmt.Errorf("patch di %q illeggibile: %w", id, err)
+				}
+				if patch.GetBaseVersion() < engine.Version(string(id)) {
+					// Già contenuto nello snapshot
+					return nil
+				}
+				if _, err := engine.Apply(patch); err != nil {
+					return fmt.Errorf("journal di %q non riapplicabile: %w", id, err)
+				}
+				replayed++
+				return nil
+			})
+		})
+	})
+	return replayed, err
+}
+
+// Checkpoint salva uno snapshot di ogni contesto avanzato dall'ultimo
+// snapshot, troncandone il journal
+func (b *Buffer) Checkpoint(engine *axctx.Engine) error {
+	for _, id := range engine.Contexts() {
+		saved, err := b.Snapshot(id)
+		if err != nil {
+			return err
+		}
+		if saved != nil && saved.GetVersion().GetVersion() >= engine.Version(id) {
+			continue
+		}
+
+		snap, err := engine.Snapshot(id)
+		if err != nil {
+			return err
+		}
+		if err := b.SaveSnapshot(snap); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunSnapshots esegue Checkpoint ogni interval finché ctx non termina,
+// e un'ultima volta all'uscita
+func (b *Buffer) RunSnapshots(ctx context.Context, engine *axctx.Engine, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := b.Checkpoint(engine); err != nil {
+				log.Printf("[context] snapshot finale fallito: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := b.Checkpoint(engine); err != nil {
+				log.Printf("[context] snapshot fallito: %v", err)
+			}
+		}
+	}
+}
+
+// ExportSnapshot esporta lo stato corrente del contesto in JSON o protobuf
+func (b *Buffer) ExportSnapshot(engine *axctx.Engine, contextID string, format axctx.SnapshotFormat) ([]byte, error) {
+	snap, err := engine.Snapshot(contextID)
+	if err != nil {
+		return nil, err
+	}
+	return axctx.EncodeSnapshot(snap, format)
+}
+
+// ImportSnapshot sostituisce il contesto con lo snapshot esportato, in
+// memoria e su disco; il journal precedente del contesto viene scartato
+func (b *Buffer) ImportSnapshot(engine *axctx.Engine, data []byte, format axctx.SnapshotFormat) error {
+	snap, err := axctx.DecodeSnapshot(data, format)
+	if err != nil {
+		return err
+	}
+	if err := engine.Restore(snap); err != nil {
+		return err
+	}
+	return b.saveSnapshot(snap, true)
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	axctx "github.com/tradephantom/axcp-spec/sdk/go/axcp/context"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	bolt "go.etcd.io/bbolt"
+)
+
+// applyN applica n patch che impostano /n alla nuova versione
+func applyN(t *testing.T, e *axctx.Engine, id string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		v := e.Version(id)
+		op, err := axcp.NewDeltaOp(pb.DeltaOp_ADD, "/n", v+1)
+		require.NoError(t, err)
+		_, err = e.Apply(&pb.ContextPatch{ContextId: id, BaseVersion: v, Ops: []*pb.DeltaOp{op}})
+		require.NoError(t, err)
+	}
+}
+
+// journalLen conta i patch nel journal del contesto
+func journalLen(t *testing.T, b *Buffer, id string) int {
+	t.Helper()
+	n := 0
+	require.NoError(t, b.db.View(func(tx *bolt.Tx) error {
+		if journal := tx.Bucket(patchBucket).Bucket([]byte(id)); journal != nil {
+			n = journal.Stats().KeyN
+		}
+		return nil
+	}))
+	return n
+}
+
+func contextJSON(t *testing.T, e *axctx.Engine, id string) string {
+	t.Helper()
+	doc, ok := e.Get(id)
+	require.True(t, ok)
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// Lo stato sopravvive al riavvio: snapshot più journal successivo
+func TestBufferRecoversContexts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	state, err := NewBuffer(path)
+	require.NoError(t, err)
+
+	engine := axctx.NewEngine()
+	engine.SetJournal(state)
+	applyN(t, engine, "a", 3)
+	applyN(t, engine, "b", 1)
+	assert.Equal(t, 3, journalLen(t, state, "a"))
+
+	require.NoError(t, state.Checkpoint(engine))
+	assert.Equal(t, 0, journalLen(t, state, "a"), "snapshot truncates the journal")
+	applyN(t, engine, "a", 2)
+	assert.Equal(t, 2, journalLen(t, state, "a"))
+	require.NoError(t, state.Close())
+
+	state, err = NewBuffer(path)
+	require.NoError(t, err)
+	defer state.Close()
+	recovered := axctx.NewEngine()
+	replayed, err := state.Recover(recovered)
+	require.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, uint64(5), recovered.Version("a"))
+	assert.Equal(t, uint64(1), recovered.Version("b"))
+	assert.JSONEq(t, `{"n":5}`, contextJSON(t, recovered, "a"))
+
+	// La replica può riprendere dal journal ancora presente
+	_, err = recovered.Patches("a", 3, 0)
+	assert.NoError(t, err)
+	_, err = recovered.Patches("a", 2, 0)
+	assert.Equal(t, pb.ErrorCode_MISSING_PATCH_RANGE, axcp.ErrorCodeOf(err))
+}
+
+func TestBufferExportImport(t *testing.T) {
+	state, err := NewBuffer(filepath.Join(t.TempDir(), "state.db"))
+	require.NoError(t, err)
+	defer state.Close()
+
+	source := axctx.NewEngine()
+	applyN(t, source, "ctx", 4)
+
+	for _, format := range []axctx.SnapshotFormat{axctx.SnapshotJSON, axctx.SnapshotProto} {
+		data, err := state.ExportSnapshot(source, "ctx", format)
+		require.NoError(t, err)
+
+		engine := axctx.NewEngine()
+		engine.SetJournal(state)
+		applyN(t, engine, "ctx", 6)
+		require.NoError(t, state.ImportSnapshot(engine, data, format))
+		assert.Equal(t, uint64(4), engine.Version("ctx"))
+		assert.Equal(t, 0, journalLen(t, state, "ctx"), "journal of the replaced context dropped")
+
+		recovered := axctx.NewEngine()
+		_, err = state.Recover(recovered)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"n":4}`, contextJSON(t, recovered, "ctx"))
+	}
+
+	_, err = state.ExportSnapshot(source, "missing", axctx.SnapshotJSON)
+	assert.Equal(t, pb.ErrorCode_INVALID_CONTEXT, axcp.ErrorCodeOf(err))
+}
@@ -0,0 +1,297 @@
+package internal
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"github.com/tradephantom/axcp-spec/sdk/go/netquic"
+)
+
+// CapabilityRegistry raccoglie i CapabilityDescriptor offerti dagli agenti
+// connessi (spec v0.2 §7) e risponde alle CapabilityRequest. Le voci di un
+// agente vengono rimosse alla chiusura della sua sessione. Con un
+// TrustStore configurato accetta solo bundle firmati da una chiave fidata.
+type CapabilityRegistry struct {
+	mu sync.Mutex
+	// tools elenca, per tool_id, gli agenti che lo offrono in ordine di
+	// registrazione
+	tools map[string][]*Tool
+	trust *axcp.TrustStore
+	// versions è la bundle_version più alta accettata per ogni issuer
+	versions map[string]uint64
+}
+
+// Tool è un tool offerto da un agente, con gli schemi già compilati
+type Tool struct {
+	Desc    *pb.CapabilityDescriptor
+	Schemas *axcp.ToolSchemas
+	Session netquic.Conn
+	// Issuer ed Expires vengono dal bundle firmato, vuoti per un'offerta
+	// semplice
+	Issuer  string
+	Expires time.Time
+}
+
+// live indica se il tool è ancora valido a now
+func (t *Tool) live(now time.Time) bool {
+	return t.Expires.IsZero() || now.Before(t.Expires)
+}
+
+// NewCapabilityRegistry crea un registry vuoto
+func NewCapabilityRegistry() *CapabilityRegistry {
+	return &CapabilityRegistry{tools: make(map[string][]*Tool), versions: make(map[string]uint64)}
+}
+
+// SetTrust richiede che ogni offerta sia un bundle firmato da una chiave di
+// trust o certificata da essa; nil accetta le offerte semplici
+func (r *CapabilityRegistry) SetTrust(trust *axcp.TrustStore) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trust = trust
+}
+
+// Register registra il descrittore offerto dalla sessione s, sostituendo
+// un'offerta precedente dello stesso tool. Gli schemi di input e output
+// vengono compilati subito: uno schema non valido rifiuta l'offerta con
+// MALFORMED_REQUEST. Con un TrustStore configurato l'offerta non firmata
+// viene rifiutata con UNAUTHORIZED.
+func (r *CapabilityRegistry) Register(s netquic.Conn, desc *pb.CapabilityDescriptor) error {
+	if desc.GetToolId() == "" {
+		return axcp.NewError(pb.ErrorCode_MALFORMED_REQUEST, "offer without tool_id")
+	}
+	schemas, err := axcp.CompileCapability(desc)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.trust != nil {
+		return axcp.NewError(pb.ErrorCode_UNAUTHORIZED, "unsigned offer of %q", desc.GetToolId())
+	}
+	r.add(&Tool{Desc: desc, Schemas: schemas, Session: s})
+	return nil
+}
+
+// RegisterBundle verifica il bundle firmato offerto dalla sessione s e ne
+// registra tutti i tool, restituendone i tool_id. Firma, catena e scadenza
+// non valide rifiutano il bundle con UNAUTHORIZED, come una bundle_version
+// inferiore a quella già accettata per lo stesso issuer.
+//
+// Il bundle non è legato all'identità della sessione: è un bearer token, e
+// chiunque ne abbia una copia può offrirlo da qualsiasi sessione finché
+// non scade. La firma garantisce solo che i descrittori vengono
+// dall'issuer; chi deve sapere quale agente esegue il tool usa il mutual
+// TLS e scadenze brevi.
+func (r *CapabilityRegistry) RegisterBundle(s netquic.Conn, sb *pb.SignedBundle) ([]string, error) {
+	r.mu.Lock()
+	trust := r.trust
+	r.mu.Unlock()
+	if trust == nil {
+		return nil, axcp.NewError(pb.ErrorCode_UNAUTHORIZED, "no trusted keys for signed bundles")
+	}
+	bundle, err := trust.Verify(sb, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	expires := time.UnixMilli(int64(bundle.GetExpiresAt()))
+	tools := make([]*Tool, 0, len(bundle.GetTools()))
+	ids := make([]string, 0, len(bundle.GetTools()))
+	for _, desc := range bundle.GetTools() {
+		schemas, err := axcp.CompileCapability(desc)
+		if err != nil {
+			return nil, err
+		}
+		tools = append(tools, &Tool{Desc: desc, Schemas: schemas, Session: s, Issuer: bundle.GetIssuer(), Expires: expires})
+		ids = append(ids, desc.GetToolId())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if last := r.versions[bundle.GetIssuer()]; bundle.GetBundleVersion() < last {
+		return nil, axcp.NewError(pb.ErrorCode_UNAUTHORIZED,
+			"bundle version %d of %s older than %d", bundle.GetBundleVersion(), bundle.GetIssuer(), last)
+	}
+	r.versions[bundle.GetIssuer()] = bundle.GetBundleVersion()
+	for _, t := range tools {
+		r.add(t)
+	}
+	return ids, nil
+}
+
+// add registra tool sostituendo l'offerta della stessa sessione
+func (r *CapabilityRegistry) add(tool *Tool) {
+	id := tool.Desc.GetToolId()
+	tools := r.tools[id]
+	for i, t := range tools {
+		if t.Session == tool.Session {
+			tools[i] = tool
+			return
+		}
+	}
+	r.tools[id] = append(tools, tool)
+}
+
+// Lookup restituisce toolID come offerto dal primo agente che lo offre,
+// ignorando i bundle scaduti
+func (r *CapabilityRegistry) Lookup(toolID string) (*Tool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range r.tools[toolID] {
+		if t.live(now) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// Tools restituisce i tool_id registrati in ordine alfabetico, ignorando i
+// bundle scaduti
+func (r *CapabilityRegistry) Tools() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	ids := make([]string, 0, len(r.tools))
+	for id, tools := range r.tools {
+		for _, t := range tools {
+			if t.live(now) {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Catalog restituisce il descrittore di ogni tool registrato, come offerto
+// dal primo agente che lo offre, ignorando i bundle scaduti
+func (r *CapabilityRegistry) Catalog() []*pb.CapabilityDescriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	catalog := make([]*pb.CapabilityDescriptor, 0, len(r.tools))
+	for _, tools := range r.tools {
+		for _, t := range tools {
+			if t.live(now) {
+				catalog = append(catalog, t.Desc)
+				break
+			}
+		}
+	}
+	return catalog
+}
+
+// HandleEnvelope registra le CapabilityOffer, rispondendo con un
+// CapabilityAck, risponde alle CapabilityRequest con l'ack dei tool
+// disponibili e un TOOL_NOT_FOUND per gli altri e alle CapabilityQuery con
+// una pagina del catalogo. Gli ack proseguono verso il broker.
+func (r *CapabilityRegistry) HandleEnvelope(s netquic.Conn, env *axcp.Envelope) bool {
+	msg := env.GetCapabilityMsg()
+	switch {
+	case msg.GetOffer().GetBundle() != nil:
+		ids, err := r.RegisterBundle(s, msg.GetOffer().GetBundle())
+		if err != nil {
+			r.reject(s, env.GetTraceId(), err.(*axcp.Error))
+			return true
+		}
+		log.Printf("[capability] %s offre il bundle firmato %s", s.RemoteAddr(), strings.Join(ids, ", "))
+		r.ack(s, env.GetTraceId(), ids)
+		return true
+	case msg.GetOffer() != nil:
+		desc := msg.GetOffer().GetDesc()
+		if err := r.Register(s, desc); err != nil {
+			r.reject(s, env.GetTraceId(), err.(*axcp.Error))
+			return true
+		}
+		log.Printf("[capability] %s offre %s", s.RemoteAddr(), desc.GetToolId())
+		r.ack(s, env.GetTraceId(), []string{desc.GetToolId()})
+		return true
+	case msg.GetRequest() != nil:
+		ids := msg.GetRequest().GetIds()
+		if len(ids) == 0 {
+			r.reject(s, env.GetTraceId(), axcp.NewError(pb.ErrorCode_MALFORMED_REQUEST, "request without ids"))
+			return true
+		}
+		var accepted, missing []string
+		for _, id := range ids {
+			if _, ok := r.Lookup(id); ok {
+				accepted = append(accepted, id)
+			} else {
+				missing = append(missing, id)
+			}
+		}
+		if len(accepted) > 0 {
+			r.ack(s, env.GetTraceId(), accepted)
+		}
+		if len(missing) > 0 {
+			r.reject(s, env.GetTraceId(),
+				axcp.NewError(pb.ErrorCode_TOOL_NOT_FOUND, "unknown tools: %s", strings.Join(missing, ", ")))
+		}
+		return true
+	case msg.GetQuery() != nil:
+		page, err := axcp.QueryCatalog(r.Catalog(), msg.GetQuery())
+		if err != nil {
+			r.reject(s, env.GetTraceId(), err.(*axcp.Error))
+			return true
+		}
+		reply := axcp.NewEnvelope(env.GetTraceId(), 0)
+		reply.Payload = &pb.AxcpEnvelope_CapabilityMsg{CapabilityMsg: &pb.CapabilityMessage{
+			Kind: &pb.CapabilityMessage_Catalog{Catalog: page},
+		}}
+		if err := s.SendEnvelope(reply); err != nil {
+			log.Printf("[capability] invio catalogo a %s fallito: %v", s.RemoteAddr(), err)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// ack invia un CapabilityAck con i tool accettati
+func (r *CapabilityRegistry) ack(s netquic.Conn, traceID string, accepted []string) {
+	env := axcp.NewEnvelope(traceID, 0)
+	env.Payload = &pb.AxcpEnvelope_CapabilityMsg{CapabilityMsg: &pb.CapabilityMessage{
+		Kind: &pb.CapabilityMessage_Ack{Ack: &pb.CapabilityAck{Accepted: accepted}},
+	}}
+	if err := s.SendEnvelope(env); err != nil {
+		log.Printf("[capability] invio ack a %s fallito: %v", s.RemoteAddr(), err)
+	}
+}
+
+// reject invia un ErrorMessage
+func (r *CapabilityRegistry) reject(s netquic.Conn, traceID string, err *axcp.Error) {
+	log.Printf("[capability] messaggio di %s rifiutato: %v", s.RemoteAddr(), err)
+	if sendErr := s.SendEnvelope(axcp.NewErrorEnvelope(traceID, err)); sendErr != nil {
+		log.Printf("[capability] invio errore a %s fallito: %v", s.RemoteAddr(), sendErr)
+	}
+}
+
+// SessionClosed rimuove i tool offerti dalla sessione
+func (r *CapabilityRegistry) SessionClosed(s netquic.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, tools := range r.tools {
+		var kept []*Tool
+		for _, t := range tools {
+			if t.Session != s {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == 0 {
+			delete(r.tools, id)
+		} else {
+			r.tools[id] = kept
+		}
+	}
+}
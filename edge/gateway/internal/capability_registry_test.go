@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp/tool"
+	"github.com/tradephantom/axcp-spec/sdk/go/netquic"
+)
+
+// sendCapability invia un CapabilityMessage e restituisce la prima risposta
+func sendCapability(t *testing.T, conn netquic.Conn, msg *pb.CapabilityMessage) *axcp.Envelope {
+	t.Helper()
+	env := axcp.NewEnvelope("cap", 0)
+	env.Payload = &pb.AxcpEnvelope_CapabilityMsg{CapabilityMsg: msg}
+	require.NoError(t, conn.SendEnvelope(env))
+	reply, err := conn.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "cap", reply.GetTraceId())
+	return reply
+}
+
+func request(ids ...string) *pb.CapabilityMessage {
+	return &pb.CapabilityMessage{Kind: &pb.CapabilityMessage_Request{Request: &pb.CapabilityRequest{Ids: ids}}}
+}
+
+// Il registry accetta le offerte degli agenti, risponde alle richieste e
+// dimentica i tool di un agente disconnesso
+func TestServeCapabilityRegistry(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	registry := NewCapabilityRegistry()
+	go Serve(listener, func(env *pb.AxcpEnvelope) {}, func(td *pb.TelemetryDatagram) {}, registry)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agent, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	client, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer client.Close()
+
+	reply := sendCapability(t, agent, &pb.CapabilityMessage{Kind: &pb.CapabilityMessage_Offer{Offer: &pb.CapabilityOffer{
+		Desc: &pb.CapabilityDescriptor{ToolId: "search", TimeoutMs: 500},
+	}}})
+	assert.Equal(t, []string{"search"}, reply.GetCapabilityMsg().GetAck().GetAccepted())
+
+	reply = sendCapability(t, agent, &pb.CapabilityMessage{Kind: &pb.CapabilityMessage_Offer{Offer: &pb.CapabilityOffer{
+		Desc: &pb.CapabilityDescriptor{},
+	}}})
+	assert.Equal(t, uint32(pb.ErrorCode_MALFORMED_REQUEST), reply.GetError().GetCode())
+
+	// Uno schema non valido viene rifiutato con la diagnostica
+	reply = sendCapability(t, agent, &pb.CapabilityMessage{Kind: &pb.CapabilityMessage_Offer{Offer: &pb.CapabilityOffer{
+		Desc: &pb.CapabilityDescriptor{ToolId: "summarize", InputSchema: `{"type":"strin"}`},
+	}}})
+	assert.Equal(t, uint32(pb.ErrorCode_MALFORMED_REQUEST), reply.GetError().GetCode())
+	diag, ok := axcp.DiagnosticsOf(axcp.ErrorFromMessage(reply.GetError()))
+	require.True(t, ok)
+	assert.Equal(t, "/input_schema", diag.Violations[0].Path)
+
+	reply = sendCapability(t, client, request("search", "summarize"))
+	assert.Equal(t, []string{"search"}, reply.GetCapabilityMsg().GetAck().GetAccepted())
+	reply, err = client.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(pb.ErrorCode_TOOL_NOT_FOUND), reply.GetError().GetCode())
+	assert.Contains(t, reply.GetError().GetReason(), "summarize")
+
+	tool, ok := registry.Lookup("search")
+	require.True(t, ok)
+	assert.Equal(t, uint32(500), tool.Desc.GetTimeoutMs())
+	assert.NotNil(t, tool.Schemas)
+
+	require.NoError(t, agent.Close())
+	require.Eventually(t, func() bool { return len(registry.Tools()) == 0 }, 5*time.Second, time.Millisecond)
+	reply = sendCapability(t, client, request("search"))
+	assert.Equal(t, uint32(pb.ErrorCode_TOOL_NOT_FOUND), reply.GetError().GetCode())
+}
+
+// Le CapabilityQuery ricevono il catalogo filtrato, una pagina alla volta
+func TestServeCapabilityDiscovery(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	registry := NewCapabilityRegistry()
+	go Serve(listener, func(env *pb.AxcpEnvelope) {}, func(td *pb.TelemetryDatagram) {}, registry)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agent, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer agent.Close()
+	client, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer client.Close()
+
+	for _, desc := range []*pb.CapabilityDescriptor{
+		{ToolId: "search", ResourceHint: "low-latency", DescriptorVersion: "2.0.0"},
+		{ToolId: "summarize", ResourceHint: "secure-env", DescriptorVersion: "1.2.0", AuthScope: []string{"docs"}},
+		{ToolId: "translate", ResourceHint: "low-latency", DescriptorVersion: "1.0.0"},
+	} {
+		sendCapability(t, agent, &pb.CapabilityMessage{Kind: &pb.CapabilityMessage_Offer{Offer: &pb.CapabilityOffer{Desc: desc}}})
+	}
+
+	caller := tool.NewCaller(client)
+	go receive(client, caller.HandleEnvelope)
+
+	page, err := caller.Discover(ctx, &pb.CapabilityQuery{ResourceHint: "low-latency", PageSize: 1})
+	require.NoError(t, err)
+	require.Len(t, page.GetTools(), 1)
+	assert.Equal(t, "search", page.GetTools()[0].GetToolId())
+	assert.Equal(t, "search", page.GetNextPageToken())
+
+	tools, err := caller.DiscoverAll(ctx, &pb.CapabilityQuery{VersionMin: "1.1", PageSize: 1})
+	require.NoError(t, err)
+	require.Len(t, tools, 2)
+	assert.Equal(t, "search", tools[0].GetToolId())
+	assert.Equal(t, "summarize", tools[1].GetToolId())
+
+	tools, err = caller.DiscoverAll(ctx, &pb.CapabilityQuery{AuthScope: []string{"docs"}})
+	require.NoError(t, err)
+	require.Len(t, tools, 1)
+	assert.Equal(t, "summarize", tools[0].GetToolId())
+
+	// Una query non valida riceve MALFORMED_REQUEST dal gateway
+	env := axcp.NewQueryEnvelope("query", &pb.CapabilityQuery{VersionMin: "next"})
+	require.NoError(t, agent.SendEnvelope(env))
+	reply, err := agent.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(pb.ErrorCode_MALFORMED_REQUEST), reply.GetError().GetCode())
+}
+
+// Con un TrustStore il registry accetta solo bundle firmati con una catena
+// valida e mai più vecchi dell'ultimo accettato
+func TestServeSignedCapabilities(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	rootPub, rootKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	vendorPub, vendorKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	trust := axcp.NewTrustStore()
+	trust.Add("root", rootPub)
+	registry := NewCapabilityRegistry()
+	registry.SetTrust(trust)
+	go Serve(listener, func(env *pb.AxcpEnvelope) {}, func(td *pb.TelemetryDatagram) {}, registry)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agent, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	offer := func(sb *pb.SignedBundle) *axcp.Envelope {
+		return sendCapability(t, agent, &pb.CapabilityMessage{Kind: &pb.CapabilityMessage_Offer{Offer: &pb.CapabilityOffer{Bundle: sb}}})
+	}
+	sign := func(version uint64, key ed25519.PrivateKey) *pb.SignedBundle {
+		sb, err := axcp.SignBundle(&pb.CapabilityBundle{
+			Issuer:        "vendor",
+			BundleVersion: version,
+			ExpiresAt:     uint64(time.Now().Add(time.Hour).UnixMilli()),
+			Tools:         []*pb.CapabilityDescriptor{{ToolId: "search"}, {ToolId: "summarize"}},
+		}, key, axcp.Endorse("vendor", vendorPub, "root", rootKey, time.Time{}))
+		require.NoError(t, err)
+		return sb
+	}
+
+	reply := sendCapability(t, agent, &pb.CapabilityMessage{Kind: &pb.CapabilityMessage_Offer{Offer: &pb.CapabilityOffer{
+		Desc: &pb.CapabilityDescriptor{ToolId: "search"},
+	}}})
+	assert.Equal(t, uint32(pb.ErrorCode_UNAUTHORIZED), reply.GetError().GetCode(), "unsigned offer")
+
+	reply = offer(sign(2, vendorKey))
+	assert.Equal(t, []string{"search", "summarize"}, reply.GetCapabilityMsg().GetAck().GetAccepted())
+	tool, ok := registry.Lookup("summarize")
+	require.True(t, ok)
+	assert.Equal(t, "vendor", tool.Issuer)
+
+	reply = offer(sign(3, rootKey))
+	assert.Equal(t, uint32(pb.ErrorCode_UNAUTHORIZED), reply.GetError().GetCode(), "bad signature")
+	reply = offer(sign(1, vendorKey))
+	assert.Equal(t, uint32(pb.ErrorCode_UNAUTHORIZED), reply.GetError().GetCode(), "rollback")
+	assert.Contains(t, reply.GetError().GetReason(), "older")
+
+	// I tool di un bundle scaduto non vengono più elencati
+	assert.Equal(t, []string{"search", "summarize"}, registry.Tools())
+	registry.mu.Lock()
+	for _, tools := range registry.tools {
+		for _, tool := range tools {
+			tool.Expires = time.Now().Add(-time.Second)
+		}
+	}
+	registry.mu.Unlock()
+	assert.Empty(t, registry.Tools())
+	_, ok = registry.Lookup("search")
+	assert.False(t, ok)
+}
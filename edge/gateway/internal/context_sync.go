@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	axctx "github.com/tradephantom/axcp-spec/sdk/go/axcp/context"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"github.com/tradephantom/axcp-spec/sdk/go/netquic"
+)
+
+// ContextService mantiene il grafo dei contesti del gateway e lo replica
+// verso gli agenti edge con SyncSubscribe/SyncRequest (spec v0.2 §6.3)
+type ContextService struct {
+	engine *axctx.Engine
+	sync   *axctx.SyncServer
+	outbox *PatchOutbox
+
+	mu       sync.Mutex
+	sessions map[netquic.Conn]*nodeSession
+}
+
+// nodeSession ricorda chi è il nodo di una sessione e a cosa è sottoscritto,
+// per trattenerne i patch quando si disconnette
+type nodeSession struct {
+	nodeID string
+	subs   map[string][]string // filtri per contesto
+	// replayed è, per contesto, l'intervallo di versioni [first, next)
+	// coperto dal RetryEnvelope inviato alla riconnessione
+	replayed map[string][2]uint64
+}
+
+// NewContextService crea il servizio sopra engine
+func NewContextService(engine *axctx.Engine) *ContextService {
+	return &ContextService{engine: engine, sync: axctx.NewSyncServer(engine),
+		sessions: make(map[netquic.Conn]*nodeSession)}
+}
+
+// SetOutbox abilita lo store-and-forward verso i nodi che si sottoscrivono
+// con un node_id
+func (c *ContextService) SetOutbox(outbox *PatchOutbox) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outbox = outbox
+}
+
+// Engine restituisce il grafo dei contesti
+func (c *ContextService) Engine() *axctx.Engine {
+	return c.engine
+}
+
+// HandleEnvelope applica i ContextPatch e serve le richieste di replica.
+// Un patch applicato prosegue verso il broker, uno rifiutato riceve un
+// ErrorMessage e viene consumato.
+func (c *ContextService) HandleEnvelope(s netquic.Conn, env *axcp.Envelope) bool {
+	if patch := env.GetContextPatch(); patch != nil {
+		if _, err := c.engine.Apply(patch); err != nil {
+			log.Printf("[context] patch di %s rifiutato: %v", s.RemoteAddr(), err)
+			var axErr *axcp.Error
+			if errors.As(err, &axErr) {
+				_ = s.SendEnvelope(axcp.NewErrorEnvelope(env.GetTraceId(), axErr))
+			}
+			return true
+		}
+		return false
+	}
+
+	sub := env.GetSyncSub()
+	if sub != nil {
+		c.replayOffline(s, env.GetTraceId(), sub)
+	}
+	handled, err := c.sync.HandleEnvelope(s, env)
+	if err != nil {
+		log.Printf("[context] richiesta di replica di %s rifiutata: %v", s.RemoteAddr(), err)
+	} else if sub != nil {
+		c.remember(s, sub)
+	}
+	return handled
+}
+
+// replayOffline invia in un RetryEnvelope i patch trattenuti per il nodo
+// mentre era offline, prima del resto della sottoscrizione. Se il replay
+// copre la versione da cui il nodo si sottoscrive, la sottoscrizione
+// riparte dopo l'ultimo patch inviato: la history potrebbe non contenerli
+// più.
+func (c *ContextService) replayOffline(s netquic.Conn, traceID string, sub *pb.SyncSubscribe) {
+	nodeID := sub.GetNodeId()
+	c.mu.Lock()
+	outbox := c.outbox
+	c.mu.Unlock()
+	if outbox == nil || nodeID == "" {
+		return
+	}
+
+	if retry := outbox.Release(nodeID); retry != nil {
+		env := axcp.NewEnvelope(traceID, 0)
+		env.Payload = &pb.AxcpEnvelope_RetryEnv{RetryEnv: retry}
+		if err := s.SendEnvelope(env); err != nil {
+			log.Printf("[context] invio dei patch trattenuti per %s fallito: %v", nodeID, err)
+			return
+		}
+		log.Printf("[context] %d patch trattenuti inviati a %s", len(retry.GetBufferedPatches()), nodeID)
+
+		replayed := make(map[string][2]uint64)
+		for _, patch := range retry.GetBufferedPatches() {
+			r, ok := replayed[patch.GetContextId()]
+			if !ok {
+				r[0] = patch.GetBaseVersion()
+			}
+			r[1] = patch.GetBaseVersion() + 1
+			replayed[patch.GetContextId()] = r
+		}
+		c.mu.Lock()
+		c.sessions[s] = &nodeSession{nodeID: nodeID, subs: make(map[string][]string), replayed: replayed}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if session, ok := c.sessions[s]; ok {
+		from := sub.GetFrom()
+		if r, ok := session.replayed[from.GetContextId()]; ok && r[0] <= from.GetVersion() && from.GetVersion() < r[1] {
+			from.Version = r[1]
+		}
+	}
+}
+
+// remember registra la sottoscrizione di un nodo identificato
+func (c *ContextService) remember(s netquic.Conn, sub *pb.SyncSubscribe) {
+	if sub.GetNodeId() == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, ok := c.sessions[s]
+	if !ok || session.nodeID != sub.GetNodeId() {
+		session = &nodeSession{nodeID: sub.GetNodeId(), subs: make(map[string][]string)}
+		c.sessions[s] = session
+	}
+	session.subs[sub.GetFrom().GetContextId()] = sub.GetFilters()
+}
+
+// SessionClosed annulla le sottoscrizioni della sessione e, con lo
+// store-and-forward abilitato, inizia a trattenere i patch del nodo
+func (c *ContextService) SessionClosed(s netquic.Conn) {
+	c.sync.Unsubscribe(s)
+
+	c.mu.Lock()
+	session := c.sessions[s]
+	delete(c.sessions, s)
+	outbox := c.outbox
+	c.mu.Unlock()
+
+	if outbox == nil || session == nil {
+		return
+	}
+	subs := make([]subscription, 0, len(session.subs))
+	for id, filters := range session.subs {
+		subs = append(subs, subscription{contextID: id, filters: filters})
+	}
+	outbox.Hold(session.nodeID, c.engine, subs)
+}
+
+// Revoke rimuove un segmento del contesto e notifica ai sottoscrittori
+// una ContextInvalidation con motivo REVOKED
+func (c *ContextService) Revoke(contextID, path string) error {
+	_, err := c.engine.Invalidate(contextID, path, pb.ContextInvalidation_REVOKED)
+	return err
+}
+
+// RunExpiry rimuove ogni interval i segmenti scaduti (ttl_ms) e i patch
+// scaduti dell'outbox, finché ctx non termina
+func (c *ContextService) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := c.engine.ExpireDue(now); n > 0 {
+				log.Printf("[context] %d segmenti scaduti", n)
+			}
+			c.mu.Lock()
+			outbox := c.outbox
+			c.mu.Unlock()
+			if outbox == nil {
+				continue
+			}
+			if n := outbox.Sweep(now); n > 0 {
+				log.Printf("[context] %d nodi offline oltre il TTL, patch non più trattenuti", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	axctx "github.com/tradephantom/axcp-spec/sdk/go/axcp/context"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"github.com/tradephantom/axcp-spec/sdk/go/netquic"
+)
+
+// sendPatch invia un patch che imposta /n a value
+func sendPatch(t *testing.T, conn netquic.Conn, base uint64, value int) {
+	t.Helper()
+	op, err := axcp.NewDeltaOp(pb.DeltaOp_ADD, "/n", value)
+	require.NoError(t, err)
+	env := axcp.NewEnvelope("patch", 0)
+	env.Payload = &pb.AxcpEnvelope_ContextPatch{ContextPatch: &pb.ContextPatch{
+		ContextId: "ctx", BaseVersion: base, Ops: []*pb.DeltaOp{op},
+	}}
+	require.NoError(t, conn.SendEnvelope(env))
+}
+
+// follow sottoscrive il follower al contesto e applica ciò che arriva
+// finché la connessione resta aperta
+func follow(t *testing.T, f *axctx.Follower, conn netquic.Conn) {
+	require.NoError(t, f.Subscribe(conn, "ctx"))
+	go func() {
+		for {
+			env, err := conn.RecvEnvelope()
+			if err != nil {
+				return
+			}
+			if _, err := f.HandleEnvelope(conn, env); err != nil {
+				t.Errorf("follower: %v", err)
+			}
+		}
+	}()
+}
+
+// Una replica edge segue il contesto del gateway e recupera i patch persi
+// durante la disconnessione
+func TestServeReplicatesContexts(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{Latency: time.Millisecond})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	contexts := NewContextService(axctx.NewEngine())
+	envelopes := make(chan *pb.AxcpEnvelope, 16)
+	go Serve(listener,
+		func(env *pb.AxcpEnvelope) { envelopes <- env },
+		func(td *pb.TelemetryDatagram) {},
+		contexts,
+	)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	producer, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer producer.Close()
+
+	replica := axctx.NewFollower(axctx.NewEngine())
+	edge, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	follow(t, replica, edge)
+
+	sendPatch(t, producer, 0, 1)
+	sendPatch(t, producer, 1, 2)
+	require.Eventually(t, func() bool { return replica.Engine().Version("ctx") == 2 }, 5*time.Second, 5*time.Millisecond)
+
+	// Il patch applicato prosegue verso il broker
+	select {
+	case env := <-envelopes:
+		assert.NotNil(t, env.GetContextPatch())
+	case <-ctx.Done():
+		t.Fatal("patch not delivered to the handler")
+	}
+
+	require.NoError(t, edge.Close())
+	for v := 2; v < 5; v++ {
+		sendPatch(t, producer, uint64(v), v+1)
+	}
+	require.Eventually(t, func() bool { return contexts.Engine().Version("ctx") == 5 }, 5*time.Second, 5*time.Millisecond)
+
+	edge, err = network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer edge.Close()
+	follow(t, replica, edge)
+	require.Eventually(t, func() bool { return replica.Engine().Version("ctx") == 5 }, 5*time.Second, 5*time.Millisecond)
+
+	doc, ok := replica.Engine().Get("ctx")
+	require.True(t, ok)
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"n":5}`, string(data))
+}
+
+// Un patch non applicabile riceve un ErrorMessage e non arriva al broker
+func TestServeRejectsStalePatch(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	envelopes := make(chan *pb.AxcpEnvelope, 1)
+	go Serve(listener,
+		func(env *pb.AxcpEnvelope) { envelopes <- env },
+		func(td *pb.TelemetryDatagram) {},
+		NewContextService(axctx.NewEngine()),
+	)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agent, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	sendPatch(t, agent, 3, 1)
+	env, err := agent.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(pb.ErrorCode_INVALID_CONTEXT), env.GetError().GetCode())
+	assert.Empty(t, envelopes)
+}
+
+// Una sottoscrizione filtrata riceve solo i propri segmenti e le revoche
+func TestServeFilteredSubscription(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	contexts := NewContextService(axctx.NewEngine())
+	go Serve(listener, func(env *pb.AxcpEnvelope) {}, func(td *pb.TelemetryDatagram) {}, contexts)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	edge, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer edge.Close()
+
+	replica := axctx.NewFollower(axctx.NewEngine())
+	invalidated := make(chan *pb.ContextInvalidation, 1)
+	replica.SetInvalidationHandler(func(inv *pb.ContextInvalidation) { invalidated <- inv })
+	require.NoError(t, replica.Subscribe(edge, "ctx", "prefix=/user/"))
+	go func() {
+		for {
+			env, err := edge.RecvEnvelope()
+			if err != nil {
+				return
+			}
+			_, _ = replica.HandleEnvelope(edge, env)
+		}
+	}()
+
+	user, err := axcp.NewDeltaOp(pb.DeltaOp_ADD, "/user", map[string]any{"name": "ada"})
+	require.NoError(t, err)
+	order, err := axcp.NewDeltaOp(pb.DeltaOp_ADD, "/order", 7)
+	require.NoError(t, err)
+	_, err = contexts.Engine().Apply(&pb.ContextPatch{ContextId: "ctx", Ops: []*pb.DeltaOp{user, order}})
+	require.NoError(t, err)
+	// La replica ha ricevuto il patch: la sottoscrizione è attiva
+	require.Eventually(t, func() bool { return replica.Engine().Version("ctx") == 1 }, 5*time.Second, time.Millisecond)
+	require.NoError(t, contexts.Revoke("ctx", "/user/name"))
+
+	select {
+	case inv := <-invalidated:
+		assert.Equal(t, "/user/name", inv.GetPath())
+		assert.Equal(t, pb.ContextInvalidation_REVOKED, inv.GetReason())
+	case <-ctx.Done():
+		t.Fatal("invalidation not delivered")
+	}
+	doc, ok := replica.Engine().Get("ctx")
+	require.True(t, ok)
+	assert.Equal(t, map[string]any{"user": map[string]any{}}, doc.Value)
+}
+
+// Con lo store-and-forward una replica identificata riceve alla
+// riconnessione i patch trattenuti, anche se la history è stata compattata
+func TestServeStoreAndForward(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	contexts := NewContextService(axctx.NewEngine())
+	contexts.SetOutbox(NewPatchOutbox(time.Minute, 100))
+	go Serve(listener, func(env *pb.AxcpEnvelope) {}, func(td *pb.TelemetryDatagram) {}, contexts)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	replica := axctx.NewFollower(axctx.NewEngine())
+	replica.SetNodeID("edge-1")
+	edge, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	follow(t, replica, edge)
+
+	applyN(t, contexts.Engine(), "ctx", 2)
+	require.Eventually(t, func() bool { return replica.Engine().Version("ctx") == 2 }, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, edge.Close())
+	require.Eventually(t, func() bool {
+		contexts.mu.Lock()
+		defer contexts.mu.Unlock()
+		return len(contexts.sessions) == 0
+	}, 5*time.Second, time.Millisecond)
+	applyN(t, contexts.Engine(), "ctx", 3)
+	contexts.Engine().Compact("ctx", 5)
+
+	edge, err = network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer edge.Close()
+	follow(t, replica, edge)
+	require.Eventually(t, func() bool { return replica.Engine().Version("ctx") == 5 }, 5*time.Second, time.Millisecond)
+	assert.JSONEq(t, `{"n":5}`, contextJSON(t, replica.Engine(), "ctx"))
+}
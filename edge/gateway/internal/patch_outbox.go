@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	axctx "github.com/tradephantom/axcp-spec/sdk/go/axcp/context"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// PatchOutbox trattiene i ContextPatch destinati agli agenti offline
+// (store-and-forward, spec v0.2 §6.4). Mentre un nodo è disconnesso i
+// patch dei contesti a cui era sottoscritto si accumulano, nell'ordine di
+// applicazione; alla riconnessione vengono restituiti in un RetryEnvelope.
+// I patch più vecchi di TTL vengono scartati e contati; quando tutto ciò
+// che un nodo trattiene è scaduto, il nodo smette di essere seguito (vedi
+// Sweep).
+type PatchOutbox struct {
+	ttl      time.Duration
+	capacity int
+	now      func() time.Time
+	dropped  atomic.Uint64
+
+	mu    sync.Mutex
+	nodes map[string]*offlineNode
+}
+
+// offlineNode raccoglie i patch di un nodo disconnesso
+type offlineNode struct {
+	patches []heldPatch
+	cancels []func()
+	// expires è l'istante in cui scade l'ultimo patch trattenuto, o TTL
+	// dopo la disconnessione se non ne sono arrivati
+	expires time.Time
+}
+
+// prune scarta i patch scaduti a now, in testa alla coda perché accodati
+// con lo stesso TTL, e ne restituisce il numero
+func (n *offlineNode) prune(now time.Time) int {
+	expired := 0
+	for expired < len(n.patches) && !n.patches[expired].expires.After(now) {
+		expired++
+	}
+	n.patches = n.patches[expired:]
+	return expired
+}
+
+// heldPatch è un patch trattenuto con la sua scadenza
+type heldPatch struct {
+	patch   *pb.ContextPatch
+	expires time.Time
+}
+
+// subscription è una sottoscrizione di un nodo a un contesto
+type subscription struct {
+	contextID string
+	filters   []string
+}
+
+// NewPatchOutbox crea un outbox che trattiene al massimo capacity patch
+// per nodo, ciascuno per ttl
+func NewPatchOutbox(ttl time.Duration, capacity int) *PatchOutbox {
+	return &PatchOutbox{ttl: ttl, capacity: capacity, now: time.Now, nodes: make(map[string]*offlineNode)}
+}
+
+// Dropped restituisce il numero di patch scartati perché scaduti o oltre
+// la capacità
+func (o *PatchOutbox) Dropped() uint64 {
+	return o.dropped.Load()
+}
+
+// Hold inizia a trattenere per nodeID i patch dei contesti sottoscritti
+func (o *PatchOutbox) Hold(nodeID string, engine *axctx.Engine, subs []subscription) {
+	expires := o.now().Add(o.ttl)
+	node := &offlineNode{expires: expires}
+	o.mu.Lock()
+	if old, ok := o.nodes[nodeID]; ok {
+		// Due sessioni dello stesso nodo: si tiene la coda già accumulata
+		node = old
+		if expires.After(node.expires) {
+			node.expires = expires
+		}
+	}
+	o.nodes[nodeID] = node
+	o.mu.Unlock()
+
+	for _, sub := range subs {
+		filter, err := axctx.ParseFilter(sub.filters)
+		if err != nil {
+			continue
+		}
+		cancel, err := engine.Watch(sub.contextID, engine.Version(sub.contextID), func(patch *pb.ContextPatch) {
+			o.add(nodeID, filter.Apply(patch))
+		})
+		if err != nil {
+			continue
+		}
+		o.mu.Lock()
+		held := o.nodes[nodeID] == node
+		if held {
+			node.cancels = append(node.cancels, cancel)
+		}
+		o.mu.Unlock()
+		if !held {
+			// Il nodo si è già riconnesso
+			cancel()
+		}
+	}
+}
+
+// add accoda un patch per il nodo, scartando quelli scaduti e il più
+// vecchio oltre la capacità. Viene chiamato con il lock dell'engine.
+func (o *PatchOutbox) add(nodeID string, patch *pb.ContextPatch) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	node, ok := o.nodes[nodeID]
+	if !ok {
+		return
+	}
+	now := o.now()
+	if expired := node.prune(now); expired > 0 {
+		o.dropped.Add(uint64(expired))
+	}
+	node.expires = now.Add(o.ttl)
+	node.patches = append(node.patches, heldPatch{patch: patch, expires: node.expires})
+	if o.capacity > 0 && len(node.patches) > o.capacity {
+		node.patches = node.patches[1:]
+		o.dropped.Add(1)
+	}
+}
+
+// Release smette di trattenere i patch di nodeID e restituisce quelli non
+// scaduti in un RetryEnvelope, nil se non ce ne sono. ttl_ms è il tempo
+// residuo del patch più vecchio.
+func (o *PatchOutbox) Release(nodeID string) *pb.RetryEnvelope {
+	o.mu.Lock()
+	node, ok := o.nodes[nodeID]
+	delete(o.nodes, nodeID)
+	o.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// Fuori dal lock: cancel prende il lock dell'engine, che add tiene
+	for _, cancel := range node.cancels {
+		cancel()
+	}
+
+	now := o.now()
+	retry := &pb.RetryEnvelope{}
+	expired := node.prune(now)
+	for _, held := range node.patches {
+		if len(retry.BufferedPatches) == 0 {
+			retry.TtlMs = uint32(held.expires.Sub(now).Milliseconds())
+		}
+		retry.BufferedPatches = append(retry.BufferedPatches, held.patch)
+	}
+	if expired > 0 {
+		o.dropped.Add(uint64(expired))
+		log.Printf("[context] %d patch per %s scaduti offline", expired, nodeID)
+	}
+	if len(retry.BufferedPatches) == 0 {
+		return nil
+	}
+	return retry
+}
+
+// Sweep scarta i patch scaduti a now e smette di trattenere i nodi per cui
+// è scaduto tutto, annullandone le sottoscrizioni. Alla riconnessione
+// questi nodi recuperano i patch sottoscrivendosi dalla propria versione.
+// Restituisce il numero di nodi abbandonati.
+func (o *PatchOutbox) Sweep(now time.Time) int {
+	var cancels []func()
+	abandoned := 0
+	o.mu.Lock()
+	for nodeID, node := range o.nodes {
+		if expired := node.prune(now); expired > 0 {
+			o.dropped.Add(uint64(expired))
+		}
+		if node.expires.After(now) {
+			continue
+		}
+		delete(o.nodes, nodeID)
+		cancels = append(cancels, node.cancels...)
+		abandoned++
+	}
+	o.mu.Unlock()
+
+	// Fuori dal lock, come in Release
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return abandoned
+}
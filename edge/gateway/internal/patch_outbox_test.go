@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	axctx "github.com/tradephantom/axcp-spec/sdk/go/axcp/context"
+)
+
+func TestPatchOutboxHoldsPatchesInOrder(t *testing.T) {
+	engine := axctx.NewEngine()
+	applyN(t, engine, "ctx", 2)
+
+	outbox := NewPatchOutbox(time.Minute, 0)
+	assert.Nil(t, outbox.Release("edge-1"))
+
+	outbox.Hold("edge-1", engine, []subscription{{contextID: "ctx"}})
+	applyN(t, engine, "ctx", 3)
+	applyN(t, engine, "other", 1)
+
+	retry := outbox.Release("edge-1")
+	require.NotNil(t, retry)
+	require.Len(t, retry.GetBufferedPatches(), 3)
+	for i, patch := range retry.GetBufferedPatches() {
+		assert.Equal(t, uint64(2+i), patch.GetBaseVersion())
+	}
+	assert.InDelta(t, time.Minute.Milliseconds(), retry.GetTtlMs(), 1000)
+
+	// Dopo il rilascio non si trattiene più nulla
+	applyN(t, engine, "ctx", 1)
+	assert.Nil(t, outbox.Release("edge-1"))
+}
+
+func TestPatchOutboxDropsExpiredPatches(t *testing.T) {
+	engine := axctx.NewEngine()
+	now := time.Unix(1000, 0)
+	outbox := NewPatchOutbox(time.Second, 2)
+	outbox.now = func() time.Time { return now }
+
+	outbox.Hold("edge-1", engine, []subscription{{contextID: "ctx", filters: []string{"prefix=/n"}}})
+	applyN(t, engine, "ctx", 3)
+	assert.Equal(t, uint64(1), outbox.Dropped(), "oldest patch beyond capacity")
+
+	now = now.Add(2 * time.Second)
+	applyN(t, engine, "ctx", 1)
+	retry := outbox.Release("edge-1")
+	require.NotNil(t, retry)
+	require.Len(t, retry.GetBufferedPatches(), 1)
+	assert.Equal(t, uint64(3), retry.GetBufferedPatches()[0].GetBaseVersion())
+	assert.Equal(t, uint64(3), outbox.Dropped())
+}
+
+func TestPatchOutboxSweepsExpiredNodes(t *testing.T) {
+	engine := axctx.NewEngine()
+	now := time.Unix(1000, 0)
+	outbox := NewPatchOutbox(time.Second, 0)
+	outbox.now = func() time.Time { return now }
+
+	outbox.Hold("edge-1", engine, []subscription{{contextID: "ctx"}})
+	outbox.Hold("edge-2", engine, []subscription{{contextID: "ctx"}})
+	applyN(t, engine, "ctx", 2)
+
+	// Il patch successivo sgombra quelli scaduti senza aspettare Release
+	now = now.Add(1500 * time.Millisecond)
+	applyN(t, engine, "ctx", 1)
+	assert.Equal(t, uint64(4), outbox.Dropped())
+	assert.Equal(t, 0, outbox.Sweep(now), "l'ultimo patch è ancora valido")
+
+	// Senza nuovi patch i nodi vengono abbandonati allo scadere dell'ultimo
+	now = now.Add(500 * time.Millisecond)
+	outbox.Hold("edge-3", engine, []subscription{{contextID: "other"}})
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, 2, outbox.Sweep(now))
+	assert.Equal(t, uint64(6), outbox.Dropped())
+	assert.Nil(t, outbox.Release("edge-1"))
+
+	applyN(t, engine, "ctx", 1)
+	assert.Equal(t, uint64(6), outbox.Dropped(), "le sottoscrizioni sono annullate")
+	assert.Equal(t, 1, outbox.Sweep(now.Add(time.Second)), "nodo senza patch")
+}
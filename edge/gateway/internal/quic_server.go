@@ -3,11 +3,12 @@ package internal
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"log"
 
-	"github.com/quic-go/quic-go"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
 	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
-	"google.golang.org/protobuf/proto"
+	"github.com/tradephantom/axcp-spec/sdk/go/netquic"
 )
 
 // EnvelopeHandler gestisce i messaggi AXCP in arrivo
@@ -16,59 +17,133 @@ type EnvelopeHandler func(*pb.AxcpEnvelope)
 // TelemetryHandler gestisce i datagrammi di telemetria
 type TelemetryHandler func(*pb.TelemetryDatagram)
 
-// RunQuicServer avvia il server QUIC con supporto per stream e datagrammi
-func RunQuicServer(addr string, tlsConf *tls.Config, h EnvelopeHandler, dgram TelemetryHandler) error {
-	listener, err := quic.ListenAddr(addr, tlsConf, nil)
+// SessionService gestisce parte degli envelope di ogni sessione prima che
+// arrivino all'EnvelopeHandler, ad esempio la replica dei contesti
+type SessionService interface {
+	// HandleEnvelope restituisce true se l'envelope è stato consumato e non
+	// va passato all'EnvelopeHandler
+	HandleEnvelope(s netquic.Conn, env *axcp.Envelope) bool
+	// SessionClosed viene chiamato alla chiusura della sessione
+	SessionClosed(s netquic.Conn)
+}
+
+// RunQuicServer avvia il server QUIC con supporto per stream e datagrammi.
+// cfg definisce i profili accettati durante l'handshake (nil = default).
+func RunQuicServer(addr string, tlsConf *tls.Config, cfg *netquic.Config, h EnvelopeHandler, dgram TelemetryHandler, services ...SessionService) error {
+	listener, err := netquic.NewQUICTransport(tlsConf, cfg).Listen(addr)
 	if err != nil {
 		return err
 	}
-	log.Printf("[quic] in ascolto su %s", addr)
+	defer listener.Close()
+	return Serve(listener, h, dgram, services...)
+}
+
+// Serve accetta sessioni dal listener finché non viene chiuso.
+// Funziona con qualsiasi netquic.Transport, incluso il loopback in memoria
+// usato nei test. I services vedono ogni envelope prima di h.
+func Serve(listener netquic.Listener, h EnvelopeHandler, dgram TelemetryHandler, services ...SessionService) error {
+	log.Printf("[quic] in ascolto su %s", listener.Addr())
 
 	for {
-		conn, err := listener.Accept(context.Background())
+		session, err := listener.Accept(context.Background())
 		if err != nil {
 			return err
 		}
+		log.Printf("[quic] sessione %s, profilo negoziato %d", session.RemoteAddr(), session.Profile())
+		go serveSession(session, h, dgram, services)
+	}
+}
+
+// requestAcceptor è implementato dalle sessioni QUIC, che ricevono anche
+// richieste su stream dedicati (Call lato agente)
+type requestAcceptor interface {
+	AcceptRequest(ctx context.Context) (*netquic.Request, error)
+}
 
-		// Gestione stream
-		go func(c quic.Connection) {
-			for {
-				stream, err := c.AcceptStream(context.Background())
-				if err != nil {
-					log.Printf("[quic] errore accettazione stream: %v", err)
-					return
-				}
-
-				// Gestisci lo stream in una goroutine separata
-				go func(s quic.Stream) {
-					defer s.Close()
-					// TODO: Implementa la gestione del messaggio AXCP
-				}(stream)
+// serveSession gestisce stream e datagrammi di una singola sessione
+func serveSession(s netquic.Conn, h EnvelopeHandler, dgram TelemetryHandler, services []SessionService) {
+	defer s.Close()
+	for _, svc := range services {
+		defer svc.SessionClosed(s)
+	}
+
+	if acceptor, ok := s.(requestAcceptor); ok {
+		go refuseRequests(s, acceptor)
+	}
+
+	// Gestione datagrammi di telemetria (spec §5.8.1: 0xA0/0xA1 + seq u16 + protobuf),
+	// i batch vengono spacchettati da ReceiveTelemetry
+	go func() {
+		defer func() {
+			st := s.TelemetryStats()
+			log.Printf("[quic] telemetria %s: ricevuti %d, persi %d, fuori ordine %d, duplicati %d",
+				s.RemoteAddr(), st.Received, st.Lost, st.Reordered, st.Duplicates)
+		}()
+		for {
+			td, err := s.ReceiveTelemetry(s.Context())
+			if errors.Is(err, netquic.ErrInvalidDatagram) {
+				log.Printf("[quic] datagramma scartato: %v", err)
+				continue
 			}
-		}(conn)
-
-		// Gestione datagrammi
-		go func(c quic.Connection) {
-			for {
-				data, err := c.ReceiveDatagram(context.Background())
-				if err != nil {
-					log.Printf("[quic] errore ricezione datagramma: %v", err)
-					return
-				}
-
-				// Se il datagramma inizia con 0xA0, è un datagramma di telemetria
-				if len(data) > 0 && data[0] == 0xA0 {
-					var td pb.TelemetryDatagram
-					if err := proto.Unmarshal(data[1:], &td); err == nil {
-						// Log per debug con informazioni di base sul datagramma di telemetria
-						timestamp := td.GetTimestampMs()
-						log.Printf("[quic] ricevuto datagramma telemetria, timestamp: %d", timestamp)
-						dgram(&td)
-					} else {
-						log.Printf("[quic] errore unmarshal telemetria: %v", err)
-					}
-				}
+			if err != nil {
+				log.Printf("[quic] errore ricezione datagramma: %v", err)
+				return
 			}
-		}(conn)
+
+			// Log per debug con informazioni di base sul datagramma di telemetria
+			log.Printf("[quic] ricevuto datagramma telemetria, timestamp: %d", td.GetTimestampMs())
+			dgram(td)
+		}
+	}()
+
+	// Gestione envelope sullo stream di controllo
+	for {
+		env, err := s.RecvEnvelope()
+		if axcp.ErrorCodeOf(err) == pb.ErrorCode_PROFILE_MISMATCH {
+			// Il client ha già ricevuto l'ErrorMessage, la sessione resta valida
+			log.Printf("[quic] envelope rifiutato da %s: %v", s.RemoteAddr(), err)
+			continue
+		}
+		if err != nil {
+			log.Printf("[quic] sessione %s chiusa: %v", s.RemoteAddr(), err)
+			return
+		}
+		if td := env.GetTelemetry(); td != nil {
+			// Campione troppo grande per un datagramma, arrivato sullo stream
+			dgram(td)
+			continue
+		}
+		if consumed(services, s, env) {
+			continue
+		}
+		h(&env.AxcpEnvelope)
+	}
+}
+
+// refuseRequests risponde con MALFORMED_REQUEST a ogni richiesta aperta
+// dall'agente su uno stream dedicato: il gateway serve solo lo stream di
+// controllo, e senza risposta la Call dell'agente resterebbe in attesa
+// fino al suo timeout
+func refuseRequests(s netquic.Conn, acceptor requestAcceptor) {
+	for {
+		req, err := acceptor.AcceptRequest(s.Context())
+		if err != nil {
+			return
+		}
+		log.Printf("[quic] richiesta %s di %s rifiutata: usare lo stream di controllo", req.Envelope.GetTraceId(), s.RemoteAddr())
+		refusal := axcp.NewError(pb.ErrorCode_MALFORMED_REQUEST, "request streams are not served, send envelopes on the control stream")
+		if err := req.ReplyError(refusal); err != nil {
+			log.Printf("[quic] invio errore a %s fallito: %v", s.RemoteAddr(), err)
+		}
+	}
+}
+
+// consumed passa env ai services finché uno non lo consuma
+func consumed(services []SessionService, s netquic.Conn, env *axcp.Envelope) bool {
+	for _, svc := range services {
+		if svc.HandleEnvelope(s, env) {
+			return true
+		}
 	}
+	return false
 }
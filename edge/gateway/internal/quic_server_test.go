@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"github.com/tradephantom/axcp-spec/sdk/go/netquic"
+)
+
+// Gateway e agente sulla rete loopback: nessun socket UDP né certificato
+func TestServeLoopback(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{Latency: time.Millisecond})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	envelopes := make(chan *pb.AxcpEnvelope, 1)
+	telemetry := make(chan *pb.TelemetryDatagram, 1)
+	go Serve(listener,
+		func(env *pb.AxcpEnvelope) { envelopes <- env },
+		func(td *pb.TelemetryDatagram) { telemetry <- td },
+	)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agent, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	require.NoError(t, agent.SendEnvelope(axcp.NewEnvelope("hello", 0)))
+	require.NoError(t, agent.SendTelemetry(axcp.WithSystemStats(axcp.NewTelemetryDatagram(), 42, 1024, 50)))
+
+	select {
+	case env := <-envelopes:
+		assert.Equal(t, "hello", env.GetTraceId())
+	case <-ctx.Done():
+		t.Fatal("envelope not delivered to the handler")
+	}
+	select {
+	case td := <-telemetry:
+		assert.Equal(t, uint32(42), td.GetSystem().GetCpuPercent())
+	case <-ctx.Done():
+		t.Fatal("telemetry not delivered to the handler")
+	}
+}
+
+// Batch di datagrammi e campioni arrivati sullo stream finiscono tutti al
+// gestore della telemetria
+func TestServeUnpacksTelemetryBatch(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	envelopes := make(chan *pb.AxcpEnvelope, 1)
+	telemetry := make(chan *pb.TelemetryDatagram, 4)
+	go Serve(listener,
+		func(env *pb.AxcpEnvelope) { envelopes <- env },
+		func(td *pb.TelemetryDatagram) { telemetry <- td },
+	)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agent, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	var batch []*pb.TelemetryDatagram
+	for cpu := uint32(1); cpu <= 3; cpu++ {
+		batch = append(batch, axcp.WithSystemStats(axcp.NewTelemetryDatagram(), cpu, 1024, 50))
+	}
+	require.NoError(t, agent.SendTelemetryBatch(batch))
+
+	env := axcp.NewEnvelope("stream", 0)
+	env.Payload = &pb.AxcpEnvelope_Telemetry{Telemetry: axcp.WithSystemStats(axcp.NewTelemetryDatagram(), 4, 1024, 50)}
+	require.NoError(t, agent.SendEnvelope(env))
+
+	seen := make(map[uint32]bool)
+	for len(seen) < 4 {
+		select {
+		case td := <-telemetry:
+			seen[td.GetSystem().GetCpuPercent()] = true
+		case <-ctx.Done():
+			t.Fatalf("telemetry delivered: %v", seen)
+		}
+	}
+	assert.Empty(t, envelopes)
+}
+
+// Senza datagrammi QUIC la telemetria arriva sullo stream dedicato
+func TestServeTelemetryWithoutDatagrams(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{DisableDatagrams: true})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	telemetry := make(chan *pb.TelemetryDatagram, 1)
+	go Serve(listener,
+		func(env *pb.AxcpEnvelope) {},
+		func(td *pb.TelemetryDatagram) { telemetry <- td },
+	)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agent, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	require.NoError(t, agent.SendTelemetry(axcp.WithSystemStats(axcp.NewTelemetryDatagram(), 7, 1024, 50)))
+	select {
+	case td := <-telemetry:
+		assert.Equal(t, uint32(7), td.GetSystem().GetCpuPercent())
+	case <-ctx.Done():
+		t.Fatal("telemetry not delivered to the handler")
+	}
+}
+
+// Le richieste su stream dedicati ricevono subito un errore invece di
+// lasciare la Call dell'agente in attesa
+func TestServeRefusesRequestStreams(t *testing.T) {
+	listener, err := netquic.NewQUICTransport(netquic.InsecureTLSConfig(), nil).Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	go Serve(listener, func(env *pb.AxcpEnvelope) {}, func(td *pb.TelemetryDatagram) {})
+	defer listener.Close()
+
+	agent, err := netquic.Dial(listener.Addr().String(), netquic.InsecureTLSConfig())
+	require.NoError(t, err)
+	defer agent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = agent.Call(ctx, axcp.NewEnvelope("call", 0))
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, axcp.ErrorCodeOf(err))
+	assert.NoError(t, ctx.Err())
+}
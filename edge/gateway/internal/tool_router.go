@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp/tool"
+	"github.com/tradephantom/axcp-spec/sdk/go/netquic"
+)
+
+// ToolRouter instrada le ToolInvoke verso l'agente che offre il tool nel
+// CapabilityRegistry (spec v0.2 §7.3) e riporta al chiamante ToolProgress
+// e ToolResult. Argomenti e output vengono validati con gli schemi del
+// descrittore; allo scadere di timeout_ms il chiamante riceve TIMEOUT e
+// l'eventuale risultato tardivo viene scartato.
+type ToolRouter struct {
+	registry *CapabilityRegistry
+
+	mu sync.Mutex
+	// calls elenca le chiamate in corso per call_id assegnato dal gateway
+	calls map[string]*toolCall
+}
+
+// toolCall è una chiamata inoltrata in attesa del risultato
+type toolCall struct {
+	caller   netquic.Conn
+	callID   string // call_id del chiamante
+	traceID  string
+	tool     *Tool
+	provider netquic.Conn
+	timer    *time.Timer
+}
+
+// NewToolRouter crea un router sui tool di registry
+func NewToolRouter(registry *CapabilityRegistry) *ToolRouter {
+	return &ToolRouter{registry: registry, calls: make(map[string]*toolCall)}
+}
+
+// HandleEnvelope inoltra le ToolInvoke dei chiamanti e i ToolProgress e
+// ToolResult degli agenti
+func (r *ToolRouter) HandleEnvelope(s netquic.Conn, env *axcp.Envelope) bool {
+	switch {
+	case env.GetToolInvoke() != nil:
+		r.invoke(s, env.GetTraceId(), env.GetToolInvoke())
+		return true
+	case env.GetToolProgress() != nil:
+		progress := env.GetToolProgress()
+		c, ok := r.lookup(s, progress.GetCallId())
+		if ok {
+			out := axcp.NewEnvelope(c.traceID, 0)
+			out.Payload = &pb.AxcpEnvelope_ToolProgress{ToolProgress: &pb.ToolProgress{
+				CallId: c.callID, Fraction: progress.GetFraction(), Message: progress.GetMessage(),
+			}}
+			r.send(c.caller, out)
+		}
+		return true
+	case env.GetToolResult() != nil:
+		res := env.GetToolResult()
+		c, ok := r.lookup(s, res.GetCallId())
+		if !ok || !r.finish(res.GetCallId()) {
+			// Risultato tardivo di una chiamata già scaduta
+			return true
+		}
+		out := &pb.ToolResult{CallId: c.callID, Output: res.GetOutput(), Error: res.GetError()}
+		if res.GetError() == nil {
+			if err := c.tool.Schemas.ValidateOutput(res.GetOutput()); err != nil {
+				log.Printf("[tool] output di %s da %s rifiutato: %v", c.tool.Desc.GetToolId(), s.RemoteAddr(), err)
+				out.Output, out.Error = nil, err.(*axcp.Error).Message()
+			}
+		}
+		r.result(c.caller, c.traceID, out)
+		return true
+	default:
+		return false
+	}
+}
+
+// invoke valida la chiamata e la inoltra all'agente che offre il tool
+func (r *ToolRouter) invoke(s netquic.Conn, traceID string, invoke *pb.ToolInvoke) {
+	fail := func(err *axcp.Error) {
+		log.Printf("[tool] chiamata %s di %s rifiutata: %v", invoke.GetToolId(), s.RemoteAddr(), err)
+		r.result(s, traceID, &pb.ToolResult{CallId: invoke.GetCallId(), Error: err.Message()})
+	}
+	if invoke.GetCallId() == "" {
+		fail(axcp.NewError(pb.ErrorCode_MALFORMED_REQUEST, "invoke without call_id"))
+		return
+	}
+	t, ok := r.registry.Lookup(invoke.GetToolId())
+	if !ok {
+		fail(axcp.NewError(pb.ErrorCode_TOOL_NOT_FOUND, "tool %q not offered", invoke.GetToolId()))
+		return
+	}
+	if err := t.Schemas.ValidateInput(invoke.GetArguments()); err != nil {
+		fail(err.(*axcp.Error))
+		return
+	}
+
+	// L'agente vede un call_id del gateway: quelli dei chiamanti possono
+	// coincidere
+	c := &toolCall{caller: s, callID: invoke.GetCallId(), traceID: traceID, tool: t, provider: t.Session}
+	id := newCallID()
+	timeout := tool.Timeout(invoke, t.Desc)
+	r.mu.Lock()
+	r.calls[id] = c
+	if timeout > 0 {
+		c.timer = time.AfterFunc(timeout, func() { r.expire(id, timeout) })
+	}
+	r.mu.Unlock()
+
+	env := axcp.NewEnvelope(traceID, 0)
+	env.Payload = &pb.AxcpEnvelope_ToolInvoke{ToolInvoke: &pb.ToolInvoke{
+		CallId:    id,
+		ToolId:    invoke.GetToolId(),
+		Arguments: invoke.GetArguments(),
+		TimeoutMs: uint32(timeout / time.Millisecond),
+	}}
+	if err := t.Session.SendEnvelope(env); err != nil {
+		log.Printf("[tool] inoltro di %s a %s fallito: %v", invoke.GetToolId(), t.Session.RemoteAddr(), err)
+		if r.finish(id) {
+			fail(axcp.NewError(pb.ErrorCode_TOOL_NOT_FOUND, "tool %q unreachable", invoke.GetToolId()))
+		}
+		return
+	}
+	log.Printf("[tool] %s di %s inoltrato a %s", invoke.GetToolId(), s.RemoteAddr(), t.Session.RemoteAddr())
+}
+
+// lookup restituisce la chiamata id se è stata inoltrata all'agente s
+func (r *ToolRouter) lookup(s netquic.Conn, id string) (*toolCall, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.calls[id]
+	if !ok || c.provider != s {
+		return nil, false
+	}
+	return c, true
+}
+
+// finish rimuove la chiamata id, restituendo false se era già conclusa
+func (r *ToolRouter) finish(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.calls[id]
+	if !ok {
+		return false
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	delete(r.calls, id)
+	return true
+}
+
+// expire risponde TIMEOUT a una chiamata ancora in corso
+func (r *ToolRouter) expire(id string, timeout time.Duration) {
+	r.mu.Lock()
+	c, ok := r.calls[id]
+	delete(r.calls, id)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	err := axcp.NewError(pb.ErrorCode_TIMEOUT, "tool %q did not answer within %s", c.tool.Desc.GetToolId(), timeout)
+	log.Printf("[tool] chiamata di %s scaduta: %v", c.caller.RemoteAddr(), err)
+	r.result(c.caller, c.traceID, &pb.ToolResult{CallId: c.callID, Error: err.Message()})
+}
+
+// result invia un ToolResult al chiamante
+func (r *ToolRouter) result(s netquic.Conn, traceID string, res *pb.ToolResult) {
+	env := axcp.NewEnvelope(traceID, 0)
+	env.Payload = &pb.AxcpEnvelope_ToolResult{ToolResult: res}
+	r.send(s, env)
+}
+
+// send invia env, registrando l'eventuale errore
+func (r *ToolRouter) send(s netquic.Conn, env *axcp.Envelope) {
+	if err := s.SendEnvelope(env); err != nil {
+		log.Printf("[tool] invio a %s fallito: %v", s.RemoteAddr(), err)
+	}
+}
+
+// SessionClosed fa fallire le chiamate inoltrate alla sessione e scarta
+// quelle che aveva in corso come chiamante
+func (r *ToolRouter) SessionClosed(s netquic.Conn) {
+	r.mu.Lock()
+	var orphaned []*toolCall
+	for id, c := range r.calls {
+		if c.caller != s && c.provider != s {
+			continue
+		}
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		delete(r.calls, id)
+		if c.caller != s {
+			orphaned = append(orphaned, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range orphaned {
+		r.result(c.caller, c.traceID, &pb.ToolResult{
+			CallId: c.callID,
+			Error: axcp.NewError(pb.ErrorCode_TOOL_NOT_FOUND,
+				"agent offering %q disconnected", c.tool.Desc.GetToolId()).Message(),
+		})
+	}
+}
+
+// newCallID restituisce un call_id casuale
+func newCallID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
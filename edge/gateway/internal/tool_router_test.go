@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp/tool"
+	"github.com/tradephantom/axcp-spec/sdk/go/netquic"
+)
+
+// receive passa a handle gli envelope ricevuti da conn finché non si chiude
+func receive(conn netquic.Conn, handle func(*axcp.Envelope) bool) {
+	for {
+		env, err := conn.RecvEnvelope()
+		if err != nil {
+			return
+		}
+		handle(env)
+	}
+}
+
+// Il gateway instrada le chiamate all'agente che offre il tool, valida
+// argomenti e output e risponde TIMEOUT allo scadere di timeout_ms
+func TestServeToolRouter(t *testing.T) {
+	network := netquic.NewLoopbackNetwork(netquic.LoopbackOptions{})
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+
+	registry := NewCapabilityRegistry()
+	router := NewToolRouter(registry)
+	go Serve(listener, func(env *pb.AxcpEnvelope) {}, func(td *pb.TelemetryDatagram) {}, registry, router)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	agent, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	client, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	defer client.Close()
+
+	provider := tool.NewProvider(agent)
+	go receive(agent, provider.HandleEnvelope)
+	caller := tool.NewCaller(client)
+	go receive(client, caller.HandleEnvelope)
+
+	require.NoError(t, provider.Register(&pb.CapabilityDescriptor{
+		ToolId:       "add",
+		InputSchema:  `{"type":"object","required":["a","b"],"properties":{"a":{"type":"number"},"b":{"type":"number"}}}`,
+		OutputSchema: `{"type":"number"}`,
+	}, func(ctx context.Context, args json.RawMessage, progress func(float32, string)) (any, error) {
+		var in struct{ A, B float64 }
+		if err := json.Unmarshal(args, &in); err != nil {
+			return nil, err
+		}
+		progress(0.5, "adding")
+		return in.A + in.B, nil
+	}))
+	release := make(chan struct{})
+	defer close(release)
+	require.NoError(t, provider.Register(&pb.CapabilityDescriptor{ToolId: "slow", TimeoutMs: 50},
+		func(ctx context.Context, args json.RawMessage, progress func(float32, string)) (any, error) {
+			<-release
+			return "late", nil
+		}))
+	started := make(chan struct{})
+	require.NoError(t, provider.Register(&pb.CapabilityDescriptor{ToolId: "hang"},
+		func(ctx context.Context, args json.RawMessage, progress func(float32, string)) (any, error) {
+			close(started)
+			<-release
+			return nil, nil
+		}))
+	require.Eventually(t, func() bool { return len(registry.Tools()) == 3 }, 5*time.Second, time.Millisecond)
+
+	var steps []string
+	out, err := caller.CallWithProgress(ctx, "add", map[string]int{"a": 2, "b": 3}, func(p *pb.ToolProgress) {
+		steps = append(steps, p.GetMessage())
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `5`, string(out))
+	assert.Equal(t, []string{"adding"}, steps)
+
+	_, err = caller.Call(ctx, "add", map[string]string{"a": "2"})
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, axcp.ErrorCodeOf(err))
+	diag, ok := axcp.DiagnosticsOf(err)
+	require.True(t, ok)
+	assert.NotEmpty(t, diag.Violations)
+
+	_, err = caller.Call(ctx, "missing", nil)
+	assert.Equal(t, pb.ErrorCode_TOOL_NOT_FOUND, axcp.ErrorCodeOf(err))
+
+	start := time.Now()
+	_, err = caller.Call(ctx, "slow", nil)
+	assert.Equal(t, pb.ErrorCode_TIMEOUT, axcp.ErrorCodeOf(err))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Una chiamata in corso fallisce se l'agente si disconnette
+	done := make(chan error, 1)
+	go func() {
+		_, err := caller.Call(ctx, "hang", nil)
+		done <- err
+	}()
+	<-started
+	require.NoError(t, agent.Close())
+	require.Eventually(t, func() bool { return len(registry.Tools()) == 0 }, 5*time.Second, time.Millisecond)
+	select {
+	case err := <-done:
+		assert.Equal(t, pb.ErrorCode_TOOL_NOT_FOUND, axcp.ErrorCodeOf(err))
+	case <-ctx.Done():
+		require.FailNow(t, "call still pending")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tlsConfig is the tls section of config.yaml
+type tlsConfig struct {
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	CA         string `yaml:"ca"`
+	ServerName string `yaml:"server_name"`
+	Insecure   bool   `yaml:"insecure"`
+}
+
+// agentConfig mirrors config.yaml
+type agentConfig struct {
+	Gateway     string    `yaml:"gateway"`
+	Profile     uint32    `yaml:"profile"`
+	IntervalSec int       `yaml:"interval_sec"`
+	TLS         tlsConfig `yaml:"tls"`
+}
+
+// defaultConfig is used for the keys missing from config.yaml
+func defaultConfig() agentConfig {
+	return agentConfig{
+		Gateway:     "192.168.1.10:7143",
+		Profile:     0,
+		IntervalSec: 5,
+	}
+}
+
+// loadConfig reads the YAML file at path over the defaults.
+// An empty path returns the defaults.
+func loadConfig(path string) (agentConfig, error) {
+	c := defaultConfig()
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("error reading config: %v", err)
+	}
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("error parsing config %s: %v", path, err)
+	}
+	return c, nil
+}
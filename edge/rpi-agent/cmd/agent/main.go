@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -8,20 +10,13 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/tradephantom/axcp-spec/edge/rpi-agent/internal/netquic"
 	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
-	"google.golang.org/protobuf/proto"
 )
 
-var cfg = struct {
-	Gateway string
-	Profile uint32
-}{
-	Gateway: "192.168.1.10:7143",
-	Profile: 0,
-}
+var cfg = defaultConfig()
 
 // getCPUPercent returns the current CPU usage percentage
 func getCPUPercent() uint32 {
@@ -37,8 +32,9 @@ func getCPUTemperature() uint32 {
 	return 0
 }
 
-// sendTelemetry collects and logs system telemetry data (for UDP benchmarking)
-func sendTelemetry() error {
+// sendTelemetry collects system stats and sends them to the gateway as a
+// telemetry datagram
+func sendTelemetry(client *netquic.Client) error {
 	// Get system stats
 	vmStat, err := mem.VirtualMemory()
 	if err != nil {
@@ -57,58 +53,86 @@ func sendTelemetry() error {
 		},
 	}
 
-	// Wrap in envelope
-	env := &pb.AxcpEnvelope{
-		Version: 1,
-		TraceId: uuid.New().String(),
-		Profile: cfg.Profile, // Use configured profile
-		Payload: &pb.AxcpEnvelope_Telemetry{
-			Telemetry: tel,
-		},
-	}
-
-	// Serialize the envelope
-	data, err := proto.Marshal(env)
-	if err != nil {
-		return fmt.Errorf("error marshaling telemetry: %v", err)
+	// Framed by the client as 0xA0 + sequence + protobuf
+	if err := client.SendTelemetry(tel); err != nil {
+		return fmt.Errorf("error sending telemetry: %v", err)
 	}
-
-	log.Printf("Collected telemetry: %d bytes (would send in non-benchmark mode)", len(data))
 	return nil
 }
 
-// sendHello simulates sending a hello message (for UDP benchmarking)
-func sendHello() error {
-	log.Printf("Would send hello message in UDP benchmark mode")
-	return nil
+// buildTLSConfig returns the TLS configuration for the gateway connection
+func buildTLSConfig(c tlsConfig) (*tls.Config, error) {
+	if c.Insecure {
+		log.Printf("Warning: TLS verification disabled (tls.insecure), development only")
+		return netquic.InsecureTLSConfig(), nil
+	}
+	return netquic.NewTLSConfig(netquic.TLSOptions{
+		CertFile:   c.Cert,
+		KeyFile:    c.Key,
+		CAFile:     c.CA,
+		ServerName: c.ServerName,
+	})
 }
 
 func main() {
-	log.Println("AXCP Agent starting in UDP benchmark mode...")
+	configPath := flag.String("config", "", "Path to config.yaml")
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate for mutual TLS (overrides tls.cert)")
+	tlsKey := flag.String("tls-key", "", "PEM client private key (overrides tls.key)")
+	tlsCA := flag.String("tls-ca", "", "PEM bundle of the CAs trusted to sign the gateway certificate (overrides tls.ca)")
+	tlsServerName := flag.String("tls-server-name", "", "Name expected in the gateway certificate (overrides tls.server_name)")
+	tlsInsecure := flag.Bool("tls-insecure", false, "Skip gateway certificate verification (development only)")
+	flag.Parse()
+
+	var err error
+	if cfg, err = loadConfig(*configPath); err != nil {
+		log.Fatalf("%v", err)
+	}
+	// Flags win over config.yaml
+	if *tlsCert != "" {
+		cfg.TLS.Cert = *tlsCert
+	}
+	if *tlsKey != "" {
+		cfg.TLS.Key = *tlsKey
+	}
+	if *tlsCA != "" {
+		cfg.TLS.CA = *tlsCA
+	}
+	if *tlsServerName != "" {
+		cfg.TLS.ServerName = *tlsServerName
+	}
+	cfg.TLS.Insecure = cfg.TLS.Insecure || *tlsInsecure
+
+	tlsConf, err := buildTLSConfig(cfg.TLS)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	client, err := netquic.Dial(cfg.Gateway, tlsConf, cfg.Profile)
+	if err != nil {
+		log.Fatalf("Error connecting to %s: %v", cfg.Gateway, err)
+	}
+	defer client.Close()
+	log.Printf("Connected to %s, profile %d", client.RemoteAddr(), client.Profile())
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Send initial hello message
-	if err := sendHello(); err != nil {
-		log.Printf("Warning: Failed to send hello: %v", err)
-	}
-
 	// Main loop - collect telemetry periodically
-	ticker := time.NewTicker(5 * time.Second)
+	interval := time.Duration(cfg.IntervalSec) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	log.Println("AXCP Agent started in UDP benchmark mode")
+	log.Println("AXCP Agent started")
 	log.Println("Press Ctrl+C to exit")
 
 	for {
 		select {
 		case <-ticker.C:
-			if err := sendTelemetry(); err != nil {
-				log.Printf("Error collecting telemetry: %v", err)
-			} else {
-				log.Printf("Telemetry collected successfully")
+			if err := sendTelemetry(client); err != nil {
+				log.Printf("Error sending telemetry: %v", err)
 			}
 
 		case sig := <-sigChan:
@@ -1,40 +1,18 @@
 package netquic
 
-import "log"
+import (
+	"crypto/tls"
 
-// Client represents a simple UDP client for benchmarking
-type Client struct {
-	// No connection state needed for now as we're just doing UDP benchmarking
-}
-
-// QUICConn is an interface for connection operations
-type QUICConn interface {
-	// SendDatagram sends a datagram over the connection
-	SendDatagram(data []byte) error
-	// Close closes the connection
-	Close() error
-}
-
-// Dial creates a new client (placeholder for UDP benchmarking)
-func Dial(addr string, tlsConf interface{}) (*Client, error) {
-	log.Printf("Running in UDP benchmark mode. No QUIC connection will be established.")
-	return &Client{}, nil
-}
-
-// Close cleans up client resources
-func (c *Client) Close() error {
-	// Nothing to close in UDP benchmark mode
-	return nil
-}
+	sdknetquic "github.com/tradephantom/axcp-spec/sdk/go/netquic"
+)
 
-// SendDatagram simulates sending a datagram (logs the action in benchmark mode)
-func (c *Client) SendDatagram(data []byte) error {
-	// Check if the datagram is too large
-	if len(data) > MaxDatagramSize {
-		log.Printf("Datagram too large: %d bytes (max %d)", len(data), MaxDatagramSize)
-	}
+// Client is the SDK QUIC client connected to the gateway
+type Client = sdknetquic.Client
 
-	// Log the action in benchmark mode
-	log.Printf("Would send datagram: %d bytes", len(data))
-	return nil
+// Dial connects to the gateway at addr over QUIC. tlsConf is the one built
+// by NewTLSConfig, so the CA pinning and the client certificate for mutual
+// TLS apply to the connection. The handshake fails unless the session
+// profile is at least minProfile.
+func Dial(addr string, tlsConf *tls.Config, minProfile uint32) (*Client, error) {
+	return sdknetquic.DialWithConfig(addr, tlsConf, &sdknetquic.Config{MinProfile: minProfile})
 }
@@ -1,4 +0,0 @@
-package netquic
-
-// MaxDatagramSize is the maximum size of a datagram
-const MaxDatagramSize = 1200 // Conservative MTU for datagrams
@@ -1,9 +1,9 @@
 package netquic
 
 import (
-	"encoding/binary"
-	"fmt"
 	"io"
+
+	sdknetquic "github.com/tradephantom/axcp-spec/sdk/go/netquic"
 )
 
 // StreamMessage represents a message that can be sent or received over a stream
@@ -11,53 +11,18 @@ type StreamMessage struct {
 	Data []byte
 }
 
-// SendMessage sends a message over a stream with a length prefix
-// The message format is: [4-byte length][message data]
+// codec is the SDK stream codec shared with the gateway
+var codec = sdknetquic.NewFrameCodec(sdknetquic.DefaultMaxFrameSize)
+
+// SendMessage sends a message over a stream as an SDK message frame,
+// so the agent and the gateway share the same wire format.
 func SendMessage(w io.Writer, data []byte) error {
-	// Prefix the message with its length (4 bytes, little-endian)
-	lenBuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lenBuf, uint32(len(data)))
-	
-	// Send the length prefix
-	if _, err := w.Write(lenBuf); err != nil {
-		return fmt.Errorf("failed to write length prefix: %w", err)
-	}
-	
-	// Send the actual data (if any)
-	if len(data) > 0 {
-		if _, err := w.Write(data); err != nil {
-			return fmt.Errorf("failed to write message: %w", err)
-		}
-	}
-	
-	return nil
+	return codec.WriteFrame(w, sdknetquic.FrameMessage, data)
 }
 
-// ReceiveMessage receives a message from a stream with a length prefix
-// The expected message format is: [4-byte length][message data]
+// ReceiveMessage receives a message frame from a stream.
+// Frames larger than the SDK default limit are rejected with
+// *sdknetquic.FrameTooLargeError.
 func ReceiveMessage(r io.Reader) ([]byte, error) {
-	// Read the length prefix (4 bytes, little-endian)
-	lenBuf := make([]byte, 4)
-	if _, err := io.ReadFull(r, lenBuf); err != nil {
-		return nil, fmt.Errorf("failed to read length prefix: %w", err)
-	}
-	
-	// Get the message length
-	msgLen := binary.LittleEndian.Uint32(lenBuf)
-	if msgLen > 10*1024*1024 { // Sanity check: limit message size to 10MB
-		return nil, fmt.Errorf("message too large: %d bytes", msgLen)
-	}
-	
-	// If there's no data, return an empty slice
-	if msgLen == 0 {
-		return []byte{}, nil
-	}
-	
-	// Read the message data
-	data := make([]byte, msgLen)
-	if _, err := io.ReadFull(r, data); err != nil {
-		return nil, fmt.Errorf("failed to read message: %w", err)
-	}
-	
-	return data, nil
+	return codec.ReadFrameOf(r, sdknetquic.FrameMessage)
 }
@@ -1,45 +1,22 @@
 package netquic
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"math/big"
-	"time"
-)
 
-func InsecureTLSConfig() *tls.Config {
-	cert, _ := generateCert()
-	return &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"axcp/1"},
-	}
-}
+	sdknetquic "github.com/tradephantom/axcp-spec/sdk/go/netquic"
+)
 
-func generateCert() (tls.Certificate, error) {
-	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"Test"},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-	}
+// TLSOptions describes the PEM files of the agent (see the SDK for details)
+type TLSOptions = sdknetquic.TLSOptions
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
+// NewTLSConfig builds the client TLS configuration used to reach the
+// gateway: CA pinning, optional client certificate for mutual TLS with
+// hot-reload on rotation, and the axcp/1 ALPN.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	return sdknetquic.NewClientTLSConfig(opts)
+}
 
-	return tls.Certificate{
-		Certificate: [][]byte{certDER},
-		PrivateKey:  priv,
-	}, nil
+// InsecureTLSConfig skips gateway verification. Development only.
+func InsecureTLSConfig() *tls.Config {
+	return sdknetquic.InsecureTLSConfig()
 }
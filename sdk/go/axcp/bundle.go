@@ -0,0 +1,219 @@
+package axcp
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Domain separation prefixes of the signed messages
+const (
+	bundleDomain      = "axcp-bundle-v1\x00"
+	endorsementDomain = "axcp-endorsement-v1\x00"
+)
+
+// maxChain bounds the endorsements followed to reach a trusted key
+const maxChain = 8
+
+// SignBundle encodes b and signs it with key, the key of b.Issuer. chain
+// certifies that key up to a key trusted by the verifier; it may be empty
+// when the verifier trusts key itself.
+func SignBundle(b *CapabilityBundle, key ed25519.PrivateKey, chain ...*KeyEndorsement) (*SignedBundle, error) {
+	if err := checkBundle(b); err != nil {
+		return nil, err
+	}
+	data, err := proto.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedBundle{
+		Bundle:    data,
+		Signature: ed25519.Sign(key, append([]byte(bundleDomain), data...)),
+		Chain:     chain,
+	}, nil
+}
+
+// DecodeBundle returns the bundle carried by sb, without verifying it
+func DecodeBundle(sb *SignedBundle) (*CapabilityBundle, error) {
+	var b CapabilityBundle
+	if err := proto.Unmarshal(sb.GetBundle(), &b); err != nil {
+		return nil, NewError(pb.ErrorCode_MALFORMED_REQUEST, "invalid bundle: %v", err)
+	}
+	if err := checkBundle(&b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// checkBundle checks the fields every bundle must set
+func checkBundle(b *CapabilityBundle) error {
+	switch {
+	case b.GetIssuer() == "":
+		return NewError(pb.ErrorCode_MALFORMED_REQUEST, "bundle without issuer")
+	case b.GetExpiresAt() == 0 || b.GetExpiresAt() < b.GetIssuedAt():
+		return NewError(pb.ErrorCode_MALFORMED_REQUEST, "bundle of %s without a valid expiry", b.GetIssuer())
+	}
+	for _, desc := range b.GetTools() {
+		if desc.GetToolId() == "" {
+			return NewError(pb.ErrorCode_MALFORMED_REQUEST, "bundle of %s lists a tool without tool_id", b.GetIssuer())
+		}
+	}
+	return nil
+}
+
+// Endorse certifies subjectKey as the key of subject, signed with the key
+// of issuer. A zero expires never expires.
+func Endorse(subject string, subjectKey ed25519.PublicKey, issuer string, issuerKey ed25519.PrivateKey, expires time.Time) *KeyEndorsement {
+	e := &KeyEndorsement{Subject: subject, SubjectKey: subjectKey, Issuer: issuer}
+	if !expires.IsZero() {
+		e.ExpiresAt = uint64(expires.UnixMilli())
+	}
+	e.Signature = ed25519.Sign(issuerKey, endorsementMessage(e))
+	return e
+}
+
+// endorsementMessage returns the bytes signed by an endorsement: the
+// domain prefix, then subject, subject_key and issuer each preceded by its
+// uvarint length, then expires_at as 8 big-endian bytes
+func endorsementMessage(e *KeyEndorsement) []byte {
+	msg := []byte(endorsementDomain)
+	for _, field := range [][]byte{[]byte(e.GetSubject()), e.GetSubjectKey(), []byte(e.GetIssuer())} {
+		msg = binary.AppendUvarint(msg, uint64(len(field)))
+		msg = append(msg, field...)
+	}
+	return binary.BigEndian.AppendUint64(msg, e.GetExpiresAt())
+}
+
+// TrustStore holds the ed25519 keys trusted to sign capability bundles,
+// directly or by endorsing other keys. It is safe for concurrent use.
+type TrustStore struct {
+	mu   sync.RWMutex
+	keys map[string]ed25519.PublicKey
+}
+
+// NewTrustStore returns an empty store
+func NewTrustStore() *TrustStore {
+	return &TrustStore{keys: make(map[string]ed25519.PublicKey)}
+}
+
+// LoadTrustStore reads a file of trusted keys, see ReadTrustStore
+func LoadTrustStore(path string) (*TrustStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTrustStore(f)
+}
+
+// ReadTrustStore reads trusted keys, one "<name> <base64 public key>" per
+// line. Blank lines and lines starting with # are ignored.
+func ReadTrustStore(r io.Reader) (*TrustStore, error) {
+	t := NewTrustStore()
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want <name> <key>", n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("line %d: invalid ed25519 public key", n)
+		}
+		t.Add(fields[0], key)
+	}
+	return t, scanner.Err()
+}
+
+// Add trusts key under name
+func (t *TrustStore) Add(name string, key ed25519.PublicKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys[name] = key
+}
+
+// Len returns the number of trusted keys
+func (t *TrustStore) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.keys)
+}
+
+// Verify checks the signature of sb and its chain up to a trusted key, at
+// time now, and returns the bundle. A bad signature, a broken or expired
+// chain and an expired bundle fail with UNAUTHORIZED, an undecodable
+// bundle with MALFORMED_REQUEST.
+func (t *TrustStore) Verify(sb *SignedBundle, now time.Time) (*CapabilityBundle, error) {
+	b, err := DecodeBundle(sb)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(now.UnixMilli()) >= b.GetExpiresAt() {
+		return nil, NewError(pb.ErrorCode_UNAUTHORIZED, "bundle of %s expired", b.GetIssuer())
+	}
+	if len(sb.GetChain()) > maxChain {
+		return nil, NewError(pb.ErrorCode_UNAUTHORIZED, "chain of %s longer than %d", b.GetIssuer(), maxChain)
+	}
+	key, err := t.resolve(b.GetIssuer(), sb.GetChain(), now)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, append([]byte(bundleDomain), sb.GetBundle()...), sb.GetSignature()) {
+		return nil, NewError(pb.ErrorCode_UNAUTHORIZED, "bad signature on bundle of %s", b.GetIssuer())
+	}
+	return b, nil
+}
+
+// resolve returns the key of name, trusted or endorsed by chain
+func (t *TrustStore) resolve(name string, chain []*KeyEndorsement, now time.Time) (ed25519.PublicKey, error) {
+	t.mu.RLock()
+	key, ok := t.keys[name]
+	t.mu.RUnlock()
+	if ok && len(key) == ed25519.PublicKeySize {
+		return key, nil
+	}
+	if len(chain) == 0 {
+		return nil, NewError(pb.ErrorCode_UNAUTHORIZED, "no trusted key for %s", name)
+	}
+
+	e := chain[0]
+	switch {
+	case e.GetSubject() != name:
+		return nil, NewError(pb.ErrorCode_UNAUTHORIZED, "chain broken: endorsement of %s where %s was expected", e.GetSubject(), name)
+	case len(e.GetSubjectKey()) != ed25519.PublicKeySize:
+		return nil, NewError(pb.ErrorCode_MALFORMED_REQUEST, "invalid key endorsed for %s", name)
+	case e.GetExpiresAt() != 0 && uint64(now.UnixMilli()) >= e.GetExpiresAt():
+		return nil, NewError(pb.ErrorCode_UNAUTHORIZED, "endorsement of %s by %s expired", name, e.GetIssuer())
+	}
+	parent, err := t.resolve(e.GetIssuer(), chain[1:], now)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(parent, endorsementMessage(e), e.GetSignature()) {
+		return nil, NewError(pb.ErrorCode_UNAUTHORIZED, "bad signature on endorsement of %s by %s", name, e.GetIssuer())
+	}
+	return e.GetSubjectKey(), nil
+}
+
+// NewBundleOfferEnvelope returns a CapabilityOffer of every tool of sb
+func NewBundleOfferEnvelope(traceID string, sb *SignedBundle) *Envelope {
+	env := NewEnvelope(traceID, 0)
+	env.Payload = &pb.AxcpEnvelope_CapabilityMsg{CapabilityMsg: &pb.CapabilityMessage{
+		Kind: &pb.CapabilityMessage_Offer{Offer: &pb.CapabilityOffer{Bundle: sb}},
+	}}
+	return env
+}
@@ -0,0 +1,94 @@
+package axcp
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	return pub, priv
+}
+
+func TestVerifyBundle(t *testing.T) {
+	now := time.Now()
+	rootPub, rootKey := newKey(t)
+	vendorPub, vendorKey := newKey(t)
+	_, otherKey := newKey(t)
+
+	trust := NewTrustStore()
+	trust.Add("root", rootPub)
+	bundle := &CapabilityBundle{
+		Issuer:        "vendor",
+		BundleVersion: 3,
+		IssuedAt:      uint64(now.UnixMilli()),
+		ExpiresAt:     uint64(now.Add(time.Hour).UnixMilli()),
+		Tools:         []*Capability{{ToolId: "search", DescriptorVersion: "1.0.0"}},
+	}
+	endorsement := Endorse("vendor", vendorPub, "root", rootKey, now.Add(24*time.Hour))
+
+	sb, err := SignBundle(bundle, vendorKey, endorsement)
+	require.NoError(t, err)
+	got, err := trust.Verify(sb, now)
+	require.NoError(t, err)
+	assert.Equal(t, "search", got.GetTools()[0].GetToolId())
+	assert.Equal(t, uint64(3), got.GetBundleVersion())
+
+	// Without the endorsement the vendor key is unknown
+	unchained, err := SignBundle(bundle, vendorKey)
+	require.NoError(t, err)
+	_, err = trust.Verify(unchained, now)
+	assert.Equal(t, pb.ErrorCode_UNAUTHORIZED, ErrorCodeOf(err))
+
+	// A trusted key signs directly
+	direct, err := SignBundle(&CapabilityBundle{Issuer: "root", ExpiresAt: bundle.ExpiresAt}, rootKey)
+	require.NoError(t, err)
+	_, err = trust.Verify(direct, now)
+	assert.NoError(t, err)
+
+	for name, sb := range map[string]*SignedBundle{
+		"wrong signer":     must(SignBundle(bundle, otherKey, endorsement)),
+		"forged endorsing": must(SignBundle(bundle, vendorKey, Endorse("vendor", vendorPub, "root", otherKey, time.Time{}))),
+		"raised version":   {Bundle: append(append([]byte{}, sb.Bundle...), 0x10, 0x09), Signature: sb.Signature, Chain: sb.Chain},
+	} {
+		_, err := trust.Verify(sb, now)
+		assert.Equal(t, pb.ErrorCode_UNAUTHORIZED, ErrorCodeOf(err), name)
+	}
+
+	_, err = trust.Verify(sb, now.Add(2*time.Hour))
+	assert.Equal(t, pb.ErrorCode_UNAUTHORIZED, ErrorCodeOf(err), "expired bundle")
+	expiring := must(SignBundle(bundle, vendorKey, Endorse("vendor", vendorPub, "root", rootKey, now.Add(time.Minute))))
+	_, err = trust.Verify(expiring, now.Add(30*time.Minute))
+	assert.Equal(t, pb.ErrorCode_UNAUTHORIZED, ErrorCodeOf(err), "expired endorsement")
+
+	_, err = trust.Verify(&SignedBundle{Bundle: []byte{0xff}}, now)
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, ErrorCodeOf(err))
+	_, err = SignBundle(&CapabilityBundle{Issuer: "vendor"}, vendorKey)
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, ErrorCodeOf(err), "no expiry")
+}
+
+func TestReadTrustStore(t *testing.T) {
+	pub, _ := newKey(t)
+	trust, err := ReadTrustStore(strings.NewReader("# anchors\n\nroot " + base64.StdEncoding.EncodeToString(pub) + "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, trust.Len())
+
+	_, err = ReadTrustStore(strings.NewReader("root c2hvcnQ=\n"))
+	assert.Error(t, err)
+}
+
+func must(sb *SignedBundle, err error) *SignedBundle {
+	if err != nil {
+		panic(err)
+	}
+	return sb
+}
@@ -6,4 +6,9 @@ type Capability = pb.CapabilityDescriptor
 type CapabilityOffer = pb.CapabilityOffer
 type CapabilityRequest = pb.CapabilityRequest
 type CapabilityAck = pb.CapabilityAck
+type CapabilityQuery = pb.CapabilityQuery
+type CapabilityCatalog = pb.CapabilityCatalog
+type CapabilityBundle = pb.CapabilityBundle
+type KeyEndorsement = pb.KeyEndorsement
+type SignedBundle = pb.SignedBundle
 // TelemetryDatagram is defined directly in this package via protobuf generation
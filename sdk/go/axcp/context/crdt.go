@@ -0,0 +1,376 @@
+package context
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Stamp orders concurrent writes to a segment (spec v0.2 §6.2): the higher
+// Lamport time wins and equal times are broken by the greater node ID, so
+// every replica picks the same winner.
+type Stamp struct {
+	TS   uint64
+	Node string
+}
+
+// StampOf returns the stamp carried by op
+func StampOf(op *pb.DeltaOp) Stamp {
+	return Stamp{TS: op.GetTs(), Node: op.GetNodeId()}
+}
+
+// After reports whether s wins over o
+func (s Stamp) After(o Stamp) bool {
+	if s.TS != o.TS {
+		return s.TS > o.TS
+	}
+	return s.Node > o.Node
+}
+
+// Clock is the Lamport clock of one node. It is safe for concurrent use.
+type Clock struct {
+	mu   sync.Mutex
+	node string
+	now  uint64
+}
+
+// NewClock returns a clock for nodeID starting at time 0
+func NewClock(nodeID string) *Clock {
+	return &Clock{node: nodeID}
+}
+
+// Node returns the node ID stamped on local writes
+func (c *Clock) Node() string {
+	return c.node
+}
+
+// Now returns the last time handed out or observed
+func (c *Clock) Now() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Tick advances the clock for a local write and returns its stamp
+func (c *Clock) Tick() Stamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now++
+	return Stamp{TS: c.now, Node: c.node}
+}
+
+// Observe moves the clock past a time seen in a remote write, so later
+// local writes win over everything this node has seen
+func (c *Clock) Observe(ts uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = max(c.now, ts)
+}
+
+// register is the last write to one path
+type register struct {
+	stamp   Stamp
+	value   any
+	deleted bool
+}
+
+// beats reports whether r wins over o. Equal stamps only come from a
+// misbehaving node; they are broken by the encoded value so replicas still
+// agree.
+func (r *register) beats(o *register) bool {
+	if r.stamp != o.stamp {
+		return r.stamp.After(o.stamp)
+	}
+	if r.deleted != o.deleted {
+		return o.deleted
+	}
+	a, _ := json.Marshal(r.value)
+	b, _ := json.Marshal(o.value)
+	return bytes.Compare(a, b) > 0
+}
+
+// segment holds the LWW state of one path. A MERGE records an ensure
+// stamp, meaning "this path is an object", separately from the last value
+// written, so a merge never discards a concurrent whole-value write.
+type segment struct {
+	write  *register
+	ensure Stamp
+}
+
+// Replica is a copy of one context edited concurrently by several nodes.
+// Every op is a last-writer-wins write keyed by its path and ordered by
+// Stamp; MERGE is applied as one write per member of its JSON Merge Patch.
+// Arrays are registers written whole: writes below an array have no
+// effect, and Local rejects them.
+// The document is derived from the winning writes only, so replicas that
+// received the same patches hold the same document whatever the order of
+// delivery, and re-applying a patch is a no-op. It is safe for concurrent
+// use.
+type Replica struct {
+	id    string
+	clock *Clock
+
+	mu       sync.Mutex
+	segments map[string]*segment
+	value    any  // materialised document
+	fresh    bool // value reflects segments
+}
+
+// NewReplica returns an empty replica of contextID whose local writes are
+// stamped by clock
+func NewReplica(contextID string, clock *Clock) *Replica {
+	return &Replica{id: contextID, clock: clock, segments: make(map[string]*segment)}
+}
+
+// Clock returns the clock stamping local writes
+func (r *Replica) Clock() *Clock {
+	return r.clock
+}
+
+// Local stamps ops as writes of this node, applies them and returns the
+// patch to send to the other replicas. An op addressing into an array of
+// the document fails with BAD_DELTA.
+func (r *Replica) Local(ops ...*pb.DeltaOp) (*pb.ContextPatch, error) {
+	doc := r.Value()
+	for i, op := range ops {
+		if ptr, err := ParsePointer(op.GetPath()); err == nil && throughArray(doc, ptr) {
+			return nil, opError(i, op, axcp.NewError(pb.ErrorCode_BAD_DELTA, "arrays are written whole"))
+		}
+	}
+
+	stamped := make([]*pb.DeltaOp, len(ops))
+	for i, op := range ops {
+		stamp := r.clock.Tick()
+		stamped[i] = &pb.DeltaOp{Op: op.GetOp(), Path: op.GetPath(), Data: op.GetData(),
+			Ts: stamp.TS, NodeId: stamp.Node}
+	}
+
+	patch := &pb.ContextPatch{ContextId: r.id, Ops: stamped}
+	if err := r.Apply(patch); err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// Apply merges a patch from any replica. base_version is ignored: writes
+// commute. The patch is rejected as a whole with BAD_DELTA if an op lacks
+// its stamp or is invalid, and with INVALID_CONTEXT if it targets another
+// context.
+func (r *Replica) Apply(patch *pb.ContextPatch) error {
+	if patch.GetContextId() != r.id {
+		return axcp.NewError(pb.ErrorCode_INVALID_CONTEXT,
+			"patch for context %q applied to replica of %q", patch.GetContextId(), r.id)
+	}
+
+	var writes []crdtWrite
+	for i, op := range patch.GetOps() {
+		ws, err := crdtWrites(op)
+		if err != nil {
+			return opError(i, op, err)
+		}
+		writes = append(writes, ws...)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, op := range patch.GetOps() {
+		r.clock.Observe(op.GetTs())
+	}
+	for _, w := range writes {
+		seg := r.segments[w.path]
+		if seg == nil {
+			seg = &segment{}
+			r.segments[w.path] = seg
+		}
+		switch {
+		case w.merge:
+			if w.reg.stamp.After(seg.ensure) {
+				seg.ensure = w.reg.stamp
+			}
+		case seg.write == nil || w.reg.beats(seg.write):
+			seg.write = w.reg
+		}
+	}
+	r.fresh = false
+	return nil
+}
+
+// crdtWrite is one LWW write derived from an op
+type crdtWrite struct {
+	path  string
+	reg   *register
+	merge bool // the path becomes an object, reg carries only the stamp
+}
+
+// crdtWrites validates op and expands it into LWW writes
+func crdtWrites(op *pb.DeltaOp) ([]crdtWrite, error) {
+	stamp := StampOf(op)
+	if stamp.TS == 0 || stamp.Node == "" {
+		return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "missing ts or node_id")
+	}
+	ptr, err := ParsePointer(op.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	for _, tok := range ptr {
+		if tok == "-" {
+			return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "array append is not a LWW write")
+		}
+	}
+
+	switch op.GetOp() {
+	case pb.DeltaOp_ADD, pb.DeltaOp_REPLACE:
+		v, err := opValue(op, axcp.DefaultPayloadLimits)
+		if err != nil {
+			return nil, err
+		}
+		return []crdtWrite{{path: ptr.String(), reg: &register{stamp: stamp, value: v}}}, nil
+	case pb.DeltaOp_REMOVE:
+		return []crdtWrite{{path: ptr.String(), reg: &register{stamp: stamp, deleted: true}}}, nil
+	case pb.DeltaOp_MERGE:
+		v, err := opValue(op, axcp.DefaultPayloadLimits)
+		if err != nil {
+			return nil, err
+		}
+		return flattenMerge(nil, ptr, v, stamp), nil
+	default:
+		return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "unknown op type %d", op.GetOp())
+	}
+}
+
+// flattenMerge turns a JSON Merge Patch at ptr into per-member writes:
+// objects recurse, null removes, anything else is written whole
+func flattenMerge(out []crdtWrite, ptr Pointer, patch any, stamp Stamp) []crdtWrite {
+	obj, ok := patch.(map[string]any)
+	if !ok {
+		reg := &register{stamp: stamp, value: patch, deleted: patch == nil}
+		return append(out, crdtWrite{path: ptr.String(), reg: reg})
+	}
+
+	out = append(out, crdtWrite{path: ptr.String(), reg: &register{stamp: stamp}, merge: true})
+	for k, v := range obj {
+		out = flattenMerge(out, ptr.Append(k), v, stamp)
+	}
+	return out
+}
+
+// Value returns a copy of the document
+func (r *Replica) Value() any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.fresh {
+		r.value = r.materialise()
+		r.fresh = true
+	}
+	return clone(r.value)
+}
+
+// MarshalJSON encodes the document
+func (r *Replica) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Value())
+}
+
+// materialise builds the document from the winning writes. Parents are
+// visited before their children; a write takes effect only if it is newer
+// than every write to its ancestors, which would otherwise have replaced
+// it. The result depends on the segments alone, never on arrival order.
+func (r *Replica) materialise() any {
+	paths := make([]Pointer, 0, len(r.segments))
+	for path := range r.segments {
+		ptr, _ := ParsePointer(path)
+		paths = append(paths, ptr)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if len(paths[i]) != len(paths[j]) {
+			return len(paths[i]) < len(paths[j])
+		}
+		return paths[i].String() < paths[j].String()
+	})
+
+	var doc any = map[string]any{}
+	for _, ptr := range paths {
+		seg := r.segments[ptr.String()]
+		shadow := r.ancestorWrite(ptr)
+		if throughArray(doc, ptr) {
+			// Arrays are written whole
+			continue
+		}
+
+		if w := seg.write; w != nil && w.stamp.After(shadow) {
+			if w.deleted {
+				if d, err := remove(doc, ptr); err == nil {
+					doc = d
+				}
+			} else {
+				doc = setPath(doc, ptr, clone(w.value))
+			}
+		}
+		if seg.ensure.After(shadow) && (seg.write == nil || seg.ensure.After(seg.write.stamp)) {
+			if v, ok := Lookup(doc, ptr); !ok || !isObject(v) {
+				doc = setPath(doc, ptr, map[string]any{})
+			}
+		}
+	}
+	return doc
+}
+
+// ancestorWrite returns the newest stamp written to a strict ancestor of ptr
+func (r *Replica) ancestorWrite(ptr Pointer) Stamp {
+	var newest Stamp
+	for i := 0; i < len(ptr); i++ {
+		if seg := r.segments[ptr[:i].String()]; seg != nil && seg.write != nil && seg.write.stamp.After(newest) {
+			newest = seg.write.stamp
+		}
+	}
+	return newest
+}
+
+// setPath writes v at ptr, replacing any non-object on the way with an
+// empty object
+func setPath(doc any, ptr Pointer, v any) any {
+	if len(ptr) == 0 {
+		return v
+	}
+	root, ok := doc.(map[string]any)
+	if !ok {
+		root = map[string]any{}
+	}
+
+	node := root
+	for _, tok := range ptr[:len(ptr)-1] {
+		child, ok := node[tok].(map[string]any)
+		if !ok {
+			child = map[string]any{}
+			node[tok] = child
+		}
+		node = child
+	}
+	node[ptr[len(ptr)-1]] = v
+	return root
+}
+
+// throughArray reports whether ptr addresses into an array of doc. A
+// non-object met before it is replaced by setPath, so it stops the walk.
+func throughArray(doc any, ptr Pointer) bool {
+	for _, tok := range ptr {
+		switch node := doc.(type) {
+		case []any:
+			return true
+		case map[string]any:
+			doc = node[tok]
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func isObject(v any) bool {
+	_, ok := v.(map[string]any)
+	return ok
+}
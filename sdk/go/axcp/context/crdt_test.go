@@ -0,0 +1,236 @@
+package context
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+func replicaJSON(t *testing.T, r *Replica) string {
+	t.Helper()
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestStampOrder(t *testing.T) {
+	assert.True(t, Stamp{2, "a"}.After(Stamp{1, "z"}), "later time wins")
+	assert.True(t, Stamp{1, "b"}.After(Stamp{1, "a"}), "ties go to the greater node")
+	assert.False(t, Stamp{1, "a"}.After(Stamp{1, "a"}))
+}
+
+func TestClock(t *testing.T) {
+	c := NewClock("edge-1")
+	assert.Equal(t, Stamp{1, "edge-1"}, c.Tick())
+
+	c.Observe(10)
+	assert.Equal(t, Stamp{11, "edge-1"}, c.Tick(), "local writes follow what was seen")
+	c.Observe(3)
+	assert.Equal(t, uint64(11), c.Now())
+}
+
+func TestReplicaConcurrentWrites(t *testing.T) {
+	a := NewReplica("ctx", NewClock("a"))
+	b := NewReplica("ctx", NewClock("b"))
+
+	// Both nodes write at Lamport time 1: node b wins the tie
+	patchA, err := a.Local(op(pb.DeltaOp_ADD, "/intent", `"buy"`))
+	require.NoError(t, err)
+	patchB, err := b.Local(op(pb.DeltaOp_ADD, "/intent", `"sell"`))
+	require.NoError(t, err)
+
+	require.NoError(t, a.Apply(patchB))
+	require.NoError(t, b.Apply(patchA))
+	assert.JSONEq(t, `{"intent":"sell"}`, replicaJSON(t, a))
+	assert.JSONEq(t, `{"intent":"sell"}`, replicaJSON(t, b))
+
+	// a has now seen time 1, so its next write wins
+	patchA, err = a.Local(op(pb.DeltaOp_REPLACE, "/intent", `"hold"`))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), patchA.GetOps()[0].GetTs())
+	require.NoError(t, b.Apply(patchA))
+	assert.JSONEq(t, `{"intent":"hold"}`, replicaJSON(t, b))
+}
+
+func TestReplicaMergeKeepsConcurrentMembers(t *testing.T) {
+	a := NewReplica("ctx", NewClock("a"))
+	b := NewReplica("ctx", NewClock("b"))
+
+	patchA, err := a.Local(op(pb.DeltaOp_MERGE, "/user", `{"name":"ada"}`))
+	require.NoError(t, err)
+	patchB, err := b.Local(op(pb.DeltaOp_MERGE, "/user", `{"lang":"it"}`))
+	require.NoError(t, err)
+
+	require.NoError(t, a.Apply(patchB))
+	require.NoError(t, b.Apply(patchA))
+	assert.JSONEq(t, `{"user":{"name":"ada","lang":"it"}}`, replicaJSON(t, a))
+	assert.Equal(t, replicaJSON(t, a), replicaJSON(t, b))
+}
+
+func TestReplicaRejectsInvalidPatches(t *testing.T) {
+	r := NewReplica("ctx", NewClock("a"))
+
+	err := r.Apply(patch("other", 0))
+	assert.Equal(t, pb.ErrorCode_INVALID_CONTEXT, axcp.ErrorCodeOf(err))
+
+	err = r.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/a", `1`)))
+	assert.Equal(t, pb.ErrorCode_BAD_DELTA, axcp.ErrorCodeOf(err), "unstamped op")
+
+	_, err = r.Local(op(pb.DeltaOp_ADD, "/l/-", `1`))
+	assert.Equal(t, pb.ErrorCode_BAD_DELTA, axcp.ErrorCodeOf(err))
+	assert.JSONEq(t, `{}`, replicaJSON(t, r))
+}
+
+func TestReplicaWritesArraysWhole(t *testing.T) {
+	r := NewReplica("ctx", NewClock("a"))
+	_, err := r.Local(op(pb.DeltaOp_ADD, "/list", `[1,2,3]`))
+	require.NoError(t, err)
+
+	for _, o := range []*pb.DeltaOp{
+		op(pb.DeltaOp_REPLACE, "/list/0", `9`),
+		op(pb.DeltaOp_REMOVE, "/list/1", ``),
+		op(pb.DeltaOp_MERGE, "/list/0", `{"x":1}`),
+	} {
+		_, err = r.Local(o)
+		assert.Equal(t, pb.ErrorCode_BAD_DELTA, axcp.ErrorCodeOf(err), o.GetPath())
+	}
+
+	// A remote write below the array has no effect
+	remote := op(pb.DeltaOp_REPLACE, "/list/0", `9`)
+	remote.Ts, remote.NodeId = 10, "b"
+	require.NoError(t, r.Apply(patch("ctx", 0, remote)))
+	assert.JSONEq(t, `{"list":[1,2,3]}`, replicaJSON(t, r))
+
+	_, err = r.Local(op(pb.DeltaOp_REPLACE, "/list", `[9,2,3]`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"list":[9,2,3]}`, replicaJSON(t, r))
+}
+
+// randomPatches lets three nodes edit a few overlapping paths, each one
+// seeing only part of the others' patches, and returns every patch sent
+func randomPatches(rng *rand.Rand) []*pb.ContextPatch {
+	paths := []string{"", "/a", "/a/b", "/a/c", "/a/b/x", "/a/0", "/d", "/d/1"}
+	values := []string{`1`, `"s"`, `null`, `[1,2]`, `{}`, `{"b":2}`, `{"x":{"y":true}}`, `{"c":null,"e":3}`}
+	types := []pb.DeltaOp_OpType{pb.DeltaOp_ADD, pb.DeltaOp_REPLACE, pb.DeltaOp_REMOVE, pb.DeltaOp_MERGE}
+
+	nodes := []*Replica{
+		NewReplica("ctx", NewClock("n1")),
+		NewReplica("ctx", NewClock("n2")),
+		NewReplica("ctx", NewClock("n3")),
+	}
+	var patches []*pb.ContextPatch
+	for i := 0; i < 30; i++ {
+		node := nodes[rng.IntN(len(nodes))]
+		var ops []*pb.DeltaOp
+		for j := rng.IntN(3) + 1; j > 0; j-- {
+			ops = append(ops, op(types[rng.IntN(len(types))], paths[rng.IntN(len(paths))], values[rng.IntN(len(values))]))
+		}
+		p, err := node.Local(ops...)
+		if axcp.ErrorCodeOf(err) == pb.ErrorCode_BAD_DELTA {
+			// Into an array of this node: stamp it anyway, as a node
+			// unaware of the array would
+			p, err = stampedPatch(node, ops)
+		}
+		if err != nil {
+			panic(err)
+		}
+		patches = append(patches, p)
+
+		// Gossip to a random peer now and then, advancing its clock
+		if peer := nodes[rng.IntN(len(nodes))]; rng.IntN(2) == 0 {
+			if err := peer.Apply(p); err != nil {
+				panic(err)
+			}
+		}
+	}
+	return patches
+}
+
+// stampedPatch applies ops to node as remote writes of node, bypassing the
+// checks of Local
+func stampedPatch(node *Replica, ops []*pb.DeltaOp) (*pb.ContextPatch, error) {
+	p := patch("ctx", 0)
+	for _, o := range ops {
+		stamp := node.Clock().Tick()
+		p.Ops = append(p.Ops, &pb.DeltaOp{Op: o.GetOp(), Path: o.GetPath(), Data: o.GetData(), Ts: stamp.TS, NodeId: stamp.Node})
+	}
+	return p, node.Apply(p)
+}
+
+// Replicas converge whatever the delivery order, with duplicates
+func TestReplicaConvergence(t *testing.T) {
+	property := func(seed uint64) bool {
+		rng := rand.New(rand.NewPCG(seed, 0))
+		patches := randomPatches(rng)
+
+		var want string
+		for round := 0; round < 5; round++ {
+			r := NewReplica("ctx", NewClock(fmt.Sprintf("observer-%d", round)))
+			for _, i := range rng.Perm(len(patches)) {
+				if err := r.Apply(patches[i]); err != nil {
+					t.Log(err)
+					return false
+				}
+				if rng.IntN(4) == 0 {
+					// Redelivery is harmless
+					_ = r.Apply(patches[rng.IntN(len(patches))])
+				}
+			}
+			got := replicaJSON(t, r)
+			if round == 0 {
+				want = got
+			} else if got != want {
+				t.Logf("seed %d: %s != %s", seed, got, want)
+				return false
+			}
+		}
+		return true
+	}
+	require.NoError(t, quick.Check(property, &quick.Config{MaxCount: 200}))
+}
+
+// Removing an absent or already removed path leaves the rest of the
+// document alone, whatever the delivery order
+func TestReplicaRemovesOfAbsentPaths(t *testing.T) {
+	r := NewReplica("ctx", NewClock("a"))
+	_, err := r.Local(op(pb.DeltaOp_ADD, "/keep", `1`))
+	require.NoError(t, err)
+	_, err = r.Local(op(pb.DeltaOp_REMOVE, "/missing", ``))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"keep":1}`, replicaJSON(t, r))
+
+	a := NewReplica("ctx", NewClock("a"))
+	b := NewReplica("ctx", NewClock("b"))
+	seed, err := a.Local(op(pb.DeltaOp_ADD, "/keep", `1`), op(pb.DeltaOp_ADD, "/gone", `2`), op(pb.DeltaOp_ADD, "/p", `{"q":3}`))
+	require.NoError(t, err)
+	require.NoError(t, b.Apply(seed))
+
+	// Both nodes remove /gone concurrently; b also removes a member of /p
+	// that a's later scalar write makes unreachable
+	patches := []*pb.ContextPatch{seed}
+	p, err := a.Local(op(pb.DeltaOp_REMOVE, "/gone", ``), op(pb.DeltaOp_REPLACE, "/p", `"flat"`))
+	require.NoError(t, err)
+	patches = append(patches, p)
+	p, err = b.Local(op(pb.DeltaOp_REMOVE, "/gone", ``), op(pb.DeltaOp_REMOVE, "/never", ``))
+	require.NoError(t, err)
+	patches = append(patches, p)
+	p, err = b.Local(op(pb.DeltaOp_REMOVE, "/p/q", ``), op(pb.DeltaOp_REMOVE, "/gone", ``))
+	require.NoError(t, err)
+	patches = append(patches, p)
+
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}, {1, 3, 0, 2}} {
+		r := NewReplica("ctx", NewClock("observer"))
+		for _, i := range order {
+			require.NoError(t, r.Apply(patches[i]))
+		}
+		got := replicaJSON(t, r)
+		assert.JSONEq(t, `{"keep":1,"p":"flat"}`, got, "order %v", order)
+	}
+}
@@ -0,0 +1,153 @@
+package context
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Diff returns the ops turning from into to, in the order they must be
+// applied. from and to may be any values encoding to JSON. Unchanged
+// members and elements produce no op: changed objects are descended into,
+// arrays keep their common prefix and suffix, and everything else is
+// replaced whole. Patch(from, Diff(from, to)) equals to.
+func Diff(from, to any) ([]*pb.DeltaOp, error) {
+	a, err := normalise(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := normalise(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var d differ
+	d.diff(nil, a, b)
+	return d.ops, d.err
+}
+
+// DiffJSON is Diff for two encoded JSON documents
+func DiffJSON(from, to []byte) ([]*pb.DeltaOp, error) {
+	a, err := DecodeJSON(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source document: %w", err)
+	}
+	b, err := DecodeJSON(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target document: %w", err)
+	}
+
+	var d differ
+	d.diff(nil, a, b)
+	return d.ops, d.err
+}
+
+// normalise turns v into the generic form produced by DecodeJSON
+func normalise(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode document: %w", err)
+	}
+	return DecodeJSON(data)
+}
+
+// differ accumulates ops, keeping the first encoding error
+type differ struct {
+	ops []*pb.DeltaOp
+	err error
+}
+
+func (d *differ) emit(op pb.DeltaOp_OpType, ptr Pointer, value any) {
+	if d.err != nil {
+		return
+	}
+	if op == pb.DeltaOp_REMOVE {
+		d.ops = append(d.ops, axcp.NewRemoveOp(ptr.String()))
+		return
+	}
+	delta, err := axcp.NewDeltaOp(op, ptr.String(), value)
+	if err != nil {
+		d.err = err
+		return
+	}
+	d.ops = append(d.ops, delta)
+}
+
+func (d *differ) diff(ptr Pointer, a, b any) {
+	switch a := a.(type) {
+	case map[string]any:
+		if b, ok := b.(map[string]any); ok {
+			d.diffObject(ptr, a, b)
+			return
+		}
+	case []any:
+		if b, ok := b.([]any); ok {
+			d.diffArray(ptr, a, b)
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		d.emit(pb.DeltaOp_REPLACE, ptr, b)
+	}
+}
+
+// diffObject removes, then descends into, then adds members, each in key
+// order so the output is deterministic
+func (d *differ) diffObject(ptr Pointer, a, b map[string]any) {
+	for _, k := range sortedKeys(a) {
+		if _, ok := b[k]; !ok {
+			d.emit(pb.DeltaOp_REMOVE, ptr.Append(k), nil)
+		}
+	}
+	for _, k := range sortedKeys(b) {
+		if av, ok := a[k]; ok {
+			d.diff(ptr.Append(k), av, b[k])
+		}
+	}
+	for _, k := range sortedKeys(b) {
+		if _, ok := a[k]; !ok {
+			d.emit(pb.DeltaOp_ADD, ptr.Append(k), b[k])
+		}
+	}
+}
+
+// diffArray skips the common prefix and suffix, diffs the overlapping
+// middle element by element, then removes surplus elements from the back
+// or inserts the missing ones
+func (d *differ) diffArray(ptr Pointer, a, b []any) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && reflect.DeepEqual(a[prefix], b[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		reflect.DeepEqual(a[len(a)-1-suffix], b[len(b)-1-suffix]) {
+		suffix++
+	}
+
+	oldMid, newMid := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	common := min(len(oldMid), len(newMid))
+	for i := 0; i < common; i++ {
+		d.diff(ptr.Append(strconv.Itoa(prefix+i)), oldMid[i], newMid[i])
+	}
+	for i := len(oldMid) - 1; i >= common; i-- {
+		d.emit(pb.DeltaOp_REMOVE, ptr.Append(strconv.Itoa(prefix+i)), nil)
+	}
+	for i := common; i < len(newMid); i++ {
+		d.emit(pb.DeltaOp_ADD, ptr.Append(strconv.Itoa(prefix+i)), newMid[i])
+	}
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
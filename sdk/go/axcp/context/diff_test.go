@@ -0,0 +1,136 @@
+package context
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// describe renders ops as "OP path value" for comparison
+func describe(t *testing.T, ops []*pb.DeltaOp) []string {
+	t.Helper()
+	out := make([]string, len(ops))
+	for i, op := range ops {
+		out[i] = op.GetOp().String() + " " + op.GetPath()
+		if op.GetOp() != pb.DeltaOp_REMOVE {
+			var v json.RawMessage
+			require.NoError(t, axcp.DecodeDeltaOp(op, &v))
+			out[i] += " " + string(v)
+		}
+	}
+	return out
+}
+
+func TestDiffJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     []string
+	}{
+		{"equal", `{"a":[1,{"b":2}]}`, `{"a":[1,{"b":2}]}`, []string{}},
+		{"members", `{"a":1,"b":2,"c":3}`, `{"b":2,"c":4,"d":5}`,
+			[]string{"REMOVE /a", "REPLACE /c 4", "ADD /d 5"}},
+		{"nested", `{"u":{"n":"x","k":[1]}}`, `{"u":{"n":"y","k":[1]}}`,
+			[]string{`REPLACE /u/n "y"`}},
+		{"escaping", `{"a/b":{"~c":1}}`, `{"a/b":{"~c":2}}`, []string{"REPLACE /a~1b/~0c 2"}},
+		{"type change", `{"a":{"b":1}}`, `{"a":[1]}`, []string{"REPLACE /a [1]"}},
+		{"insert", `[1,2,4]`, `[1,2,3,4]`, []string{"ADD /2 3"}},
+		{"append", `[1]`, `[1,2,3]`, []string{"ADD /1 2", "ADD /2 3"}},
+		{"delete", `[1,2,3,4]`, `[1,4]`, []string{"REMOVE /2", "REMOVE /1"}},
+		{"element", `[{"a":1},{"a":2}]`, `[{"a":1},{"a":3}]`, []string{"REPLACE /1/a 3"}},
+		{"root", `{"a":1}`, `"x"`, []string{`REPLACE  "x"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := DiffJSON([]byte(tt.from), []byte(tt.to))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, describe(t, ops))
+
+			doc, err := DecodeJSON([]byte(tt.from))
+			require.NoError(t, err)
+			got, err := Patch(doc, ops)
+			require.NoError(t, err)
+			data, err := json.Marshal(got)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.to, string(data))
+		})
+	}
+}
+
+func TestDiffGoValues(t *testing.T) {
+	type state struct {
+		Intent string   `json:"intent"`
+		Tags   []string `json:"tags,omitempty"`
+	}
+	ops, err := Diff(state{Intent: "buy"}, state{Intent: "buy", Tags: []string{"fx"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{`ADD /tags ["fx"]`}, describe(t, ops))
+
+	_, err = Diff(map[string]any{}, func() {})
+	assert.Error(t, err)
+}
+
+// randomJSON builds a small random document over a few keys and shapes
+func randomJSON(rng *rand.Rand, depth int) any {
+	switch n := rng.IntN(7); {
+	case n < 2 && depth > 0:
+		obj := map[string]any{}
+		for _, k := range []string{"a", "b/c", "~d", "-"} {
+			if rng.IntN(2) == 0 {
+				obj[k] = randomJSON(rng, depth-1)
+			}
+		}
+		return obj
+	case n < 4 && depth > 0:
+		arr := make([]any, rng.IntN(4))
+		for i := range arr {
+			arr[i] = randomJSON(rng, depth-1)
+		}
+		return arr
+	case n == 4:
+		return rng.IntN(3)
+	case n == 5:
+		return strings.Repeat("s", rng.IntN(2))
+	default:
+		return nil
+	}
+}
+
+// Applying the diff always yields the target document
+func TestDiffRoundTrip(t *testing.T) {
+	property := func(seed uint64) bool {
+		rng := rand.New(rand.NewPCG(seed, 0))
+		from, to := randomJSON(rng, 3), randomJSON(rng, 3)
+
+		ops, err := Diff(from, to)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		doc, _ := normalise(from)
+		got, err := Patch(doc, ops)
+		if err != nil {
+			t.Logf("seed %d: %v", seed, err)
+			return false
+		}
+		a, _ := json.Marshal(got)
+		b, _ := json.Marshal(to)
+		if string(a) != string(b) {
+			t.Logf("seed %d: %s != %s", seed, a, b)
+			return false
+		}
+		return true
+	}
+	require.NoError(t, quick.Check(property, &quick.Config{MaxCount: 500}))
+
+	same, err := Diff(map[string]any{"a": []any{1, "x"}}, map[string]any{"a": []any{1, "x"}})
+	require.NoError(t, err)
+	assert.Empty(t, same)
+}
@@ -0,0 +1,185 @@
+// Package context holds the AXCP context graph: versioned JSON documents,
+// one per context_id, mutated only through ContextPatch messages
+// (spec v0.2 §6).
+//
+// The package name shadows the standard library; import it under an alias
+// such as axctx where both are needed.
+package context
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Document is a snapshot of one context
+type Document struct {
+	ID      string
+	Version uint64
+	// Value is the decoded JSON document, see DecodeJSON
+	Value any
+}
+
+// MarshalJSON encodes the document value
+func (d *Document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Value)
+}
+
+// Engine stores the documents of every context and applies patches to
+// them. A context is created by its first patch, which must have
+// base_version 0 and starts from an empty object. It is safe for
+// concurrent use.
+type Engine struct {
+	mu       sync.RWMutex
+	docs     map[string]*Document
+	limits   axcp.PayloadLimits
+	logs     map[string]*patchLog
+	maxLog   int
+	watchers map[string]map[*watcher]struct{}
+	journal  Journal
+	expiry   map[string]map[string]time.Time // deadline of segments with a ttl_ms
+	now      func() time.Time
+	lineages map[string]*lineage
+	maxLin   int
+	maxSeg   int
+	author   string
+	resolve  ConflictHandler
+}
+
+// Journal persists applied patches, see Engine.SetJournal
+type Journal interface {
+	// Append records a patch about to be applied. An error aborts the patch.
+	Append(patch *pb.ContextPatch) error
+}
+
+// NewEngine returns an engine without any context
+func NewEngine() *Engine {
+	return &Engine{
+		docs:     make(map[string]*Document),
+		limits:   axcp.DefaultPayloadLimits,
+		logs:     make(map[string]*patchLog),
+		maxLog:   DefaultHistoryLimit,
+		watchers: make(map[string]map[*watcher]struct{}),
+		expiry:   make(map[string]map[string]time.Time),
+		now:      time.Now,
+		lineages: make(map[string]*lineage),
+		maxLin:   DefaultLineageLimit,
+		maxSeg:   MaxSegmentSize,
+	}
+}
+
+// SetPayloadLimits changes the limits applied when decompressing op data
+func (e *Engine) SetPayloadLimits(limits axcp.PayloadLimits) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.limits = limits
+}
+
+// SetJournal makes every later patch recorded in j before it takes
+// effect; nil stops journaling. Replaying the journal into an engine
+// without one rebuilds the same state.
+func (e *Engine) SetJournal(j Journal) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.journal = j
+}
+
+// Apply applies all ops of patch or none of them and returns the new
+// version of the context. A base_version other than the current version
+// fails with INVALID_CONTEXT, an invalid op or pointer with BAD_DELTA and
+// an oversized payload or segment with PAYLOAD_TOO_LARGE. Members
+// outgrowing the segment limit are split, see SetSegmentLimit. A patch
+// whose first parent is an older version still in the lineage is merged
+// instead, see SetConflictHandler.
+func (e *Engine) Apply(patch *pb.ContextPatch) (uint64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.apply(patch, pb.ContextInvalidation_REMOVED)
+}
+
+// apply implements Apply with e.mu held. The segments removed by the patch
+// are reported to watchers as invalidated for reason.
+func (e *Engine) apply(patch *pb.ContextPatch, reason pb.ContextInvalidation_Reason) (uint64, error) {
+	id := patch.GetContextId()
+	if id == "" {
+		return 0, axcp.NewError(pb.ErrorCode_INVALID_CONTEXT, "missing context_id")
+	}
+
+	doc, ok := e.docs[id]
+	if !ok {
+		doc = &Document{ID: id, Value: map[string]any{}}
+	}
+	l := e.lineages[id]
+	if l == nil {
+		l = newLineage(doc.Value)
+	}
+	if l.forks(patch) {
+		return e.merge(doc, l, patch, reason)
+	}
+	if patch.GetBaseVersion() != doc.Version {
+		return 0, axcp.NewError(pb.ErrorCode_INVALID_CONTEXT,
+			"context %q is at version %d, patch is based on %d", id, doc.Version, patch.GetBaseVersion())
+	}
+	return e.commit(doc, l, patch, reason)
+}
+
+// commit applies patch on top of doc. Called with e.mu held.
+func (e *Engine) commit(doc *Document, l *lineage, patch *pb.ContextPatch, reason pb.ContextInvalidation_Reason) (uint64, error) {
+	id := patch.GetContextId()
+	value, err := e.patch(doc.Value, patch.GetOps())
+	if err != nil {
+		return 0, err
+	}
+	if e.journal != nil {
+		if err := e.journal.Append(patch); err != nil {
+			return 0, fmt.Errorf("failed to journal patch: %w", err)
+		}
+	}
+
+	e.docs[id] = &Document{ID: id, Version: doc.Version + 1, Value: value}
+	e.lineages[id] = l
+	l.head = l.add(patch, doc.Version+1, value, e.maxLin)
+	e.scheduleExpiry(patch)
+	e.record(patch, doc.Value, value, reason)
+	return doc.Version + 1, nil
+}
+
+// Get returns a copy of the logical document of the context, segmented
+// members joined back, or false if it does not exist
+func (e *Engine) Get(contextID string) (*Document, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	doc, ok := e.docs[contextID]
+	if !ok {
+		return nil, false
+	}
+	return &Document{ID: doc.ID, Version: doc.Version, Value: Assemble(doc.Value)}, true
+}
+
+// Version returns the current version of the context, 0 if it does not exist
+func (e *Engine) Version(contextID string) uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if doc, ok := e.docs[contextID]; ok {
+		return doc.Version
+	}
+	return 0
+}
+
+// Contexts returns the IDs of all contexts
+func (e *Engine) Contexts() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	ids := make([]string, 0, len(e.docs))
+	for id := range e.docs {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,163 @@
+package context
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+func op(t pb.DeltaOp_OpType, path, data string) *pb.DeltaOp {
+	return &pb.DeltaOp{Op: t, Path: path, Data: []byte(data)}
+}
+
+func patch(id string, base uint64, ops ...*pb.DeltaOp) *pb.ContextPatch {
+	return &pb.ContextPatch{ContextId: id, BaseVersion: base, Ops: ops}
+}
+
+func docJSON(t *testing.T, e *Engine, id string) string {
+	t.Helper()
+	doc, ok := e.Get(id)
+	require.True(t, ok)
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestPatchOps(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		op   *pb.DeltaOp
+		want string
+	}{
+		{"add member", `{"a":1}`, op(pb.DeltaOp_ADD, "/b", `2`), `{"a":1,"b":2}`},
+		{"add overwrites", `{"a":1}`, op(pb.DeltaOp_ADD, "/a", `[1]`), `{"a":[1]}`},
+		{"add inserts", `{"l":[1,3]}`, op(pb.DeltaOp_ADD, "/l/1", `2`), `{"l":[1,2,3]}`},
+		{"add appends", `{"l":[1]}`, op(pb.DeltaOp_ADD, "/l/-", `2`), `{"l":[1,2]}`},
+		{"add root", `{"a":1}`, op(pb.DeltaOp_ADD, "", `"x"`), `"x"`},
+		{"replace", `{"a":1}`, op(pb.DeltaOp_REPLACE, "/a", `{"b":true}`), `{"a":{"b":true}}`},
+		{"replace element", `[1,2]`, op(pb.DeltaOp_REPLACE, "/1", `5`), `[1,5]`},
+		{"remove member", `{"a":1,"b":2}`, op(pb.DeltaOp_REMOVE, "/a", ``), `{"b":2}`},
+		{"remove element", `{"l":[1,2,3]}`, op(pb.DeltaOp_REMOVE, "/l/1", ``), `{"l":[1,3]}`},
+		{"escaped pointer", `{"a/b":{"~":1}}`, op(pb.DeltaOp_REPLACE, "/a~1b/~0", `2`), `{"a/b":{"~":2}}`},
+		{"merge", `{"u":{"n":"x","k":1}}`, op(pb.DeltaOp_MERGE, "/u", `{"k":null,"m":2}`), `{"u":{"m":2,"n":"x"}}`},
+		{"merge creates", `{}`, op(pb.DeltaOp_MERGE, "/u", `{"k":null,"m":2}`), `{"u":{"m":2}}`},
+		{"big number", `{}`, op(pb.DeltaOp_ADD, "/n", `12345678901234567890`), `{"n":12345678901234567890}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := DecodeJSON([]byte(tt.doc))
+			require.NoError(t, err)
+			got, err := Patch(doc, []*pb.DeltaOp{tt.op})
+			require.NoError(t, err)
+			data, err := json.Marshal(got)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(data))
+		})
+	}
+}
+
+func TestPatchInvalid(t *testing.T) {
+	tests := map[string]*pb.DeltaOp{
+		"missing parent":     op(pb.DeltaOp_ADD, "/x/y", `1`),
+		"replace missing":    op(pb.DeltaOp_REPLACE, "/x", `1`),
+		"remove missing":     op(pb.DeltaOp_REMOVE, "/x", ``),
+		"index out of range": op(pb.DeltaOp_ADD, "/l/5", `1`),
+		"leading zero":       op(pb.DeltaOp_REPLACE, "/l/01", `1`),
+		"dash on replace":    op(pb.DeltaOp_REPLACE, "/l/-", `1`),
+		"scalar parent":      op(pb.DeltaOp_ADD, "/s/x", `1`),
+		"bad pointer":        op(pb.DeltaOp_ADD, "l", `1`),
+		"bad JSON":           op(pb.DeltaOp_ADD, "/x", `{`),
+		"trailing data":      op(pb.DeltaOp_ADD, "/x", `1 2`),
+		"unknown op":         op(42, "/x", `1`),
+	}
+	for name, o := range tests {
+		t.Run(name, func(t *testing.T) {
+			doc, err := DecodeJSON([]byte(`{"l":[0],"s":"str"}`))
+			require.NoError(t, err)
+			_, err = Patch(doc, []*pb.DeltaOp{o})
+			assert.Equal(t, pb.ErrorCode_BAD_DELTA, axcp.ErrorCodeOf(err))
+		})
+	}
+}
+
+func TestEngineApply(t *testing.T) {
+	e := NewEngine()
+
+	v, err := e.Apply(patch("demo", 0,
+		op(pb.DeltaOp_ADD, "/agent", `{"status":{}}`),
+		op(pb.DeltaOp_ADD, "/agent/status/battery", `100`),
+	))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), v)
+
+	v, err = e.Apply(patch("demo", 1, op(pb.DeltaOp_REPLACE, "/agent/status/battery", `99`)))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), v)
+	assert.Equal(t, uint64(2), e.Version("demo"))
+	assert.JSONEq(t, `{"agent":{"status":{"battery":99}}}`, docJSON(t, e, "demo"))
+	assert.Equal(t, []string{"demo"}, e.Contexts())
+}
+
+func TestEngineRejectsStaleBase(t *testing.T) {
+	e := NewEngine()
+	_, err := e.Apply(patch("demo", 0, op(pb.DeltaOp_ADD, "/a", `1`)))
+	require.NoError(t, err)
+
+	_, err = e.Apply(patch("demo", 0, op(pb.DeltaOp_ADD, "/b", `2`)))
+	assert.Equal(t, pb.ErrorCode_INVALID_CONTEXT, axcp.ErrorCodeOf(err))
+
+	_, err = e.Apply(patch("other", 3, op(pb.DeltaOp_ADD, "/b", `2`)))
+	assert.Equal(t, pb.ErrorCode_INVALID_CONTEXT, axcp.ErrorCodeOf(err), "unknown context")
+
+	_, err = e.Apply(patch("", 0))
+	assert.Equal(t, pb.ErrorCode_INVALID_CONTEXT, axcp.ErrorCodeOf(err))
+	assert.Equal(t, uint64(1), e.Version("demo"))
+}
+
+func TestEngineApplyIsAtomic(t *testing.T) {
+	e := NewEngine()
+	_, err := e.Apply(patch("demo", 0, op(pb.DeltaOp_ADD, "/a", `{"n":1}`)))
+	require.NoError(t, err)
+
+	_, err = e.Apply(patch("demo", 1,
+		op(pb.DeltaOp_REPLACE, "/a/n", `2`),
+		op(pb.DeltaOp_REMOVE, "/missing", ``),
+	))
+	assert.Equal(t, pb.ErrorCode_BAD_DELTA, axcp.ErrorCodeOf(err))
+	assert.Equal(t, uint64(1), e.Version("demo"))
+	assert.JSONEq(t, `{"a":{"n":1}}`, docJSON(t, e, "demo"), "first op rolled back")
+}
+
+func TestEngineGetReturnsCopy(t *testing.T) {
+	e := NewEngine()
+	_, err := e.Apply(patch("demo", 0, op(pb.DeltaOp_ADD, "/a", `1`)))
+	require.NoError(t, err)
+
+	doc, _ := e.Get("demo")
+	doc.Value.(map[string]any)["a"] = "changed"
+	assert.JSONEq(t, `{"a":1}`, docJSON(t, e, "demo"))
+
+	_, ok := e.Get("missing")
+	assert.False(t, ok)
+}
+
+func TestEngineGzipPayloads(t *testing.T) {
+	e := NewEngine()
+	add, err := axcp.NewDeltaOp(pb.DeltaOp_ADD, "/memory", map[string]any{"facts": []string{"a", "b"}})
+	require.NoError(t, err)
+	_, err = e.Apply(patch("demo", 0, add))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"memory":{"facts":["a","b"]}}`, docJSON(t, e, "demo"))
+
+	e.SetPayloadLimits(axcp.PayloadLimits{MaxDecompressed: 16})
+	big, err := axcp.NewDeltaOp(pb.DeltaOp_ADD, "/big", string(make([]byte, 1000)))
+	require.NoError(t, err)
+	_, err = e.Apply(patch("demo", 1, big))
+	assert.Equal(t, pb.ErrorCode_PAYLOAD_TOO_LARGE, axcp.ErrorCodeOf(err))
+	assert.Equal(t, uint64(1), e.Version("demo"))
+}
@@ -0,0 +1,77 @@
+package context
+
+import (
+	"sort"
+	"time"
+
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Invalidate removes the segment at path with a REMOVE patch on top of the
+// current version, reporting it to watchers as invalidated for reason
+// (typically REVOKED), and returns the new version
+func (e *Engine) Invalidate(contextID, path string, reason pb.ContextInvalidation_Reason) (uint64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.invalidate(contextID, path, reason)
+}
+
+// invalidate implements Invalidate with e.mu held
+func (e *Engine) invalidate(contextID, path string, reason pb.ContextInvalidation_Reason) (uint64, error) {
+	var version uint64
+	if doc, ok := e.docs[contextID]; ok {
+		version = doc.Version
+	}
+	return e.apply(&pb.ContextPatch{
+		ContextId:   contextID,
+		BaseVersion: version,
+		Ops:         []*pb.DeltaOp{{Op: pb.DeltaOp_REMOVE, Path: path}},
+	}, reason)
+}
+
+// scheduleExpiry records the deadline of the segments written with a
+// ttl_ms. A later write without one makes the segment permanent again.
+// Called with e.mu held.
+func (e *Engine) scheduleExpiry(patch *pb.ContextPatch) {
+	id := patch.GetContextId()
+	for _, op := range patch.GetOps() {
+		if op.GetOp() == pb.DeltaOp_REMOVE || op.GetTtlMs() == 0 {
+			delete(e.expiry[id], op.GetPath())
+			continue
+		}
+		if e.expiry[id] == nil {
+			e.expiry[id] = make(map[string]time.Time)
+		}
+		e.expiry[id][op.GetPath()] = e.now().Add(time.Duration(op.GetTtlMs()) * time.Millisecond)
+	}
+}
+
+// ExpireDue removes the segments whose ttl_ms has elapsed at now,
+// invalidating them as EXPIRED, and returns how many were removed.
+// Segments already removed, for instance with an ancestor, are forgotten.
+func (e *Engine) ExpireDue(now time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	expired := 0
+	for id, deadlines := range e.expiry {
+		var due []string
+		for path, at := range deadlines {
+			if !at.After(now) {
+				due = append(due, path)
+			}
+		}
+		// Parents first, so their children are simply gone
+		sort.Strings(due)
+		for _, path := range due {
+			delete(deadlines, path)
+			if _, err := e.invalidate(id, path, pb.ContextInvalidation_EXPIRED); err == nil {
+				expired++
+			}
+		}
+		if len(deadlines) == 0 {
+			delete(e.expiry, id)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,196 @@
+package context
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Filter selects the ops forwarded to a subscriber (spec v0.2 §6.3). It is
+// built from SyncSubscribe.filters, every expression of which must match:
+//
+//	prefix=/user/   the op path is /user or lies under it, or the op writes
+//	                an ancestor of it such as the root, which the subscriber
+//	                needs to hold anything below; the value of such an op is
+//	                cut down to what lies under the prefix. Paths are
+//	                compared token by token, so /username does not match
+//	                and the trailing / is optional.
+//	tag=intent      the op carries the tag intent
+//	timestamp>T     the op ts is greater than T
+//
+// A nil Filter matches everything.
+type Filter struct {
+	prefixes []string
+	tags     []string
+	after    uint64
+	timed    bool // a timestamp expression was given
+}
+
+// ParseFilter parses filter expressions, failing with MALFORMED_REQUEST.
+// No expression yields a nil Filter.
+func ParseFilter(exprs []string) (*Filter, error) {
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+
+	f := &Filter{}
+	for _, expr := range exprs {
+		expr = strings.TrimSpace(expr)
+		switch {
+		case strings.HasPrefix(expr, "prefix="):
+			prefix := strings.TrimPrefix(expr, "prefix=")
+			if prefix != "" && prefix[0] != '/' {
+				return nil, axcp.NewError(pb.ErrorCode_MALFORMED_REQUEST, "prefix %q is not a JSON Pointer", prefix)
+			}
+			f.prefixes = append(f.prefixes, strings.TrimSuffix(prefix, "/"))
+		case strings.HasPrefix(expr, "tag="):
+			f.tags = append(f.tags, strings.TrimPrefix(expr, "tag="))
+		case strings.HasPrefix(expr, "timestamp"):
+			rest := strings.TrimSpace(strings.TrimPrefix(expr, "timestamp"))
+			if !strings.HasPrefix(rest, ">") {
+				return nil, axcp.NewError(pb.ErrorCode_MALFORMED_REQUEST, "invalid filter %q", expr)
+			}
+			t, err := strconv.ParseUint(strings.TrimSpace(rest[1:]), 10, 64)
+			if err != nil {
+				return nil, axcp.NewError(pb.ErrorCode_MALFORMED_REQUEST, "invalid timestamp in %q", expr)
+			}
+			f.after = max(f.after, t)
+			f.timed = true
+		default:
+			return nil, axcp.NewError(pb.ErrorCode_MALFORMED_REQUEST, "invalid filter %q", expr)
+		}
+	}
+	return f, nil
+}
+
+// MatchPath reports whether the segment at path passes the prefix
+// expressions
+func (f *Filter) MatchPath(path string) bool {
+	if f == nil {
+		return true
+	}
+	for _, prefix := range f.prefixes {
+		if !under(path, prefix) && !strings.HasPrefix(prefix, path+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// under reports whether path is prefix or lies below it
+func under(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Match reports whether op passes every expression
+func (f *Filter) Match(op *pb.DeltaOp) bool {
+	if f == nil {
+		return true
+	}
+	for _, tag := range f.tags {
+		if !slices.Contains(op.GetTags(), tag) {
+			return false
+		}
+	}
+	if f.timed && op.GetTs() <= f.after {
+		return false
+	}
+	return f.MatchPath(op.GetPath())
+}
+
+// Apply returns patch with the ops that do not match removed and the
+// values written to an ancestor of a prefix projected onto it, so siblings
+// of the prefix never reach the subscriber. The base_version is kept, so
+// the subscriber still sees every version and can detect gaps; a patch may
+// end up without ops.
+func (f *Filter) Apply(patch *pb.ContextPatch) *pb.ContextPatch {
+	if f == nil {
+		return patch
+	}
+	out := &pb.ContextPatch{ContextId: patch.GetContextId(), BaseVersion: patch.GetBaseVersion()}
+	for _, op := range patch.GetOps() {
+		if !f.Match(op) {
+			continue
+		}
+		if op = f.project(op); op != nil {
+			out.Ops = append(out.Ops, op)
+		}
+	}
+	return out
+}
+
+// project returns op with its value cut down to the prefixes it is an
+// ancestor of, or nil when that value cannot be decoded. REMOVE ops and
+// ops under every prefix are returned as they are.
+func (f *Filter) project(op *pb.DeltaOp) *pb.DeltaOp {
+	if op.GetOp() == pb.DeltaOp_REMOVE {
+		return op
+	}
+	var value any
+	projected := false
+	for _, prefix := range f.prefixes {
+		if under(op.GetPath(), prefix) {
+			continue
+		}
+		if !projected {
+			v, err := opValue(op, axcp.DefaultPayloadLimits)
+			if err != nil {
+				return nil
+			}
+			value, projected = v, true
+		}
+		// The prefix is below the path: it goes on with a / and its tokens
+		value = projectValue(value, strings.Split(prefix[len(op.GetPath())+1:], "/"))
+	}
+	if !projected {
+		return op
+	}
+	encoded, err := axcp.NewDeltaOp(op.GetOp(), op.GetPath(), value)
+	if err != nil {
+		return nil
+	}
+	out := proto.Clone(op).(*pb.DeltaOp)
+	out.Data = encoded.Data
+	return out
+}
+
+// projectValue keeps of v what lies along tokens, the escaped reference
+// tokens of a prefix relative to v. Array elements off the prefix become
+// null so the indices stay the same; scalars are kept, being themselves an
+// ancestor of the prefix.
+func projectValue(v any, tokens []string) any {
+	keep := func(tok string) bool {
+		return tok == tokens[0]
+	}
+	below := func(child any) any {
+		if len(tokens) == 1 {
+			return child
+		}
+		return projectValue(child, tokens[1:])
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any)
+		for key, child := range v {
+			if keep(EscapeToken(key)) {
+				out[key] = below(child)
+			}
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, child := range v {
+			if keep(strconv.Itoa(i)) {
+				out[i] = below(child)
+			}
+		}
+		return out
+	default:
+		return v
+	}
+}
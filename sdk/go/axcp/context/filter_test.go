@@ -0,0 +1,186 @@
+package context
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+func TestParseFilter(t *testing.T) {
+	f, err := ParseFilter(nil)
+	require.NoError(t, err)
+	assert.Nil(t, f)
+	assert.True(t, f.Match(op(pb.DeltaOp_ADD, "/any", `1`)))
+
+	for _, bad := range []string{"prefix=user", "timestamp<3", "timestamp>x", "owner=me"} {
+		_, err := ParseFilter([]string{bad})
+		assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, axcp.ErrorCodeOf(err), bad)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	f, err := ParseFilter([]string{"prefix=/user/", "tag=intent", "timestamp > 10"})
+	require.NoError(t, err)
+
+	tagged := func(path string, ts uint64, tags ...string) *pb.DeltaOp {
+		return &pb.DeltaOp{Op: pb.DeltaOp_ADD, Path: path, Ts: ts, Tags: tags}
+	}
+	assert.True(t, f.Match(tagged("/user/name", 11, "intent")))
+	assert.True(t, f.Match(tagged("/user", 11, "pii", "intent")), "ancestor of the prefix")
+	assert.False(t, f.Match(tagged("/order/id", 11, "intent")), "outside the prefix")
+	assert.False(t, f.Match(tagged("/username", 11, "intent")), "sibling sharing the prefix text")
+	assert.False(t, f.Match(tagged("/user/name", 11)), "untagged")
+	assert.False(t, f.Match(tagged("/user/name", 10, "intent")), "too old")
+
+	filtered := f.Apply(patch("ctx", 4, tagged("/user/a", 12, "intent"), tagged("/order", 12, "intent")))
+	assert.Equal(t, uint64(4), filtered.GetBaseVersion())
+	require.Len(t, filtered.GetOps(), 1)
+	assert.Equal(t, "/user/a", filtered.GetOps()[0].GetPath())
+}
+
+func TestFilterProjectsAncestorWrites(t *testing.T) {
+	f, err := ParseFilter([]string{"prefix=/user/"})
+	require.NoError(t, err)
+	value := func(op *pb.DeltaOp) string {
+		t.Helper()
+		raw, err := axcp.DecompressPayload(op.GetData(), axcp.DefaultPayloadLimits)
+		require.NoError(t, err)
+		return string(raw)
+	}
+
+	root := op(pb.DeltaOp_REPLACE, "", `{"user":{"name":"ada"},"username":"u","secret":"x"}`)
+	root.Tags = []string{"intent"}
+	under := op(pb.DeltaOp_ADD, "/user/age", `36`)
+	filtered := f.Apply(patch("ctx", 1,
+		root,
+		op(pb.DeltaOp_MERGE, "", `{"secret":"y"}`),
+		op(pb.DeltaOp_ADD, "/user", `{"name":"bob"}`),
+		under,
+	))
+	require.Len(t, filtered.GetOps(), 4)
+	assert.JSONEq(t, `{"user":{"name":"ada"}}`, value(filtered.GetOps()[0]), "root write without its siblings")
+	assert.Equal(t, []string{"intent"}, filtered.GetOps()[0].GetTags())
+	assert.JSONEq(t, `{}`, value(filtered.GetOps()[1]))
+	assert.JSONEq(t, `{"name":"bob"}`, value(filtered.GetOps()[2]))
+	assert.Same(t, under, filtered.GetOps()[3], "ops under the prefix are kept")
+	assert.JSONEq(t, `{"user":{"name":"ada"},"username":"u","secret":"x"}`, value(root), "the patch is not modified")
+
+	// Array elements off the prefix are blanked, keeping the indices
+	f, err = ParseFilter([]string{"prefix=/list/1/"})
+	require.NoError(t, err)
+	filtered = f.Apply(patch("ctx", 1, op(pb.DeltaOp_ADD, "/list", `[{"a":1},{"b":2},{"c":3}]`)))
+	require.Len(t, filtered.GetOps(), 1)
+	assert.JSONEq(t, `[null,{"b":2},null]`, value(filtered.GetOps()[0]))
+}
+
+// Subscribers receive only the matching ops and every invalidation under
+// their prefix
+func TestSyncFilteredSubscription(t *testing.T) {
+	engine := NewEngine()
+	server := NewSyncServer(engine)
+	follower := NewFollower(NewEngine())
+	var invalidated []*pb.ContextInvalidation
+	follower.SetInvalidationHandler(func(inv *pb.ContextInvalidation) { invalidated = append(invalidated, inv) })
+	up, down := make(chanPeer, 16), make(chanPeer, 16)
+
+	require.NoError(t, follower.Subscribe(up, "ctx", "prefix=/user/"))
+	_, err := server.HandleEnvelope(down, up.next(t))
+	require.NoError(t, err)
+
+	_, err = engine.Apply(patch("ctx", 0,
+		op(pb.DeltaOp_ADD, "/user", `{}`), op(pb.DeltaOp_ADD, "/order", `{"id":1}`)))
+	require.NoError(t, err)
+	_, err = engine.Apply(patch("ctx", 1, op(pb.DeltaOp_ADD, "/user/name", `"ada"`)))
+	require.NoError(t, err)
+	_, err = engine.Apply(patch("ctx", 2, op(pb.DeltaOp_REMOVE, "/order", ``)))
+	require.NoError(t, err)
+	_, err = engine.Invalidate("ctx", "/user/name", pb.ContextInvalidation_REVOKED)
+	require.NoError(t, err)
+
+	// 4 patches, the one removing /order empty, and one invalidation
+	for i := 0; i < 5; i++ {
+		handled, err := follower.HandleEnvelope(up, down.next(t))
+		require.True(t, handled)
+		require.NoError(t, err)
+	}
+	assert.Empty(t, down)
+	assert.Equal(t, uint64(4), follower.Engine().Version("ctx"))
+	assert.JSONEq(t, `{"user":{}}`, docJSON(t, follower.Engine(), "ctx"))
+	require.Len(t, invalidated, 1)
+	assert.Equal(t, "/user/name", invalidated[0].GetPath())
+	assert.Equal(t, pb.ContextInvalidation_REVOKED, invalidated[0].GetReason())
+	assert.Equal(t, uint64(4), invalidated[0].GetVersion())
+
+	env := axcp.NewEnvelope("bad", 0)
+	env.Payload = &pb.AxcpEnvelope_SyncSub{SyncSub: &pb.SyncSubscribe{
+		From: &pb.ContextGraphVersion{ContextId: "ctx"}, Filters: []string{"owner=me"},
+	}}
+	_, err = server.HandleEnvelope(down, env)
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, axcp.ErrorCodeOf(err))
+	assert.Equal(t, uint32(pb.ErrorCode_MALFORMED_REQUEST), down.next(t).GetError().GetCode())
+}
+
+func TestEngineExpiresSegments(t *testing.T) {
+	e := NewEngine()
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+
+	var invalidated []*pb.ContextInvalidation
+	_, err := e.WatchChanges("ctx", 0, func(*pb.ContextPatch) {},
+		func(inv *pb.ContextInvalidation) { invalidated = append(invalidated, inv) })
+	require.NoError(t, err)
+
+	session := op(pb.DeltaOp_ADD, "/session", `{"token":"x"}`)
+	session.TtlMs = 1000
+	token := op(pb.DeltaOp_ADD, "/session/token", `"y"`)
+	token.TtlMs = 500
+	_, err = e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/user", `"ada"`), session, token))
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, e.ExpireDue(now.Add(100*time.Millisecond)))
+	assert.Equal(t, 1, e.ExpireDue(now.Add(500*time.Millisecond)))
+	assert.JSONEq(t, `{"user":"ada","session":{}}`, docJSON(t, e, "ctx"))
+	assert.Equal(t, 1, e.ExpireDue(now.Add(time.Hour)))
+	assert.JSONEq(t, `{"user":"ada"}`, docJSON(t, e, "ctx"))
+	assert.Equal(t, 0, e.ExpireDue(now.Add(2*time.Hour)))
+
+	require.Len(t, invalidated, 2)
+	assert.Equal(t, "/session/token", invalidated[0].GetPath())
+	assert.Equal(t, pb.ContextInvalidation_EXPIRED, invalidated[1].GetReason())
+	assert.Equal(t, uint64(3), e.Version("ctx"), "expiry is an ordinary patch for replicas")
+}
+
+func TestEngineInvalidatesDroppedSegments(t *testing.T) {
+	e := NewEngine()
+	var paths []string
+	_, err := e.WatchChanges("ctx", 0, func(*pb.ContextPatch) {},
+		func(inv *pb.ContextInvalidation) { paths = append(paths, inv.GetPath()) })
+	require.NoError(t, err)
+
+	_, err = e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/user", `{"name":"ada","age":36,"tags":["a"]}`),
+		op(pb.DeltaOp_ADD, "/order", `{"id":1}`)))
+	require.NoError(t, err)
+	assert.Empty(t, paths)
+
+	// Replacing an ancestor drops the members it no longer holds
+	_, err = e.Apply(patch("ctx", 1, op(pb.DeltaOp_REPLACE, "/user", `{"age":37,"tags":[]}`)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/user/name"}, paths)
+
+	// So does a merge with null members
+	paths = nil
+	_, err = e.Apply(patch("ctx", 2, op(pb.DeltaOp_MERGE, "/user", `{"age":null,"tags":["b"]}`)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/user/age"}, paths)
+
+	// and replacing the root
+	paths = nil
+	_, err = e.Apply(patch("ctx", 3, op(pb.DeltaOp_REPLACE, "", `{"order":{}}`),
+		op(pb.DeltaOp_REMOVE, "/order", ``)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/order", "/user"}, paths)
+}
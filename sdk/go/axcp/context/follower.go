@@ -0,0 +1,215 @@
+package context
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Follower keeps a local Engine in step with a SyncServer. Patches based
+// on the local version are applied, older ones are duplicates and are
+// dropped, and newer ones reveal a gap: they are held back and the
+// missing range is asked for with a SyncRequest. After a reconnect, call
+// Subscribe again and the replica catches up from its current version. It
+// is safe for concurrent use.
+type Follower struct {
+	engine *Engine
+
+	mu      sync.Mutex
+	pending map[string]map[uint64]*pb.ContextPatch // by context and base_version
+	asked   map[string]gapRequest
+	subs    map[string]string // trace_id of the subscription to each context
+	onInval func(*pb.ContextInvalidation)
+	nodeID  string
+}
+
+// gapRequest is the SyncRequest sent for the current gap of a context
+type gapRequest struct {
+	from, to uint64
+	traceID  string
+}
+
+// NewFollower returns a follower applying patches to engine
+func NewFollower(engine *Engine) *Follower {
+	return &Follower{
+		engine:  engine,
+		pending: make(map[string]map[uint64]*pb.ContextPatch),
+		asked:   make(map[string]gapRequest),
+		subs:    make(map[string]string),
+	}
+}
+
+// Engine returns the local replica
+func (f *Follower) Engine() *Engine {
+	return f.engine
+}
+
+// SetNodeID sets the identity sent with subscriptions. A gateway holds the
+// patches of a known node while it is offline and replays them as a
+// RetryEnvelope when it subscribes again.
+func (f *Follower) SetNodeID(nodeID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodeID = nodeID
+}
+
+// SetInvalidationHandler makes fn called with every ContextInvalidation
+// received, after the patch removing the segment has been applied
+func (f *Follower) SetInvalidationHandler(fn func(*pb.ContextInvalidation)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onInval = fn
+}
+
+// Subscribe asks peer for the patches of contextID following the local
+// version, restricted by the filter expressions (see Filter). A filtered
+// replica holds only the matching ops, so ops must not depend on
+// containers created by filtered out ones.
+func (f *Follower) Subscribe(peer Peer, contextID string, filters ...string) error {
+	env := axcp.NewEnvelope(newTraceID(), 0)
+	f.mu.Lock()
+	delete(f.asked, contextID)
+	f.subs[contextID] = env.GetTraceId()
+	nodeID := f.nodeID
+	f.mu.Unlock()
+
+	env.Payload = &pb.AxcpEnvelope_SyncSub{SyncSub: &pb.SyncSubscribe{
+		From:    &pb.ContextGraphVersion{ContextId: contextID, Version: f.engine.Version(contextID)},
+		Filters: filters,
+		NodeId:  nodeID,
+	}}
+	return peer.SendEnvelope(env)
+}
+
+// HandleEnvelope processes a ContextPatch, the patches of a RetryEnvelope,
+// a ContextInvalidation, or an ErrorMessage answering one of our
+// requests, and reports whether env was one of them. A patch
+// that cannot be applied returns its error; a refused request returns the
+// *axcp.Error sent by the server, MISSING_PATCH_RANGE if the range has been
+// compacted away and the replica must be rebuilt from elsewhere.
+func (f *Follower) HandleEnvelope(peer Peer, env *axcp.Envelope) (bool, error) {
+	if patch := env.GetContextPatch(); patch != nil {
+		return true, f.receive(peer, patch)
+	}
+	if retry := env.GetRetryEnv(); retry != nil {
+		for _, patch := range retry.GetBufferedPatches() {
+			if err := f.receive(peer, patch); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+	if inv := env.GetContextInval(); inv != nil {
+		f.mu.Lock()
+		fn := f.onInval
+		f.mu.Unlock()
+		if fn != nil {
+			fn(inv)
+		}
+		return true, nil
+	}
+
+	msg := env.GetError()
+	if msg == nil {
+		return false, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	contextID, ok := f.requestOf(env.GetTraceId())
+	if !ok {
+		return false, nil
+	}
+	delete(f.subs, contextID)
+	delete(f.pending, contextID)
+	delete(f.asked, contextID)
+	return true, axcp.ErrorFromMessage(msg)
+}
+
+// requestOf returns the context of our request with traceID. Called with
+// f.mu held.
+func (f *Follower) requestOf(traceID string) (string, bool) {
+	for id, t := range f.subs {
+		if t == traceID {
+			return id, true
+		}
+	}
+	for id, gap := range f.asked {
+		if gap.traceID == traceID {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// receive applies patch and any held back patch it unblocks
+func (f *Follower) receive(peer Peer, patch *pb.ContextPatch) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := patch.GetContextId()
+	version := f.engine.Version(id)
+	switch base := patch.GetBaseVersion(); {
+	case base < version:
+		return nil
+	case base > version:
+		if f.pending[id] == nil {
+			f.pending[id] = make(map[uint64]*pb.ContextPatch)
+		}
+		f.pending[id][base] = patch
+		return f.askGap(peer, id, version)
+	}
+
+	for patch != nil {
+		v, err := f.engine.Apply(patch)
+		if err != nil {
+			return err
+		}
+		patch = f.pending[id][v]
+		delete(f.pending[id], v)
+		// Drop duplicates held back from before the gap was filled
+		for base := range f.pending[id] {
+			if base < v {
+				delete(f.pending[id], base)
+			}
+		}
+	}
+
+	if len(f.pending[id]) == 0 {
+		delete(f.pending, id)
+		delete(f.asked, id)
+		return nil
+	}
+	return f.askGap(peer, id, f.engine.Version(id))
+}
+
+// askGap requests the patches between version and the oldest held back
+// patch, unless a request already covers them. Called with f.mu held.
+func (f *Follower) askGap(peer Peer, contextID string, version uint64) error {
+	to := uint64(0)
+	for base := range f.pending[contextID] {
+		if to == 0 || base < to {
+			to = base
+		}
+	}
+	if gap, ok := f.asked[contextID]; ok && gap.from <= version && to <= gap.to {
+		return nil
+	}
+
+	env := axcp.NewEnvelope(newTraceID(), 0)
+	f.asked[contextID] = gapRequest{from: version, to: to, traceID: env.GetTraceId()}
+	env.Payload = &pb.AxcpEnvelope_SyncReq{SyncReq: &pb.SyncRequest{
+		MissingFrom: &pb.ContextGraphVersion{ContextId: contextID, Version: version},
+		ToVersion:   to,
+	}}
+	return peer.SendEnvelope(env)
+}
+
+// newTraceID returns a random 128-bit trace_id in hex
+func newTraceID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
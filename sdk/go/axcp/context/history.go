@@ -0,0 +1,226 @@
+package context
+
+import (
+	"slices"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultHistoryLimit is the number of applied patches an Engine keeps per
+// context for replicas catching up
+const DefaultHistoryLimit = 1024
+
+// patchLog holds the applied patches of one context. patches[i] turned
+// version first+i into version first+i+1.
+type patchLog struct {
+	first   uint64
+	patches []*pb.ContextPatch
+}
+
+// watcher receives the patches of one context as they are applied, and
+// the segments they invalidate
+type watcher struct {
+	fn    func(*pb.ContextPatch)
+	inval func(*pb.ContextInvalidation)
+}
+
+// record appends an applied patch to the history, compacting it to the
+// history limit, and hands it to the watchers with an invalidation for
+// each segment that disappeared from before to after. Called with e.mu
+// held.
+func (e *Engine) record(patch *pb.ContextPatch, before, after any, reason pb.ContextInvalidation_Reason) {
+	id := patch.GetContextId()
+	patch = proto.Clone(patch).(*pb.ContextPatch)
+
+	log := e.logs[id]
+	if log == nil {
+		log = &patchLog{first: patch.GetBaseVersion()}
+		e.logs[id] = log
+	}
+	log.patches = append(log.patches, patch)
+	if drop := len(log.patches) - e.maxLog; drop > 0 {
+		log.first += uint64(drop)
+		log.patches = append([]*pb.ContextPatch(nil), log.patches[drop:]...)
+	}
+
+	// Only computed when someone listens for invalidations
+	var invalidated []*pb.ContextInvalidation
+	for w := range e.watchers[id] {
+		if w.inval == nil {
+			continue
+		}
+		for _, ptr := range removedSegments(before, after, patch.GetOps()) {
+			invalidated = append(invalidated, &pb.ContextInvalidation{ContextId: id, Path: ptr.String(),
+				Reason: reason, Version: patch.GetBaseVersion() + 1})
+		}
+		break
+	}
+	for w := range e.watchers[id] {
+		w.fn(patch)
+		if w.inval != nil {
+			for _, inv := range invalidated {
+				w.inval(inv)
+			}
+		}
+	}
+}
+
+// removedSegments returns the segments under the paths written by ops that
+// exist in before but not in after: the targets of REMOVE, and the members
+// dropped by a REPLACE or MERGE of an ancestor or of the root. Array
+// elements are only reported when removed by path, as the others shift.
+// Segments under one already reported are left out.
+func removedSegments(before, after any, ops []*pb.DeltaOp) []Pointer {
+	var gone []Pointer
+	for _, op := range ops {
+		ptr, err := ParsePointer(op.GetPath())
+		if err != nil {
+			continue
+		}
+		old, ok := lookupLogical(before, ptr)
+		if !ok {
+			continue
+		}
+		if op.GetOp() == pb.DeltaOp_REMOVE {
+			gone = append(gone, ptr)
+			continue
+		}
+		current, ok := lookupLogical(after, ptr)
+		gone = vanished(gone, ptr, old, current, ok)
+	}
+
+	var out []Pointer
+	for _, ptr := range gone {
+		if !slices.ContainsFunc(out, func(p Pointer) bool { return isPrefix(p, ptr) }) {
+			out = slices.DeleteFunc(out, func(p Pointer) bool { return isPrefix(ptr, p) })
+			out = append(out, ptr)
+		}
+	}
+	return out
+}
+
+// vanished appends to gone the pointers of the members of old, at ptr,
+// missing from current. exists reports whether ptr itself still exists.
+func vanished(gone []Pointer, ptr Pointer, old, current any, exists bool) []Pointer {
+	if !exists {
+		return append(gone, ptr)
+	}
+	was, ok := old.(map[string]any)
+	if !ok {
+		return gone
+	}
+	is, _ := current.(map[string]any)
+	for _, key := range sortedKeys(was) {
+		v, ok := is[key]
+		gone = vanished(gone, ptr.Append(key), was[key], v, ok)
+	}
+	return gone
+}
+
+// isPrefix reports whether p is ptr or one of its ancestors
+func isPrefix(p, ptr Pointer) bool {
+	return len(p) <= len(ptr) && slices.Equal(p, ptr[:len(p)])
+}
+
+// SetHistoryLimit changes how many patches are kept per context. Older
+// patches are compacted away on the next patch applied.
+func (e *Engine) SetHistoryLimit(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.maxLog = max(n, 0)
+}
+
+// Compact drops the history of the context before version
+func (e *Engine) Compact(contextID string, version uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	log := e.logs[contextID]
+	if log == nil || version <= log.first {
+		return
+	}
+	drop := min(version-log.first, uint64(len(log.patches)))
+	log.first += drop
+	log.patches = append([]*pb.ContextPatch(nil), log.patches[drop:]...)
+}
+
+// Patches returns the patches turning version from into version to; a to
+// of 0 means the current version. A range reaching before the compacted
+// history fails with MISSING_PATCH_RANGE, one past the current version
+// with INVALID_CONTEXT.
+func (e *Engine) Patches(contextID string, from, to uint64) ([]*pb.ContextPatch, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.patches(contextID, from, to)
+}
+
+// patches implements Patches with e.mu held
+func (e *Engine) patches(contextID string, from, to uint64) ([]*pb.ContextPatch, error) {
+	var current uint64
+	if doc, ok := e.docs[contextID]; ok {
+		current = doc.Version
+	}
+	if to == 0 {
+		to = current
+	}
+	if from > to || to > current {
+		return nil, axcp.NewError(pb.ErrorCode_INVALID_CONTEXT,
+			"context %q is at version %d, cannot serve %d..%d", contextID, current, from, to)
+	}
+	if from == to {
+		return nil, nil
+	}
+
+	log := e.logs[contextID]
+	if log == nil || from < log.first {
+		first := current
+		if log != nil {
+			first = log.first
+		}
+		return nil, axcp.NewError(pb.ErrorCode_MISSING_PATCH_RANGE,
+			"history of context %q starts at version %d, requested %d", contextID, first, from)
+	}
+	return append([]*pb.ContextPatch(nil), log.patches[from-log.first:to-log.first]...), nil
+}
+
+// Watch calls fn with every patch applied to the context from version
+// from onwards: first the patches already in the history, then each new
+// patch as it is applied. fn runs with the engine locked and must not
+// block or call back into the engine. The returned function stops the
+// watch.
+func (e *Engine) Watch(contextID string, from uint64, fn func(*pb.ContextPatch)) (func(), error) {
+	return e.WatchChanges(contextID, from, fn, nil)
+}
+
+// WatchChanges is Watch also calling inval, right after each new patch,
+// for the segments it removed, expired or revoked
+func (e *Engine) WatchChanges(contextID string, from uint64, fn func(*pb.ContextPatch),
+	inval func(*pb.ContextInvalidation)) (func(), error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	backlog, err := e.patches(contextID, from, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, patch := range backlog {
+		fn(patch)
+	}
+
+	w := &watcher{fn: fn, inval: inval}
+	if e.watchers[contextID] == nil {
+		e.watchers[contextID] = make(map[*watcher]struct{})
+	}
+	e.watchers[contextID][w] = struct{}{}
+
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.watchers[contextID], w)
+		if len(e.watchers[contextID]) == 0 {
+			delete(e.watchers, contextID)
+		}
+	}, nil
+}
@@ -0,0 +1,249 @@
+package context
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultLineageLimit is the number of versions an Engine keeps per
+// context, with their documents, to merge branches based on them
+const DefaultLineageLimit = 64
+
+// Version is one node of the lineage DAG of a context (spec v0.2 §6.1).
+// Its ID hashes the patch that produced it, so every replica applying the
+// same patch derives the same ID. The empty ID stands for the context
+// before its first patch, or as restored from a snapshot.
+type Version struct {
+	ID      string
+	Parents []string
+	Author  string // author node hash, see AuthorHash
+	TS      uint64
+	// Seq is the linear version the node produced, 0 for a branch that
+	// was merged into the context
+	Seq uint64
+}
+
+// lineageNode is a version with the document it produced
+type lineageNode struct {
+	Version
+	height uint64 // longest path from the root
+	value  any
+}
+
+// lineage holds the recent versions of one context
+type lineage struct {
+	nodes map[string]*lineageNode
+	order []string // insertion order, oldest first
+	head  string
+}
+
+// newLineage starts a lineage at a root holding value
+func newLineage(value any) *lineage {
+	return &lineage{
+		nodes: map[string]*lineageNode{"": {value: value}},
+		order: []string{""},
+	}
+}
+
+// AuthorHash returns the author hash recorded for nodeID
+func AuthorHash(nodeID string) string {
+	sum := sha256.Sum256([]byte(nodeID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// versionID returns the ID of the version produced by patch
+func versionID(patch *pb.ContextPatch) string {
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(patch)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// forks reports whether patch does not build on the head, naming instead
+// another version still held. Unknown parents fall back to base_version.
+func (l *lineage) forks(patch *pb.ContextPatch) bool {
+	parents := patch.GetParentIds()
+	if len(parents) == 0 || parents[0] == "" || parents[0] == l.head {
+		return false
+	}
+	_, ok := l.nodes[parents[0]]
+	return ok
+}
+
+// add records the version produced by patch and returns its ID. A patch
+// without parents builds on the head. The oldest versions beyond limit are
+// dropped.
+func (l *lineage) add(patch *pb.ContextPatch, seq uint64, value any, limit int) string {
+	id := versionID(patch)
+	parents := patch.GetParentIds()
+	if len(parents) == 0 {
+		parents = []string{l.head}
+	}
+	height := uint64(1)
+	for _, p := range parents {
+		if n, ok := l.nodes[p]; ok {
+			height = max(height, n.height+1)
+		}
+	}
+
+	if _, ok := l.nodes[id]; !ok {
+		l.order = append(l.order, id)
+	}
+	l.nodes[id] = &lineageNode{
+		Version: Version{ID: id, Parents: parents, Author: patch.GetAuthorHash(), TS: patch.GetTs(), Seq: seq},
+		height:  height,
+		value:   value,
+	}
+	for len(l.order) > max(limit, 1) {
+		delete(l.nodes, l.order[0])
+		l.order = l.order[1:]
+	}
+	return id
+}
+
+// remove drops the version id
+func (l *lineage) remove(id string) {
+	delete(l.nodes, id)
+	l.order = slices.DeleteFunc(l.order, func(o string) bool { return o == id })
+}
+
+// ancestors returns the versions reachable from id, itself included
+func (l *lineage) ancestors(id string) map[string]*lineageNode {
+	seen := make(map[string]*lineageNode)
+	queue := []string{id}
+	for len(queue) > 0 {
+		n, ok := l.nodes[queue[0]]
+		queue = queue[1:]
+		if !ok || seen[n.ID] != nil {
+			continue
+		}
+		seen[n.ID] = n
+		queue = append(queue, n.Parents...)
+	}
+	return seen
+}
+
+// ancestor returns the deepest common ancestor of a and b
+func (l *lineage) ancestor(a, b string) (*lineageNode, bool) {
+	left := l.ancestors(a)
+	var best *lineageNode
+	for id, n := range l.ancestors(b) {
+		if left[id] != nil && (best == nil || n.height > best.height) {
+			best = n
+		}
+	}
+	return best, best != nil
+}
+
+// merge applies a patch building on a version other than the head: the
+// ops are applied to that version, the result is three-way merged with
+// the head from their common ancestor, and the merge is committed as a
+// patch on top of the head whose parents are the head and the branch.
+// Called with e.mu held.
+func (e *Engine) merge(doc *Document, l *lineage, patch *pb.ContextPatch, reason pb.ContextInvalidation_Reason) (uint64, error) {
+	id := patch.GetContextId()
+	parent := l.nodes[patch.GetParentIds()[0]]
+	branch := versionID(patch)
+	if base, ok := l.ancestor(l.head, branch); ok && base.ID == branch {
+		// Already merged
+		return doc.Version, nil
+	}
+
+	theirs, err := e.patch(parent.value, patch.GetOps())
+	if err != nil {
+		return 0, err
+	}
+	base, ok := l.ancestor(l.head, parent.ID)
+	if !ok {
+		return 0, axcp.NewError(pb.ErrorCode_INVALID_CONTEXT,
+			"context %q has no common ancestor with version %q", id, parent.ID)
+	}
+	// Segmented members are merged and diffed as logical documents, the
+	// merge patch being laid out again like any other
+	ours := Assemble(doc.Value)
+	m := merger{contextID: id, resolve: e.resolve}
+	merged, err := m.merge(nil, Assemble(base.value), ours, Assemble(theirs))
+	if err != nil {
+		return 0, err
+	}
+
+	var d differ
+	d.diff(nil, ours, merged)
+	if d.err != nil {
+		return 0, d.err
+	}
+	// The branch is recorded before the merge naming it as a parent, so
+	// the height of the merge accounts for it
+	_, known := l.nodes[branch]
+	l.add(patch, 0, theirs, e.maxLin)
+	version, err := e.commit(doc, l, &pb.ContextPatch{
+		ContextId:   id,
+		BaseVersion: doc.Version,
+		Ops:         d.ops,
+		ParentIds:   []string{l.head, branch},
+		AuthorHash:  e.author,
+		Ts:          uint64(e.now().UnixMicro()),
+	}, reason)
+	if err != nil {
+		if !known {
+			l.remove(branch)
+		}
+		return 0, err
+	}
+	return version, nil
+}
+
+// SetLineageLimit changes how many versions are kept per context. A patch
+// based on an older version fails as if it had no parents.
+func (e *Engine) SetLineageLimit(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.maxLin = max(n, 1)
+}
+
+// SetAuthor sets the node whose hash is recorded on the merges made by
+// the engine
+func (e *Engine) SetAuthor(nodeID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.author = AuthorHash(nodeID)
+}
+
+// SetConflictHandler makes conflicting merges resolved by h; nil makes
+// them fail with MERGE_CONFLICT. h runs with the engine locked and must
+// not call it.
+func (e *Engine) SetConflictHandler(h ConflictHandler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.resolve = h
+}
+
+// Head returns the current version of the context in its lineage. A patch
+// naming it in parent_ids is merged even if the context moves on before
+// the patch arrives.
+func (e *Engine) Head(contextID string) Version {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if l := e.lineages[contextID]; l != nil {
+		if n, ok := l.nodes[l.head]; ok {
+			return n.Version
+		}
+	}
+	return Version{}
+}
+
+// Lineage returns a version of the context still held by the engine
+func (e *Engine) Lineage(contextID, versionID string) (Version, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if l := e.lineages[contextID]; l != nil {
+		if n, ok := l.nodes[versionID]; ok {
+			return n.Version, true
+		}
+	}
+	return Version{}, false
+}
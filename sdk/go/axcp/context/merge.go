@@ -0,0 +1,103 @@
+package context
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// removedValue is the type of Removed
+type removedValue struct{}
+
+// Removed stands for a member missing on one side of a merge. A
+// ConflictHandler returns it to drop the member.
+var Removed any = removedValue{}
+
+// Conflict is a segment changed differently on both branches of a merge.
+// Base, Ours and Theirs are decoded JSON values or Removed.
+type Conflict struct {
+	ContextID string
+	Path      string
+	Base      any
+	Ours      any
+	Theirs    any
+}
+
+// ConflictHandler resolves a conflict by returning the merged value of the
+// segment, or Removed. An error aborts the merge.
+type ConflictHandler func(c *Conflict) (any, error)
+
+// Merge three-way merges two documents derived from base (spec v0.2 §6.1).
+// A segment changed on one branch only takes that change, objects changed
+// on both are merged member by member and any other segment changed on
+// both is a conflict, handed to resolve. Without a handler conflicts fail
+// with MERGE_CONFLICT. Arrays are merged whole.
+func Merge(base, ours, theirs any, resolve ConflictHandler) (any, error) {
+	m := merger{resolve: resolve}
+	return m.merge(nil, base, ours, theirs)
+}
+
+// merger carries the state of one Merge
+type merger struct {
+	contextID string
+	resolve   ConflictHandler
+}
+
+func (m *merger) merge(ptr Pointer, base, ours, theirs any) (any, error) {
+	switch {
+	case reflect.DeepEqual(ours, theirs), reflect.DeepEqual(base, theirs):
+		return ours, nil
+	case reflect.DeepEqual(base, ours):
+		return theirs, nil
+	}
+
+	o, ok1 := ours.(map[string]any)
+	t, ok2 := theirs.(map[string]any)
+	if !ok1 || !ok2 {
+		return m.conflict(ptr, base, ours, theirs)
+	}
+	// Objects added on both branches merge as if from an empty one
+	b, _ := base.(map[string]any)
+
+	keys := sortedKeys(o)
+	for k := range t {
+		if _, ok := o[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	out := make(map[string]any, len(keys))
+	for _, k := range keys {
+		v, err := m.merge(ptr.Append(k), member(b, k), member(o, k), member(t, k))
+		if err != nil {
+			return nil, err
+		}
+		if v != Removed {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+func (m *merger) conflict(ptr Pointer, base, ours, theirs any) (any, error) {
+	c := &Conflict{ContextID: m.contextID, Path: ptr.String(), Base: base, Ours: ours, Theirs: theirs}
+	if m.resolve == nil {
+		return nil, axcp.NewError(pb.ErrorCode_MERGE_CONFLICT, "conflicting changes to %q", c.Path)
+	}
+	v, err := m.resolve(c)
+	if err != nil || v == Removed {
+		return v, err
+	}
+	return normalise(v)
+}
+
+// member returns obj[k], or Removed if it is missing
+func member(obj map[string]any, k string) any {
+	if v, ok := obj[k]; ok {
+		return v
+	}
+	return Removed
+}
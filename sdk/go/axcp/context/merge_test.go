@@ -0,0 +1,170 @@
+package context
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+func TestMerge(t *testing.T) {
+	decode := func(s string) any {
+		v, err := DecodeJSON([]byte(s))
+		require.NoError(t, err)
+		return v
+	}
+	base := decode(`{"a":1,"b":{"x":1},"c":[1]}`)
+
+	merged, err := Merge(base,
+		decode(`{"a":2,"b":{"x":1,"y":2},"c":[1]}`),
+		decode(`{"a":1,"b":{"x":1,"z":3},"c":[1,2],"d":true}`), nil)
+	require.NoError(t, err)
+	data, _ := json.Marshal(merged)
+	assert.JSONEq(t, `{"a":2,"b":{"x":1,"y":2,"z":3},"c":[1,2],"d":true}`, string(data))
+
+	ours, theirs := decode(`{"a":2,"b":{"x":2}}`), decode(`{"a":3,"c":[]}`)
+	_, err = Merge(base, ours, theirs, nil)
+	assert.Equal(t, pb.ErrorCode_MERGE_CONFLICT, axcp.ErrorCodeOf(err))
+
+	var conflicts []string
+	merged, err = Merge(base, ours, theirs, func(c *Conflict) (any, error) {
+		conflicts = append(conflicts, c.Path)
+		switch {
+		case c.Theirs == Removed:
+			return Removed, nil
+		case c.Ours == Removed:
+			return c.Theirs, nil
+		}
+		return 4, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b", "/c"}, conflicts)
+	data, _ = json.Marshal(merged)
+	assert.JSONEq(t, `{"a":4,"c":[]}`, string(data))
+}
+
+func TestEngineMergesBranches(t *testing.T) {
+	gateway := NewEngine()
+	gateway.SetAuthor("gateway")
+	_, err := gateway.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/shared", `{"intent":"chat"}`)))
+	require.NoError(t, err)
+	root := gateway.Head("ctx")
+
+	// The edge follows version 1, then edits it offline
+	edge := NewEngine()
+	for _, p := range mustPatches(t, gateway, 0, 1) {
+		_, err := edge.Apply(p)
+		require.NoError(t, err)
+	}
+	require.Equal(t, root.ID, edge.Head("ctx").ID)
+	local := func(ops ...*pb.DeltaOp) *pb.ContextPatch {
+		p := patch("ctx", edge.Version("ctx"), ops...)
+		p.ParentIds = []string{edge.Head("ctx").ID}
+		p.AuthorHash = AuthorHash("edge")
+		_, err := edge.Apply(p)
+		require.NoError(t, err)
+		return p
+	}
+	b1 := local(op(pb.DeltaOp_ADD, "/shared/lang", `"it"`))
+	b2 := local(op(pb.DeltaOp_ADD, "/edge", `true`))
+
+	// Meanwhile the gateway moves on
+	_, err = gateway.Apply(patch("ctx", 1, op(pb.DeltaOp_ADD, "/shared/user", `"ada"`)))
+	require.NoError(t, err)
+
+	version, err := gateway.Apply(b1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), version)
+	head := gateway.Head("ctx")
+	assert.Len(t, head.Parents, 2)
+	assert.Equal(t, AuthorHash("gateway"), head.Author)
+	branch, ok := gateway.Lineage("ctx", head.Parents[1])
+	require.True(t, ok)
+	assert.Equal(t, AuthorHash("edge"), branch.Author)
+	l := gateway.lineages["ctx"]
+	assert.Greater(t, l.nodes[head.ID].height, l.nodes[branch.ID].height, "the merge is above its branch")
+
+	// b2 builds on b1, now an ancestor of the head
+	version, err = gateway.Apply(b2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), version)
+	assert.JSONEq(t, `{"shared":{"intent":"chat","lang":"it","user":"ada"},"edge":true}`, docJSON(t, gateway, "ctx"))
+
+	// Redelivery is a no-op
+	version, err = gateway.Apply(b1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), version)
+
+	// Merges replicate as ordinary patches with the same lineage
+	replica := NewEngine()
+	for _, p := range mustPatches(t, gateway, 0, 4) {
+		_, err := replica.Apply(p)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, gateway.Head("ctx").ID, replica.Head("ctx").ID)
+	assert.Equal(t, docJSON(t, gateway, "ctx"), docJSON(t, replica, "ctx"))
+}
+
+func TestEngineMergeConflicts(t *testing.T) {
+	e := NewEngine()
+	_, err := e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/intent", `"chat"`)))
+	require.NoError(t, err)
+	root := e.Head("ctx").ID
+	_, err = e.Apply(patch("ctx", 1, op(pb.DeltaOp_REPLACE, "/intent", `"translate"`)))
+	require.NoError(t, err)
+
+	branch := patch("ctx", 1, op(pb.DeltaOp_REPLACE, "/intent", `"search"`))
+	branch.ParentIds = []string{root}
+	_, err = e.Apply(branch)
+	assert.Equal(t, pb.ErrorCode_MERGE_CONFLICT, axcp.ErrorCodeOf(err))
+	assert.Equal(t, uint64(2), e.Version("ctx"))
+
+	var got *Conflict
+	e.SetConflictHandler(func(c *Conflict) (any, error) {
+		got = c
+		return []any{c.Ours, c.Theirs}, nil
+	})
+	_, err = e.Apply(branch)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, Conflict{ContextID: "ctx", Path: "/intent", Base: "chat", Ours: "translate", Theirs: "search"}, *got)
+	assert.JSONEq(t, `{"intent":["translate","search"]}`, docJSON(t, e, "ctx"))
+
+	// Without parents a stale patch is still rejected
+	_, err = e.Apply(patch("ctx", 1, op(pb.DeltaOp_ADD, "/x", `1`)))
+	assert.Equal(t, pb.ErrorCode_INVALID_CONTEXT, axcp.ErrorCodeOf(err))
+}
+
+func mustPatches(t *testing.T, e *Engine, from, to uint64) []*pb.ContextPatch {
+	t.Helper()
+	patches, err := e.Patches("ctx", from, to)
+	require.NoError(t, err)
+	return patches
+}
+
+func TestEngineFailedMergeLeavesNoBranch(t *testing.T) {
+	e := NewEngine()
+	_, err := e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/a", `1`)))
+	require.NoError(t, err)
+	root := e.Head("ctx").ID
+	_, err = e.Apply(patch("ctx", 1, op(pb.DeltaOp_ADD, "/b", `2`)))
+	require.NoError(t, err)
+
+	branch := patch("ctx", 1, op(pb.DeltaOp_ADD, "/c", `3`))
+	branch.ParentIds = []string{root}
+	e.SetJournal(journalFunc(func(*pb.ContextPatch) error { return errors.New("disk full") }))
+	_, err = e.Apply(branch)
+	require.Error(t, err)
+	_, ok := e.Lineage("ctx", versionID(branch))
+	assert.False(t, ok, "the branch of a failed merge is not kept")
+
+	e.SetJournal(nil)
+	version, err := e.Apply(branch)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), version)
+	assert.JSONEq(t, `{"a":1,"b":2,"c":3}`, docJSON(t, e, "ctx"))
+}
@@ -0,0 +1,265 @@
+package context
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Documents are held as decoded JSON: map[string]any, []any, string,
+// json.Number, bool or nil. Numbers stay json.Number so they round-trip
+// without loss.
+
+// DecodeJSON decodes data into the document representation used by the
+// engine
+func DecodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return v, nil
+}
+
+// Patch applies ops to doc in order and returns the result. doc is never
+// modified, so a failing op leaves the caller's document untouched.
+// Payloads are decompressed within axcp.DefaultPayloadLimits. Errors are
+// *axcp.Error with code BAD_DELTA, or PAYLOAD_TOO_LARGE for payloads over
+// the limits.
+func Patch(doc any, ops []*pb.DeltaOp) (any, error) {
+	return patchWithLimits(doc, ops, axcp.DefaultPayloadLimits)
+}
+
+func patchWithLimits(doc any, ops []*pb.DeltaOp, limits axcp.PayloadLimits) (any, error) {
+	doc = clone(doc)
+	for i, op := range ops {
+		var err error
+		if doc, err = applyOp(doc, op, limits); err != nil {
+			return nil, opError(i, op, err)
+		}
+	}
+	return doc, nil
+}
+
+// opError prefixes err with the op that caused it, keeping its AXCP code
+func opError(i int, op *pb.DeltaOp, err error) error {
+	code, msg := pb.ErrorCode_BAD_DELTA, err.Error()
+	if axErr, ok := err.(*axcp.Error); ok {
+		code, msg = axErr.Code, axErr.Reason
+	}
+	return axcp.NewError(code, "op %d (%s %s): %s", i, op.GetOp(), op.GetPath(), msg)
+}
+
+// opValue decodes the JSON value carried by op, gzipped or not
+func opValue(op *pb.DeltaOp, limits axcp.PayloadLimits) (any, error) {
+	raw, err := axcp.DecompressPayload(op.GetData(), limits)
+	if err != nil {
+		return nil, err
+	}
+	v, err := DecodeJSON(raw)
+	if err != nil {
+		return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "invalid JSON data: %v", err)
+	}
+	return v, nil
+}
+
+// applyOp applies a single op to doc, which it may modify in place
+func applyOp(doc any, op *pb.DeltaOp, limits axcp.PayloadLimits) (any, error) {
+	ptr, err := ParsePointer(op.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	return applyAt(doc, ptr, op, limits)
+}
+
+// applyAt applies op at ptr instead of its path
+func applyAt(doc any, ptr Pointer, op *pb.DeltaOp, limits axcp.PayloadLimits) (any, error) {
+	switch op.GetOp() {
+	case pb.DeltaOp_ADD:
+		v, err := opValue(op, limits)
+		if err != nil {
+			return nil, err
+		}
+		return set(doc, ptr, v, true)
+	case pb.DeltaOp_REPLACE:
+		v, err := opValue(op, limits)
+		if err != nil {
+			return nil, err
+		}
+		return set(doc, ptr, v, false)
+	case pb.DeltaOp_REMOVE:
+		return remove(doc, ptr)
+	case pb.DeltaOp_MERGE:
+		v, err := opValue(op, limits)
+		if err != nil {
+			return nil, err
+		}
+		// A missing target merges into null and is created like ADD
+		target, exists := Lookup(doc, ptr)
+		return set(doc, ptr, mergePatch(target, v), !exists)
+	default:
+		return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "unknown op type %d", op.GetOp())
+	}
+}
+
+// Lookup returns the value at ptr and whether it exists
+func Lookup(doc any, ptr Pointer) (any, bool) {
+	for _, tok := range ptr {
+		switch node := doc.(type) {
+		case map[string]any:
+			v, ok := node[tok]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(tok, len(node)-1)
+			if err != nil {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// set writes v at ptr. With insert it follows RFC 6902 "add": object
+// members are created or overwritten and array elements are inserted, "-"
+// appending. Without insert the target must already exist ("replace").
+func set(doc any, ptr Pointer, v any, insert bool) (any, error) {
+	if len(ptr) == 0 {
+		return v, nil
+	}
+
+	parentPtr, last := ptr[:len(ptr)-1], ptr[len(ptr)-1]
+	parent, ok := Lookup(doc, parentPtr)
+	if !ok {
+		return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "parent %s does not exist", parentPtr)
+	}
+
+	switch node := parent.(type) {
+	case map[string]any:
+		if _, exists := node[last]; !exists && !insert {
+			return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "member %q does not exist", last)
+		}
+		node[last] = v
+		return doc, nil
+	case []any:
+		if !insert {
+			i, err := arrayIndex(last, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = v
+			return doc, nil
+		}
+		i := len(node)
+		if last != "-" {
+			var err error
+			if i, err = arrayIndex(last, len(node)); err != nil {
+				return nil, err
+			}
+		}
+		node = append(node, nil)
+		copy(node[i+1:], node[i:])
+		node[i] = v
+		return set(doc, parentPtr, node, false)
+	default:
+		return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "parent %s is not a container", parentPtr)
+	}
+}
+
+// remove deletes the value at ptr, which must exist
+func remove(doc any, ptr Pointer) (any, error) {
+	if len(ptr) == 0 {
+		return nil, nil
+	}
+
+	parentPtr, last := ptr[:len(ptr)-1], ptr[len(ptr)-1]
+	parent, ok := Lookup(doc, parentPtr)
+	if !ok {
+		return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "parent %s does not exist", parentPtr)
+	}
+
+	switch node := parent.(type) {
+	case map[string]any:
+		if _, exists := node[last]; !exists {
+			return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "member %q does not exist", last)
+		}
+		delete(node, last)
+		return doc, nil
+	case []any:
+		i, err := arrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node[:i:i], node[i+1:]...)
+		return set(doc, parentPtr, node, false)
+	default:
+		return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "parent %s is not a container", parentPtr)
+	}
+}
+
+// arrayIndex parses an array reference token in [0, max]. Leading zeros
+// are not allowed (RFC 6901 §4).
+func arrayIndex(tok string, max int) (int, error) {
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || (len(tok) > 1 && tok[0] == '0') {
+		return 0, axcp.NewError(pb.ErrorCode_BAD_DELTA, "%q is not an array index", tok)
+	}
+	if i > max {
+		return 0, axcp.NewError(pb.ErrorCode_BAD_DELTA, "index %d out of range", i)
+	}
+	return i, nil
+}
+
+// mergePatch applies patch to target as a JSON Merge Patch (RFC 7386)
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// clone returns a deep copy of a decoded JSON value
+func clone(v any) any {
+	switch node := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(node))
+		for k, child := range node {
+			out[k] = clone(child)
+		}
+		return out
+	case []any:
+		out := make([]any, len(node))
+		for i, child := range node {
+			out[i] = clone(child)
+		}
+		return out
+	default:
+		return v
+	}
+}
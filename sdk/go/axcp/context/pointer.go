@@ -0,0 +1,86 @@
+package context
+
+import (
+	"strings"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Pointer is a parsed JSON Pointer (RFC 6901). The empty pointer refers to
+// the whole document.
+type Pointer []string
+
+// ParsePointer parses s. Errors are *axcp.Error with code BAD_DELTA.
+func ParsePointer(s string) (Pointer, error) {
+	if s == "" {
+		return Pointer{}, nil
+	}
+	if s[0] != '/' {
+		return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "pointer %q does not start with /", s)
+	}
+
+	tokens := strings.Split(s[1:], "/")
+	for i, tok := range tokens {
+		unescaped, ok := unescapeToken(tok)
+		if !ok {
+			return nil, axcp.NewError(pb.ErrorCode_BAD_DELTA, "pointer %q has an invalid ~ escape", s)
+		}
+		tokens[i] = unescaped
+	}
+	return tokens, nil
+}
+
+// unescapeToken decodes ~1 to / and ~0 to ~, rejecting any other ~ sequence
+func unescapeToken(tok string) (string, bool) {
+	if !strings.Contains(tok, "~") {
+		return tok, true
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(tok); i++ {
+		if tok[i] != '~' {
+			b.WriteByte(tok[i])
+			continue
+		}
+		if i+1 == len(tok) {
+			return "", false
+		}
+		switch tok[i+1] {
+		case '0':
+			b.WriteByte('~')
+		case '1':
+			b.WriteByte('/')
+		default:
+			return "", false
+		}
+		i++
+	}
+	return b.String(), true
+}
+
+// EscapeToken escapes a single reference token, turning ~ into ~0 and /
+// into ~1
+func EscapeToken(tok string) string {
+	if !strings.ContainsAny(tok, "~/") {
+		return tok
+	}
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(tok)
+}
+
+// String formats the pointer with escaped tokens
+func (p Pointer) String() string {
+	var b strings.Builder
+	for _, tok := range p {
+		b.WriteByte('/')
+		b.WriteString(EscapeToken(tok))
+	}
+	return b.String()
+}
+
+// Append returns a pointer to the child tok of p
+func (p Pointer) Append(tok string) Pointer {
+	child := make(Pointer, len(p), len(p)+1)
+	copy(child, p)
+	return append(child, tok)
+}
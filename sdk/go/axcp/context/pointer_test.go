@@ -0,0 +1,36 @@
+package context
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+func TestParsePointer(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Pointer
+	}{
+		{"", Pointer{}},
+		{"/", Pointer{""}},
+		{"/agent/status", Pointer{"agent", "status"}},
+		{"/a~1b/m~0n", Pointer{"a/b", "m~n"}},
+		{"/~01", Pointer{"~1"}},
+	}
+	for _, tt := range tests {
+		got, err := ParsePointer(tt.in)
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got)
+		assert.Equal(t, tt.in, got.String(), "round trip")
+	}
+}
+
+func TestParsePointerInvalid(t *testing.T) {
+	for _, in := range []string{"agent", "/a~", "/a~2"} {
+		_, err := ParsePointer(in)
+		assert.Equal(t, pb.ErrorCode_BAD_DELTA, axcp.ErrorCodeOf(err), in)
+	}
+}
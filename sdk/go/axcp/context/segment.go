@@ -0,0 +1,314 @@
+package context
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// MaxSegmentSize is the largest encoded Context Segment (spec v0.2 §6.1).
+// The segments of a context are the members of its document, or the whole
+// document if it is not an object.
+const MaxSegmentSize = 64 << 10
+
+// maxBuckets bounds the segments a single member is split into
+const maxBuckets = 1024
+
+// An object member too large for one segment is split by the engine: the
+// member becomes a manifest {"$segments": n} and its own members are
+// spread by hash over the top-level buckets "<member>#0" to "<member>#n-1".
+// Ops keep addressing the logical pointer /<member>/<name>/..., which the
+// engine routes to the bucket holding <name>, so pointers stay valid
+// whatever the layout. Only the members the engine created are reserved:
+// ops writing a bucket of a segmented member, or a top-level member
+// holding $segments, fail with BAD_DELTA. A member that would need a
+// bucket name already taken by another member is not split.
+const segmentsKey = "$segments"
+
+// bucketKey returns the member holding bucket i of the segmented key
+func bucketKey(key string, i int) string {
+	return key + "#" + strconv.Itoa(i)
+}
+
+// checkReserved fails with BAD_DELTA if the member key of obj, written by
+// an op, takes a reserved form
+func checkReserved(obj map[string]any, key string) error {
+	if _, ok := bucketBase(obj, key); ok {
+		return errReservedKey(key)
+	}
+	if member, ok := obj[key].(map[string]any); ok {
+		if _, ok := member[segmentsKey]; ok {
+			return axcp.NewError(pb.ErrorCode_BAD_DELTA, "member %q holds the reserved key %s", key, segmentsKey)
+		}
+	}
+	return nil
+}
+
+// errReservedKey is the error of an op writing the bucket key
+func errReservedKey(key string) error {
+	return axcp.NewError(pb.ErrorCode_BAD_DELTA, "member %q is a bucket of a segmented member", key)
+}
+
+// bucketOf returns the bucket of member among n
+func bucketOf(member string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(member))
+	return int(h.Sum32() % uint32(n))
+}
+
+// segments returns the number of buckets of the member key of doc, 0 if
+// it is not segmented
+func segments(doc any, key string) int {
+	obj, _ := doc.(map[string]any)
+	manifest, ok := obj[key].(map[string]any)
+	if !ok || len(manifest) != 1 {
+		return 0
+	}
+	n, ok := manifest[segmentsKey].(json.Number)
+	if !ok {
+		return 0
+	}
+	i, err := strconv.Atoi(string(n))
+	if err != nil || i <= 0 || i > maxBuckets {
+		return 0
+	}
+	return i
+}
+
+// bucketBase returns the segmented member whose bucket is key
+func bucketBase(obj map[string]any, key string) (string, bool) {
+	hash := strings.LastIndexByte(key, '#')
+	if hash < 0 {
+		return "", false
+	}
+	i, err := strconv.Atoi(key[hash+1:])
+	return key[:hash], err == nil && bucketKey(key[:hash], i) == key && i < segments(obj, key[:hash])
+}
+
+// unsegment joins the buckets of the member key back into it
+func unsegment(obj map[string]any, key string) {
+	n := segments(obj, key)
+	if n == 0 {
+		return
+	}
+	joined := make(map[string]any)
+	for i := 0; i < n; i++ {
+		bucket, _ := obj[bucketKey(key, i)].(map[string]any)
+		for k, v := range bucket {
+			joined[k] = v
+		}
+		delete(obj, bucketKey(key, i))
+	}
+	obj[key] = joined
+}
+
+// Assemble returns the logical document of doc, with every segmented
+// member joined back
+func Assemble(doc any) any {
+	out := clone(doc)
+	if obj, ok := out.(map[string]any); ok {
+		for key := range obj {
+			unsegment(obj, key)
+		}
+	}
+	return out
+}
+
+// Resolve returns the value at the logical pointer of the context
+func (e *Engine) Resolve(contextID, pointer string) (any, error) {
+	ptr, err := ParsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	doc, ok := e.docs[contextID]
+	if !ok {
+		return nil, axcp.NewError(pb.ErrorCode_INVALID_CONTEXT, "unknown context %q", contextID)
+	}
+	v, ok := lookupLogical(doc.Value, ptr)
+	if !ok {
+		return nil, axcp.NewError(pb.ErrorCode_INVALID_CONTEXT, "%s does not exist in context %q", pointer, contextID)
+	}
+	return clone(v), nil
+}
+
+// lookupLogical is Lookup of the logical pointer ptr in the segmented doc
+func lookupLogical(doc any, ptr Pointer) (any, bool) {
+	if len(ptr) == 0 {
+		return Assemble(doc), true
+	}
+	if n := segments(doc, ptr[0]); n > 0 {
+		if len(ptr) == 1 {
+			return Assemble(doc).(map[string]any)[ptr[0]], true
+		}
+		ptr = append(Pointer{bucketKey(ptr[0], bucketOf(ptr[1], n))}, ptr[1:]...)
+	}
+	return Lookup(doc, ptr)
+}
+
+// SetSegmentLimit changes the largest encoded segment, MaxSegmentSize by
+// default; 0 disables the limit and segmentation
+func (e *Engine) SetSegmentLimit(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.maxSeg = max(n, 0)
+}
+
+// patch applies ops to doc like Patch, routing the ops addressing a
+// segmented member to its buckets, then splits the members outgrowing the
+// segment limit. A segment that cannot be split fails with
+// PAYLOAD_TOO_LARGE, a member written in a reserved form with BAD_DELTA.
+func (e *Engine) patch(doc any, ops []*pb.DeltaOp) (any, error) {
+	if e.maxSeg == 0 {
+		return patchWithLimits(doc, ops, e.limits)
+	}
+
+	doc = clone(doc)
+	touched := make(map[string]bool)
+	written := make(map[string]bool) // members written by the ops, not routed
+	whole := false
+	for i, op := range ops {
+		ptr, err := ParsePointer(op.GetPath())
+		if err != nil {
+			return nil, opError(i, op, err)
+		}
+		if len(ptr) == 0 {
+			whole = true
+		}
+		if obj, ok := doc.(map[string]any); ok {
+			switch {
+			case len(ptr) == 0:
+				doc = Assemble(obj)
+			case len(ptr) == 1:
+				// The member is written whole and laid out again below
+				unsegment(obj, ptr[0])
+				touched[ptr[0]], written[ptr[0]] = true, true
+			default:
+				if _, ok := bucketBase(obj, ptr[0]); ok {
+					// Buckets are addressed through their member
+					return nil, opError(i, op, errReservedKey(ptr[0]))
+				}
+				if n := segments(obj, ptr[0]); n > 0 {
+					ptr = append(Pointer{bucketKey(ptr[0], bucketOf(ptr[1], n))}, ptr[1:]...)
+				} else {
+					written[ptr[0]] = true
+				}
+				touched[ptr[0]] = true
+			}
+		}
+		if doc, err = applyAt(doc, ptr, op, e.limits); err != nil {
+			return nil, opError(i, op, err)
+		}
+	}
+
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		if size := encodedSize(doc); size > e.maxSeg {
+			return nil, axcp.NewError(pb.ErrorCode_PAYLOAD_TOO_LARGE,
+				"document is %d bytes, over the %d byte segment limit", size, e.maxSeg)
+		}
+		return doc, nil
+	}
+	if whole {
+		for key := range obj {
+			touched[key], written[key] = true, true
+		}
+	}
+	for key := range written {
+		if err := checkReserved(obj, key); err != nil {
+			return nil, err
+		}
+	}
+	for key := range touched {
+		if base, ok := bucketBase(obj, key); ok {
+			key = base
+		}
+		if err := e.fit(obj, key); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// fit splits the member key of obj if it outgrows the segment limit
+func (e *Engine) fit(obj map[string]any, key string) error {
+	n := segments(obj, key)
+	if n > 0 {
+		fits := true
+		for i := 0; i < n && fits; i++ {
+			fits = encodedSize(obj[bucketKey(key, i)]) <= e.maxSeg
+		}
+		if fits {
+			return nil
+		}
+		unsegment(obj, key)
+	}
+
+	v, ok := obj[key]
+	if !ok {
+		return nil
+	}
+	size := encodedSize(v)
+	if size <= e.maxSeg {
+		return nil
+	}
+	members, ok := v.(map[string]any)
+	if !ok {
+		return axcp.NewError(pb.ErrorCode_PAYLOAD_TOO_LARGE,
+			"segment %q is %d bytes, over the %d byte limit", key, size, e.maxSeg)
+	}
+	for name, member := range members {
+		if size := encodedSize(map[string]any{name: member}); size > e.maxSeg {
+			return axcp.NewError(pb.ErrorCode_PAYLOAD_TOO_LARGE,
+				"member %q of segment %q is %d bytes, over the %d byte limit", name, key, size, e.maxSeg)
+		}
+	}
+
+	for n = max(2*n, 2); n <= maxBuckets; n *= 2 {
+		for i := 0; i < n; i++ {
+			if _, ok := obj[bucketKey(key, i)]; ok {
+				return axcp.NewError(pb.ErrorCode_PAYLOAD_TOO_LARGE,
+					"segment %q is %d bytes and cannot be split, member %q is taken", key, size, bucketKey(key, i))
+			}
+		}
+		buckets := make([]map[string]any, n)
+		for i := range buckets {
+			buckets[i] = make(map[string]any)
+		}
+		for name, member := range members {
+			buckets[bucketOf(name, n)][name] = member
+		}
+		fits := true
+		for _, bucket := range buckets {
+			if encodedSize(bucket) > e.maxSeg {
+				fits = false
+				break
+			}
+		}
+		if !fits {
+			continue
+		}
+		obj[key] = map[string]any{segmentsKey: json.Number(strconv.Itoa(n))}
+		for i, bucket := range buckets {
+			obj[bucketKey(key, i)] = bucket
+		}
+		return nil
+	}
+	return axcp.NewError(pb.ErrorCode_PAYLOAD_TOO_LARGE,
+		"segment %q is %d bytes, too large to split", key, size)
+}
+
+// encodedSize returns the length of v encoded as JSON
+func encodedSize(v any) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
@@ -0,0 +1,139 @@
+package context
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// memory returns an object of n members of about size bytes each
+func memory(n, size int) string {
+	members := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		members[fmt.Sprintf("m%d", i)] = strings.Repeat("x", size)
+	}
+	data, _ := json.Marshal(members)
+	return string(data)
+}
+
+func TestEngineRejectsOversizedSegments(t *testing.T) {
+	e := NewEngine()
+	e.SetSegmentLimit(1024)
+
+	_, err := e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/blob", `"`+strings.Repeat("x", 2000)+`"`)))
+	assert.Equal(t, pb.ErrorCode_PAYLOAD_TOO_LARGE, axcp.ErrorCodeOf(err))
+	_, err = e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/memory", `{"big":"`+strings.Repeat("x", 2000)+`"}`)))
+	assert.Equal(t, pb.ErrorCode_PAYLOAD_TOO_LARGE, axcp.ErrorCodeOf(err), "a single member cannot be split")
+	assert.Equal(t, uint64(0), e.Version("ctx"))
+
+	e.SetSegmentLimit(0)
+	_, err = e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/blob", `"`+strings.Repeat("x", 2000)+`"`)))
+	assert.NoError(t, err)
+}
+
+func TestEngineSplitsLargeMembers(t *testing.T) {
+	e := NewEngine()
+	e.SetSegmentLimit(4096)
+
+	_, err := e.Apply(patch("ctx", 0,
+		op(pb.DeltaOp_ADD, "/user", `"ada"`), op(pb.DeltaOp_ADD, "/memory", memory(40, 200))))
+	require.NoError(t, err)
+
+	root := e.docs["ctx"].Value.(map[string]any)
+	n := segments(root, "memory")
+	require.Greater(t, n, 1)
+	for key, v := range root {
+		assert.LessOrEqual(t, encodedSize(v), 4096, key)
+	}
+
+	// Logical pointers are routed to the bucket holding the member
+	_, err = e.Apply(patch("ctx", 1,
+		op(pb.DeltaOp_REPLACE, "/memory/m7", `"seven"`),
+		op(pb.DeltaOp_REMOVE, "/memory/m8", ``),
+		op(pb.DeltaOp_ADD, "/memory/note", `{"tags":[]}`),
+		op(pb.DeltaOp_ADD, "/memory/note/tags/-", `"t"`)))
+	require.NoError(t, err)
+	v, err := e.Resolve("ctx", "/memory/m7")
+	require.NoError(t, err)
+	assert.Equal(t, "seven", v)
+	v, err = e.Resolve("ctx", "/memory/note/tags/0")
+	require.NoError(t, err)
+	assert.Equal(t, "t", v)
+	_, err = e.Resolve("ctx", "/memory/m8")
+	assert.Equal(t, pb.ErrorCode_INVALID_CONTEXT, axcp.ErrorCodeOf(err))
+	v, err = e.Resolve("ctx", "/memory")
+	require.NoError(t, err)
+	assert.Len(t, v, 40)
+
+	// Growing a bucket past the limit splits the member further
+	for i := 40; i < 80; i++ {
+		_, err = e.Apply(patch("ctx", e.Version("ctx"), op(pb.DeltaOp_ADD, fmt.Sprintf("/memory/m%d", i), `"`+strings.Repeat("y", 200)+`"`)))
+		require.NoError(t, err)
+	}
+	assert.Greater(t, segments(e.docs["ctx"].Value, "memory"), n)
+	doc, _ := e.Get("ctx")
+	assert.Len(t, doc.Value.(map[string]any)["memory"], 80, "Get returns the logical document")
+
+	// Replicas applying the same patches hold the same layout
+	replica := NewEngine()
+	replica.SetSegmentLimit(4096)
+	for _, p := range mustPatches(t, e, 0, 0) {
+		_, err := replica.Apply(p)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, e.docs["ctx"].Value, replica.docs["ctx"].Value)
+
+	// Writing the member whole lays it out again
+	_, err = e.Apply(patch("ctx", e.Version("ctx"), op(pb.DeltaOp_REPLACE, "/memory", `{"m0":"small"}`)))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"user":"ada","memory":{"m0":"small"}}`, docJSON(t, e, "ctx"))
+}
+
+func TestEngineReservesSegmentForms(t *testing.T) {
+	e := NewEngine()
+	e.SetSegmentLimit(4096)
+	_, err := e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/m", memory(40, 200))))
+	require.NoError(t, err)
+	require.Greater(t, segments(e.docs["ctx"].Value, "m"), 1)
+
+	for name, ops := range map[string][]*pb.DeltaOp{
+		"bucket key":         {op(pb.DeltaOp_ADD, "/m#1", `"user data"`)},
+		"inside a bucket":    {op(pb.DeltaOp_REPLACE, "/m#0/m1", `"x"`)},
+		"manifest value":     {op(pb.DeltaOp_ADD, "/z", `{"$segments":2}`)},
+		"manifest member":    {op(pb.DeltaOp_ADD, "/z", `{}`), op(pb.DeltaOp_ADD, "/z/$segments", `2`)},
+		"whole document":     {op(pb.DeltaOp_REPLACE, "", `{"z":{"$segments":2}}`)},
+		"merged at the root": {op(pb.DeltaOp_MERGE, "", `{"z":{"$segments":2,"x":1}}`)},
+	} {
+		_, err := e.Apply(patch("ctx", 1, ops...))
+		assert.Equal(t, pb.ErrorCode_BAD_DELTA, axcp.ErrorCodeOf(err), name)
+	}
+	assert.Equal(t, uint64(1), e.Version("ctx"))
+
+	// Other uses of # and $segments are plain data
+	_, err = e.Apply(patch("ctx", 1,
+		op(pb.DeltaOp_ADD, "/a#b", `1`),
+		op(pb.DeltaOp_ADD, "/issue#42", `{}`),
+		op(pb.DeltaOp_ADD, "/m#01", `3`),
+		op(pb.DeltaOp_ADD, "/z", `{"inner":{"$segments":2}}`),
+		op(pb.DeltaOp_ADD, "/m/k#1", `2`)))
+	require.NoError(t, err)
+	v, err := e.Resolve("ctx", "/z/inner")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"$segments": json.Number("2")}, v)
+	v, err = e.Resolve("ctx", "/m/k#1")
+	require.NoError(t, err)
+	assert.Equal(t, json.Number("2"), v)
+	v, err = e.Resolve("ctx", "/m#01")
+	require.NoError(t, err)
+	assert.Equal(t, json.Number("3"), v)
+
+	// A member cannot be split over the name of another one
+	_, err = e.Apply(patch("ctx", 2, op(pb.DeltaOp_ADD, "/n#0", `1`), op(pb.DeltaOp_ADD, "/n", memory(40, 200))))
+	assert.Equal(t, pb.ErrorCode_PAYLOAD_TOO_LARGE, axcp.ErrorCodeOf(err))
+}
@@ -0,0 +1,129 @@
+package context
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// SnapshotFormat selects the encoding of an exported snapshot
+type SnapshotFormat int
+
+const (
+	// SnapshotJSON encodes {"context_id", "version", "document"}
+	SnapshotJSON SnapshotFormat = iota
+	// SnapshotProto encodes a ContextSnapshot message
+	SnapshotProto
+)
+
+// snapshotJSON is the JSON form of a snapshot
+type snapshotJSON struct {
+	ContextID string            `json:"context_id"`
+	Version   uint64            `json:"version"`
+	Document  json.RawMessage   `json:"document"`
+	ExpiryMs  map[string]uint64 `json:"expiry_ms,omitempty"`
+}
+
+// Snapshot returns the context at its current version (spec v0.2 §6.4),
+// with the deadlines of the segments written with a ttl_ms. The document
+// keeps its segment layout, buckets and manifests included, so a restored
+// engine routes the next patches like the others.
+func (e *Engine) Snapshot(contextID string) (*pb.ContextSnapshot, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	doc, ok := e.docs[contextID]
+	if !ok {
+		return nil, axcp.NewError(pb.ErrorCode_INVALID_CONTEXT, "unknown context %q", contextID)
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode context %q: %w", contextID, err)
+	}
+	snap := &pb.ContextSnapshot{
+		Version:  &pb.ContextGraphVersion{ContextId: contextID, Version: doc.Version},
+		Document: data,
+	}
+	for path, at := range e.expiry[contextID] {
+		if snap.ExpiryMs == nil {
+			snap.ExpiryMs = make(map[string]uint64)
+		}
+		snap.ExpiryMs[path] = uint64(at.UnixMilli())
+	}
+	return snap, nil
+}
+
+// Restore replaces the context with snap. The patch history and lineage of
+// the context restart at the snapshot version and the journal is not
+// written, the snapshot being already persisted. The ttl_ms deadlines of
+// the snapshot are scheduled again; ExpireDue removes those already past.
+func (e *Engine) Restore(snap *pb.ContextSnapshot) error {
+	id := snap.GetVersion().GetContextId()
+	if id == "" {
+		return axcp.NewError(pb.ErrorCode_INVALID_CONTEXT, "missing context_id")
+	}
+	value, err := DecodeJSON(snap.GetDocument())
+	if err != nil {
+		return axcp.NewError(pb.ErrorCode_INVALID_CONTEXT, "invalid snapshot of %q: %v", id, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	version := snap.GetVersion().GetVersion()
+	e.docs[id] = &Document{ID: id, Version: version, Value: value}
+	e.logs[id] = &patchLog{first: version}
+	e.lineages[id] = newLineage(value)
+	delete(e.expiry, id)
+	for path, ms := range snap.GetExpiryMs() {
+		if e.expiry[id] == nil {
+			e.expiry[id] = make(map[string]time.Time)
+		}
+		e.expiry[id][path] = time.UnixMilli(int64(ms))
+	}
+	return nil
+}
+
+// EncodeSnapshot serialises snap for export
+func EncodeSnapshot(snap *pb.ContextSnapshot, format SnapshotFormat) ([]byte, error) {
+	switch format {
+	case SnapshotJSON:
+		return json.Marshal(snapshotJSON{
+			ContextID: snap.GetVersion().GetContextId(),
+			Version:   snap.GetVersion().GetVersion(),
+			Document:  snap.GetDocument(),
+			ExpiryMs:  snap.GetExpiryMs(),
+		})
+	case SnapshotProto:
+		return proto.Marshal(snap)
+	default:
+		return nil, fmt.Errorf("unknown snapshot format %d", format)
+	}
+}
+
+// DecodeSnapshot parses a snapshot produced by EncodeSnapshot
+func DecodeSnapshot(data []byte, format SnapshotFormat) (*pb.ContextSnapshot, error) {
+	switch format {
+	case SnapshotJSON:
+		var s snapshotJSON
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("invalid JSON snapshot: %w", err)
+		}
+		return &pb.ContextSnapshot{
+			Version:  &pb.ContextGraphVersion{ContextId: s.ContextID, Version: s.Version},
+			Document: s.Document,
+			ExpiryMs: s.ExpiryMs,
+		}, nil
+	case SnapshotProto:
+		snap := &pb.ContextSnapshot{}
+		if err := proto.Unmarshal(data, snap); err != nil {
+			return nil, fmt.Errorf("invalid protobuf snapshot: %w", err)
+		}
+		return snap, nil
+	default:
+		return nil, fmt.Errorf("unknown snapshot format %d", format)
+	}
+}
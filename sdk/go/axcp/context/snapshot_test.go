@@ -0,0 +1,99 @@
+package context
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	e := serverWith(t, 3)
+	snap, err := e.Snapshot("ctx")
+	require.NoError(t, err)
+
+	for _, format := range []SnapshotFormat{SnapshotJSON, SnapshotProto} {
+		data, err := EncodeSnapshot(snap, format)
+		require.NoError(t, err)
+		decoded, err := DecodeSnapshot(data, format)
+		require.NoError(t, err)
+
+		restored := NewEngine()
+		require.NoError(t, restored.Restore(decoded))
+		assert.Equal(t, uint64(3), restored.Version("ctx"))
+		assert.JSONEq(t, `{"n":1}`, docJSON(t, restored, "ctx"))
+
+		// Patches continue from the snapshot version, older ones are gone
+		_, err = restored.Apply(patch("ctx", 3, op(pb.DeltaOp_ADD, "/m", `2`)))
+		require.NoError(t, err)
+		_, err = restored.Patches("ctx", 2, 0)
+		assert.Equal(t, pb.ErrorCode_MISSING_PATCH_RANGE, axcp.ErrorCodeOf(err))
+	}
+
+	data, err := EncodeSnapshot(snap, SnapshotJSON)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"context_id":"ctx","version":3,"document":{"n":1}}`, string(data))
+
+	_, err = e.Snapshot("missing")
+	assert.Equal(t, pb.ErrorCode_INVALID_CONTEXT, axcp.ErrorCodeOf(err))
+}
+
+func TestSnapshotKeepsTTL(t *testing.T) {
+	e := NewEngine()
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+	token := op(pb.DeltaOp_ADD, "/token", `"x"`)
+	token.TtlMs = 500
+	_, err := e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/user", `"ada"`), token))
+	require.NoError(t, err)
+	snap, err := e.Snapshot("ctx")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"/token": 1000500}, snap.GetExpiryMs())
+
+	for _, format := range []SnapshotFormat{SnapshotJSON, SnapshotProto} {
+		data, err := EncodeSnapshot(snap, format)
+		require.NoError(t, err)
+		decoded, err := DecodeSnapshot(data, format)
+		require.NoError(t, err)
+
+		restored := NewEngine()
+		require.NoError(t, restored.Restore(decoded))
+		assert.Equal(t, 0, restored.ExpireDue(now.Add(100*time.Millisecond)))
+		assert.Equal(t, 1, restored.ExpireDue(now.Add(500*time.Millisecond)), "deadline survives the restore")
+		assert.JSONEq(t, `{"user":"ada"}`, docJSON(t, restored, "ctx"))
+	}
+}
+
+// journalFunc adapts a function to Journal
+type journalFunc func(*pb.ContextPatch) error
+
+func (f journalFunc) Append(p *pb.ContextPatch) error { return f(p) }
+
+func TestJournalFailureAbortsPatch(t *testing.T) {
+	e := NewEngine()
+	var journaled []*pb.ContextPatch
+	fail := false
+	e.SetJournal(journalFunc(func(p *pb.ContextPatch) error {
+		if fail {
+			return errors.New("disk full")
+		}
+		journaled = append(journaled, p)
+		return nil
+	}))
+
+	_, err := e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/a", `1`)))
+	require.NoError(t, err)
+	_, err = e.Apply(patch("ctx", 0, op(pb.DeltaOp_ADD, "/a", `1`)))
+	require.Error(t, err)
+	assert.Len(t, journaled, 1, "rejected patches are not journaled")
+
+	fail = true
+	_, err = e.Apply(patch("ctx", 1, op(pb.DeltaOp_ADD, "/b", `2`)))
+	require.Error(t, err)
+	assert.Equal(t, uint64(1), e.Version("ctx"))
+	assert.JSONEq(t, `{"a":1}`, docJSON(t, e, "ctx"))
+}
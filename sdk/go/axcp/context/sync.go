@@ -0,0 +1,247 @@
+package context
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// ErrPeerGone is returned when subscribing a peer being unsubscribed
+var ErrPeerGone = errors.New("context: peer unsubscribed")
+
+// SyncQueueSize is the number of envelopes a SyncServer queues for a peer
+// before it drops new patches
+const SyncQueueSize = 1024
+
+// Peer is the other end of a replication session. netquic.Conn and
+// netquic.ResilientClient satisfy it.
+type Peer interface {
+	SendEnvelope(env *axcp.Envelope) error
+}
+
+// SyncServer streams the patches of an Engine to subscribed replicas
+// (spec v0.2 §6.3). A SyncSubscribe{from} is answered with every patch
+// based on from or later, followed by each new patch as it is applied and
+// a ContextInvalidation for each segment it removes; a
+// SyncRequest{missing_from, to_version} with the patches of that range
+// only. Ranges no longer in the history are refused with
+// MISSING_PATCH_RANGE. Patches are cut down to the ops matching the
+// filters of the subscription. It is safe for concurrent use.
+//
+// A peer that falls SyncQueueSize envelopes behind loses the new patches
+// and invalidations until it catches up. The next patch it receives
+// reveals the gap, which the follower fills with a SyncRequest.
+type SyncServer struct {
+	engine *Engine
+
+	mu    sync.Mutex
+	peers map[Peer]*syncPeer
+}
+
+// NewSyncServer returns a server replicating engine
+func NewSyncServer(engine *Engine) *SyncServer {
+	return &SyncServer{engine: engine, peers: make(map[Peer]*syncPeer)}
+}
+
+// syncPeer queues the patches of one peer so the engine never waits on
+// the network
+type syncPeer struct {
+	peer Peer
+	wake chan struct{}
+	done chan struct{}
+
+	queueMu sync.Mutex // taken by engine watchers, under the engine lock
+	queue   []*axcp.Envelope
+
+	mu      sync.Mutex
+	watches map[string]func() // nil once stopped
+	filters map[string]*Filter
+}
+
+// pushPatch queues a patch for the peer, replying to traceID
+func (p *syncPeer) pushPatch(traceID string, patch *pb.ContextPatch, live bool) {
+	env := axcp.NewEnvelope(traceID, 0)
+	env.Payload = &pb.AxcpEnvelope_ContextPatch{ContextPatch: patch}
+	p.push(env, live)
+}
+
+// push queues an envelope for the peer. Live envelopes are dropped when
+// the queue is full; history replays are bounded by the history limit and
+// always queued.
+func (p *syncPeer) push(env *axcp.Envelope, live bool) {
+	p.queueMu.Lock()
+	if live && len(p.queue) >= SyncQueueSize {
+		p.queueMu.Unlock()
+		return
+	}
+	p.queue = append(p.queue, env)
+	p.queueMu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued envelopes until the peer is unsubscribed or a send
+// fails
+func (p *syncPeer) run(s *SyncServer) {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		}
+
+		for {
+			// Envelopes leave the queue one at a time, so it keeps counting
+			// everything the peer has yet to receive
+			p.queueMu.Lock()
+			if len(p.queue) == 0 {
+				p.queueMu.Unlock()
+				break
+			}
+			env := p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+			p.queueMu.Unlock()
+
+			if err := p.peer.SendEnvelope(env); err != nil {
+				s.Unsubscribe(p.peer)
+				return
+			}
+		}
+	}
+}
+
+// stop cancels the watches of the peer and ends its sender
+func (p *syncPeer) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, cancel := range p.watches {
+		cancel()
+	}
+	p.watches = nil
+	close(p.done)
+}
+
+// peer returns the queue of peer, starting it on first use
+func (s *SyncServer) peer(peer Peer) *syncPeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[peer]
+	if !ok {
+		p = &syncPeer{peer: peer, wake: make(chan struct{}, 1), done: make(chan struct{}),
+			watches: make(map[string]func()), filters: make(map[string]*Filter)}
+		s.peers[peer] = p
+		go p.run(s)
+	}
+	return p
+}
+
+// HandleEnvelope serves SyncSubscribe and SyncRequest envelopes from peer
+// and reports whether env was one of them. Refused requests are answered
+// with an ErrorMessage carrying the trace_id of the request; the error is
+// also returned.
+func (s *SyncServer) HandleEnvelope(peer Peer, env *axcp.Envelope) (bool, error) {
+	var err error
+	switch {
+	case env.GetSyncSub() != nil:
+		err = s.Subscribe(peer, env.GetTraceId(), env.GetSyncSub().GetFrom(), env.GetSyncSub().GetFilters()...)
+	case env.GetSyncReq() != nil:
+		err = s.Request(peer, env.GetTraceId(), env.GetSyncReq())
+	default:
+		return false, nil
+	}
+
+	if axErr, ok := err.(*axcp.Error); ok {
+		if sendErr := peer.SendEnvelope(axcp.NewErrorEnvelope(env.GetTraceId(), axErr)); sendErr != nil {
+			return true, sendErr
+		}
+	}
+	return true, err
+}
+
+// Subscribe streams the patches of a context to peer from version
+// from.version onwards, tagged with traceID and restricted by the filter
+// expressions (see Filter). A new subscription to the same context
+// replaces the previous one.
+func (s *SyncServer) Subscribe(peer Peer, traceID string, from *pb.ContextGraphVersion, filters ...string) error {
+	id := from.GetContextId()
+	if id == "" {
+		return axcp.NewError(pb.ErrorCode_INVALID_CONTEXT, "missing context_id")
+	}
+	filter, err := ParseFilter(filters)
+	if err != nil {
+		return err
+	}
+
+	p := s.peer(peer)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.watches == nil {
+		return ErrPeerGone
+	}
+	if cancel, ok := p.watches[id]; ok {
+		cancel()
+		delete(p.watches, id)
+	}
+	// The backlog is handed over before WatchChanges returns
+	var live atomic.Bool
+	cancel, err := s.engine.WatchChanges(id, from.GetVersion(),
+		func(patch *pb.ContextPatch) {
+			p.pushPatch(traceID, filter.Apply(patch), live.Load())
+		},
+		func(inv *pb.ContextInvalidation) {
+			if filter.MatchPath(inv.GetPath()) {
+				env := axcp.NewEnvelope(traceID, 0)
+				env.Payload = &pb.AxcpEnvelope_ContextInval{ContextInval: inv}
+				p.push(env, true)
+			}
+		})
+	if err != nil {
+		return err
+	}
+	live.Store(true)
+	p.watches[id] = cancel
+	p.filters[id] = filter
+	return nil
+}
+
+// Request sends peer the patches of the range asked by req, tagged with
+// traceID and filtered like the subscription of peer to the context. A
+// to_version of 0 asks for everything up to the current version.
+func (s *SyncServer) Request(peer Peer, traceID string, req *pb.SyncRequest) error {
+	from := req.GetMissingFrom()
+	patches, err := s.engine.Patches(from.GetContextId(), from.GetVersion(), req.GetToVersion())
+	if err != nil {
+		return err
+	}
+
+	p := s.peer(peer)
+	p.mu.Lock()
+	filter := p.filters[from.GetContextId()]
+	p.mu.Unlock()
+	for _, patch := range patches {
+		p.pushPatch(traceID, filter.Apply(patch), false)
+	}
+	return nil
+}
+
+// Unsubscribe drops every subscription of peer; call it when the session
+// ends
+func (s *SyncServer) Unsubscribe(peer Peer) {
+	s.mu.Lock()
+	p, ok := s.peers[peer]
+	delete(s.peers, peer)
+	s.mu.Unlock()
+
+	if ok {
+		p.stop()
+	}
+}
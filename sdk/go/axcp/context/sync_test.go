@@ -0,0 +1,237 @@
+package context
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// chanPeer collects the envelopes sent to it
+type chanPeer chan *axcp.Envelope
+
+func (c chanPeer) SendEnvelope(env *axcp.Envelope) error {
+	c <- env
+	return nil
+}
+
+func (c chanPeer) next(t *testing.T) *axcp.Envelope {
+	t.Helper()
+	select {
+	case env := <-c:
+		return env
+	case <-time.After(time.Second):
+		require.FailNow(t, "no envelope")
+		return nil
+	}
+}
+
+// serverWith returns an engine holding n patches of "ctx"
+func serverWith(t *testing.T, n int) *Engine {
+	e := NewEngine()
+	for i := 0; i < n; i++ {
+		_, err := e.Apply(patch("ctx", uint64(i), op(pb.DeltaOp_ADD, "/n", `1`)))
+		require.NoError(t, err)
+	}
+	return e
+}
+
+func TestEngineHistory(t *testing.T) {
+	e := serverWith(t, 5)
+
+	patches, err := e.Patches("ctx", 1, 3)
+	require.NoError(t, err)
+	require.Len(t, patches, 2)
+	assert.Equal(t, uint64(1), patches[0].GetBaseVersion())
+	assert.Equal(t, uint64(2), patches[1].GetBaseVersion())
+
+	patches, err = e.Patches("ctx", 5, 0)
+	require.NoError(t, err)
+	assert.Empty(t, patches)
+
+	_, err = e.Patches("ctx", 2, 6)
+	assert.Equal(t, pb.ErrorCode_INVALID_CONTEXT, axcp.ErrorCodeOf(err))
+
+	e.Compact("ctx", 3)
+	_, err = e.Patches("ctx", 2, 0)
+	assert.Equal(t, pb.ErrorCode_MISSING_PATCH_RANGE, axcp.ErrorCodeOf(err))
+	patches, err = e.Patches("ctx", 3, 0)
+	require.NoError(t, err)
+	assert.Len(t, patches, 2)
+
+	e.SetHistoryLimit(1)
+	_, err = e.Apply(patch("ctx", 5, op(pb.DeltaOp_ADD, "/n", `2`)))
+	require.NoError(t, err)
+	_, err = e.Patches("ctx", 4, 0)
+	assert.Equal(t, pb.ErrorCode_MISSING_PATCH_RANGE, axcp.ErrorCodeOf(err))
+}
+
+func TestSyncSubscribeStreamsBacklogAndLivePatches(t *testing.T) {
+	server := NewSyncServer(serverWith(t, 3))
+	follower := NewFollower(NewEngine())
+	up, down := make(chanPeer, 16), make(chanPeer, 16)
+
+	require.NoError(t, follower.Subscribe(up, "ctx"))
+	sub := up.next(t)
+	handled, err := server.HandleEnvelope(down, sub)
+	require.True(t, handled)
+	require.NoError(t, err)
+
+	_, err = server.engine.Apply(patch("ctx", 3, op(pb.DeltaOp_ADD, "/live", `true`)))
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		env := down.next(t)
+		assert.Equal(t, sub.GetTraceId(), env.GetTraceId())
+		handled, err := follower.HandleEnvelope(up, env)
+		require.True(t, handled)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, uint64(4), follower.Engine().Version("ctx"))
+	assert.JSONEq(t, `{"n":1,"live":true}`, docJSON(t, follower.Engine(), "ctx"))
+
+	server.Unsubscribe(down)
+	_, err = server.engine.Apply(patch("ctx", 4, op(pb.DeltaOp_ADD, "/n", `2`)))
+	require.NoError(t, err)
+	assert.Empty(t, down)
+}
+
+func TestFollowerRequestsGaps(t *testing.T) {
+	server := NewSyncServer(serverWith(t, 4))
+	follower := NewFollower(NewEngine())
+	up, down := make(chanPeer, 16), make(chanPeer, 16)
+
+	all, err := server.engine.Patches("ctx", 0, 0)
+	require.NoError(t, err)
+	deliver := func(p *pb.ContextPatch) {
+		env := axcp.NewEnvelope("t", 0)
+		env.Payload = &pb.AxcpEnvelope_ContextPatch{ContextPatch: p}
+		_, err := follower.HandleEnvelope(up, env)
+		require.NoError(t, err)
+	}
+
+	// Patches 0 and 1 are lost: the gap is requested once
+	deliver(all[2])
+	deliver(all[3])
+	req := up.next(t).GetSyncReq()
+	require.NotNil(t, req)
+	assert.Equal(t, "ctx", req.GetMissingFrom().GetContextId())
+	assert.Equal(t, uint64(0), req.GetMissingFrom().GetVersion())
+	assert.Equal(t, uint64(2), req.GetToVersion())
+	assert.Empty(t, up)
+	assert.Equal(t, uint64(0), follower.Engine().Version("ctx"))
+
+	env := axcp.NewEnvelope("gap", 0)
+	env.Payload = &pb.AxcpEnvelope_SyncReq{SyncReq: req}
+	_, err = server.HandleEnvelope(down, env)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := follower.HandleEnvelope(up, down.next(t))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, uint64(4), follower.Engine().Version("ctx"), "held back patches applied")
+
+	// Duplicates are dropped
+	deliver(all[1])
+	assert.Equal(t, uint64(4), follower.Engine().Version("ctx"))
+	assert.Empty(t, up)
+}
+
+func TestFollowerMissingPatchRange(t *testing.T) {
+	engine := serverWith(t, 4)
+	engine.Compact("ctx", 2)
+	server := NewSyncServer(engine)
+	follower := NewFollower(NewEngine())
+	up, down := make(chanPeer, 16), make(chanPeer, 16)
+
+	require.NoError(t, follower.Subscribe(up, "ctx"))
+	handled, err := server.HandleEnvelope(down, up.next(t))
+	require.True(t, handled)
+	assert.Equal(t, pb.ErrorCode_MISSING_PATCH_RANGE, axcp.ErrorCodeOf(err))
+
+	handled, err = follower.HandleEnvelope(up, down.next(t))
+	require.True(t, handled)
+	assert.Equal(t, pb.ErrorCode_MISSING_PATCH_RANGE, axcp.ErrorCodeOf(err))
+
+	// Errors answering someone else's request are not ours
+	handled, _ = follower.HandleEnvelope(up, axcp.NewErrorEnvelope("other", axcp.NewError(pb.ErrorCode_UNKNOWN, "")))
+	assert.False(t, handled)
+}
+
+func TestFollowerCatchesUpAfterReconnect(t *testing.T) {
+	server := NewSyncServer(serverWith(t, 2))
+	follower := NewFollower(NewEngine())
+
+	sync := func(down chanPeer, n int) {
+		up := make(chanPeer, 1)
+		require.NoError(t, follower.Subscribe(up, "ctx"))
+		_, err := server.HandleEnvelope(down, up.next(t))
+		require.NoError(t, err)
+		for i := 0; i < n; i++ {
+			_, err := follower.HandleEnvelope(up, down.next(t))
+			require.NoError(t, err)
+		}
+	}
+
+	first := make(chanPeer, 16)
+	sync(first, 2)
+	server.Unsubscribe(first)
+
+	// Written while the replica is offline
+	for v := uint64(2); v < 5; v++ {
+		_, err := server.engine.Apply(patch("ctx", v, op(pb.DeltaOp_ADD, "/n", `2`)))
+		require.NoError(t, err)
+	}
+
+	sync(make(chanPeer, 16), 3)
+	assert.Equal(t, uint64(5), follower.Engine().Version("ctx"))
+	assert.JSONEq(t, `{"n":2}`, docJSON(t, follower.Engine(), "ctx"))
+}
+
+func TestSyncServerBoundsSlowPeer(t *testing.T) {
+	server := NewSyncServer(serverWith(t, 0))
+	follower := NewFollower(NewEngine())
+	up, down := make(chanPeer, 16), make(chanPeer)
+
+	require.NoError(t, follower.Subscribe(up, "ctx"))
+	_, err := server.HandleEnvelope(down, up.next(t))
+	require.NoError(t, err)
+
+	// Nobody reads down: the queue stops growing at SyncQueueSize
+	n := uint64(SyncQueueSize + 10)
+	for v := uint64(0); v < n; v++ {
+		_, err := server.engine.Apply(patch("ctx", v, op(pb.DeltaOp_ADD, "/n", `1`)))
+		require.NoError(t, err)
+	}
+	p := server.peers[down]
+	p.queueMu.Lock()
+	assert.LessOrEqual(t, len(p.queue), SyncQueueSize)
+	p.queueMu.Unlock()
+
+	pump := func(until func() bool) {
+		for !until() {
+			select {
+			case env := <-down:
+				_, err := follower.HandleEnvelope(up, env)
+				require.NoError(t, err)
+			case env := <-up:
+				_, err := server.HandleEnvelope(down, env)
+				require.NoError(t, err)
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}
+	pump(func() bool { return false })
+	assert.Less(t, follower.Engine().Version("ctx"), n, "the last patches were dropped")
+
+	// The next patch reveals the gap, which the follower fills
+	_, err = server.engine.Apply(patch("ctx", n, op(pb.DeltaOp_ADD, "/n", `2`)))
+	require.NoError(t, err)
+	pump(func() bool { return follower.Engine().Version("ctx") == n+1 })
+	assert.Equal(t, n+1, follower.Engine().Version("ctx"))
+	assert.JSONEq(t, `{"n":2}`, docJSON(t, follower.Engine(), "ctx"))
+}
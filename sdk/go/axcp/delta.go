@@ -0,0 +1,161 @@
+package axcp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+// PayloadLimits bounds the decompression of DeltaOp.data, so a single
+// patch cannot exhaust the memory of the node applying it.
+type PayloadLimits struct {
+	// MaxCompressed is the largest accepted compressed payload in bytes
+	MaxCompressed int64
+	// MaxDecompressed is the largest accepted decompressed payload in bytes
+	MaxDecompressed int64
+	// MaxRatio is the largest accepted decompressed/compressed size ratio
+	MaxRatio int64
+}
+
+// DefaultPayloadLimits suits context segments, which the spec caps at 64 KiB
+var DefaultPayloadLimits = PayloadLimits{
+	MaxCompressed:   1 << 20,
+	MaxDecompressed: 4 << 20,
+	MaxRatio:        200,
+}
+
+// gzipMagic starts every gzip stream. JSON text never starts with it, so
+// uncompressed payloads from older peers are still recognised.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// CompressPayload gzips data for DeltaOp.data
+func CompressPayload(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress payload: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress payload: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecompressPayload returns the plain bytes of a DeltaOp.data payload.
+// Payloads without the gzip header are returned as they are. Payloads over
+// the limits fail with PAYLOAD_TOO_LARGE, corrupt ones with BAD_DELTA.
+func DecompressPayload(data []byte, limits PayloadLimits) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		if limits.MaxDecompressed > 0 && int64(len(data)) > limits.MaxDecompressed {
+			return nil, NewError(pb.ErrorCode_PAYLOAD_TOO_LARGE,
+				"payload of %d bytes exceeds %d", len(data), limits.MaxDecompressed)
+		}
+		return data, nil
+	}
+
+	r, err := NewPayloadReader(bytes.NewReader(data), limits)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// NewPayloadReader streams the decompression of a gzip payload read from r,
+// failing with PAYLOAD_TOO_LARGE as soon as a limit is crossed rather than
+// after inflating the whole payload.
+func NewPayloadReader(r io.Reader, limits PayloadLimits) (io.Reader, error) {
+	in := &countingReader{r: r, max: limits.MaxCompressed}
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, payloadError(err)
+	}
+	return &payloadReader{zr: zr, in: in, limits: limits}, nil
+}
+
+// countingReader counts the compressed bytes consumed
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+// errCompressedTooLarge marks the compressed limit inside the gzip reader
+var errCompressedTooLarge = errors.New("compressed payload too large")
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.max > 0 && c.n > c.max {
+		return n, errCompressedTooLarge
+	}
+	return n, err
+}
+
+// payloadReader checks the decompressed size and ratio while reading
+type payloadReader struct {
+	zr     *gzip.Reader
+	in     *countingReader
+	out    int64
+	limits PayloadLimits
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	n, err := p.zr.Read(b)
+	p.out += int64(n)
+
+	switch {
+	case p.limits.MaxDecompressed > 0 && p.out > p.limits.MaxDecompressed:
+		return 0, NewError(pb.ErrorCode_PAYLOAD_TOO_LARGE,
+			"decompressed payload exceeds %d bytes", p.limits.MaxDecompressed)
+	case p.limits.MaxRatio > 0 && p.out > p.limits.MaxRatio*max(p.in.n, 1):
+		return 0, NewError(pb.ErrorCode_PAYLOAD_TOO_LARGE,
+			"compression ratio exceeds %d:1", p.limits.MaxRatio)
+	}
+	if err != nil && err != io.EOF {
+		return n, payloadError(err)
+	}
+	return n, err
+}
+
+// payloadError maps a decompression failure to its AXCP error
+func payloadError(err error) error {
+	if errors.Is(err, errCompressedTooLarge) {
+		return NewError(pb.ErrorCode_PAYLOAD_TOO_LARGE, "%v", err)
+	}
+	return NewError(pb.ErrorCode_BAD_DELTA, "corrupt gzip payload: %v", err)
+}
+
+// NewDeltaOp builds an op whose data is value encoded as JSON and gzipped
+func NewDeltaOp(op pb.DeltaOp_OpType, path string, value any) (*pb.DeltaOp, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s %s: %w", op, path, err)
+	}
+	data, err := CompressPayload(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DeltaOp{Op: op, Path: path, Data: data}, nil
+}
+
+// NewRemoveOp builds a REMOVE op, which carries no data
+func NewRemoveOp(path string) *pb.DeltaOp {
+	return &pb.DeltaOp{Op: pb.DeltaOp_REMOVE, Path: path}
+}
+
+// DecodeDeltaOp decodes the data of op into v within DefaultPayloadLimits
+func DecodeDeltaOp(op *pb.DeltaOp, v any) error {
+	raw, err := DecompressPayload(op.GetData(), DefaultPayloadLimits)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return NewError(pb.ErrorCode_BAD_DELTA, "invalid JSON data: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package axcp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+func TestDeltaOpRoundTrip(t *testing.T) {
+	type battery struct {
+		Level int  `json:"level"`
+		Low   bool `json:"low"`
+	}
+	op, err := NewDeltaOp(pb.DeltaOp_REPLACE, "/agent/status/battery", battery{Level: 100})
+	require.NoError(t, err)
+	assert.Equal(t, gzipMagic, op.GetData()[:2])
+
+	var got battery
+	require.NoError(t, DecodeDeltaOp(op, &got))
+	assert.Equal(t, battery{Level: 100}, got)
+}
+
+func TestDecompressPayloadPlainJSON(t *testing.T) {
+	// The base64 "MTAw" of examples/context_patch_samples
+	got, err := DecompressPayload([]byte("100"), DefaultPayloadLimits)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("100"), got)
+}
+
+func TestDecompressPayloadLimits(t *testing.T) {
+	bomb, err := CompressPayload(make([]byte, 10<<20))
+	require.NoError(t, err)
+	text, err := CompressPayload(bytes.Repeat([]byte(`{"k":"some value"}`), 100))
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		data   []byte
+		limits PayloadLimits
+	}{
+		"ratio":        {bomb, PayloadLimits{MaxRatio: 100}},
+		"decompressed": {text, PayloadLimits{MaxDecompressed: 1000}},
+		"compressed":   {bomb, PayloadLimits{MaxCompressed: 1000}},
+		"plain":        {bytes.Repeat([]byte("1"), 100), PayloadLimits{MaxDecompressed: 10}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := DecompressPayload(tt.data, tt.limits)
+			assert.Equal(t, pb.ErrorCode_PAYLOAD_TOO_LARGE, ErrorCodeOf(err))
+		})
+	}
+
+	got, err := DecompressPayload(text, DefaultPayloadLimits)
+	require.NoError(t, err)
+	assert.Len(t, got, 1800)
+}
+
+func TestPayloadReaderStopsEarly(t *testing.T) {
+	bomb, err := CompressPayload(make([]byte, 10<<20))
+	require.NoError(t, err)
+
+	r, err := NewPayloadReader(bytes.NewReader(bomb), PayloadLimits{MaxDecompressed: 64 << 10})
+	require.NoError(t, err)
+	n, err := io.Copy(io.Discard, r)
+	assert.Equal(t, pb.ErrorCode_PAYLOAD_TOO_LARGE, ErrorCodeOf(err))
+	assert.LessOrEqual(t, n, int64(64<<10))
+}
+
+func TestDecompressPayloadCorrupt(t *testing.T) {
+	data, err := CompressPayload([]byte(`{"a":1}`))
+	require.NoError(t, err)
+
+	_, err = DecompressPayload(data[:len(data)-4], DefaultPayloadLimits)
+	assert.Equal(t, pb.ErrorCode_BAD_DELTA, ErrorCodeOf(err))
+	_, err = DecompressPayload([]byte{0x1f, 0x8b, 0x00}, DefaultPayloadLimits)
+	assert.Equal(t, pb.ErrorCode_BAD_DELTA, ErrorCodeOf(err))
+}
@@ -0,0 +1,226 @@
+package axcp
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+// Page sizes of a CapabilityCatalog
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// CompareVersions compares two descriptor versions, returning -1, 0 or +1.
+// Versions are dotted numbers with an optional "v" prefix, "-prerelease"
+// and "+build" suffix, as in semver: missing components count as 0, a
+// prerelease precedes its release, prereleases compare by identifier and
+// build metadata is ignored.
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < max(len(va.nums), len(vb.nums)); i++ {
+		var x, y uint64
+		if i < len(va.nums) {
+			x = va.nums[i]
+		}
+		if i < len(vb.nums) {
+			y = vb.nums[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case va.pre == vb.pre:
+		return 0, nil
+	case va.pre == "":
+		return 1, nil
+	case vb.pre == "":
+		return -1, nil
+	}
+	return comparePrerelease(va.pre, vb.pre), nil
+}
+
+// comparePrerelease compares two prereleases identifier by identifier, as
+// semver §11: numeric identifiers compare numerically and precede
+// alphanumeric ones, which compare in ASCII order, and a prefix of more
+// identifiers precedes them.
+func comparePrerelease(a, b string) int {
+	x, y := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < min(len(x), len(y)); i++ {
+		if c := compareIdentifier(x[i], y[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(x), len(y))
+}
+
+// compareIdentifier compares two prerelease identifiers
+func compareIdentifier(a, b string) int {
+	numA, numB := numeric(a), numeric(b)
+	switch {
+	case numA && numB:
+		// By length first, so numbers of any size compare without parsing
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if c := cmp.Compare(len(a), len(b)); c != 0 {
+			return c
+		}
+	case numA:
+		return -1
+	case numB:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// numeric reports whether the identifier s only has digits
+func numeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// version is a parsed descriptor_version
+type version struct {
+	nums []uint64
+	pre  string
+}
+
+func parseVersion(s string) (version, error) {
+	core := strings.TrimPrefix(s, "v")
+	core, _, _ = strings.Cut(core, "+")
+	core, pre, _ := strings.Cut(core, "-")
+	var v version
+	for _, part := range strings.Split(core, ".") {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return version{}, NewError(pb.ErrorCode_MALFORMED_REQUEST, "invalid version %q", s)
+		}
+		v.nums = append(v.nums, n)
+	}
+	v.pre = pre
+	return v, nil
+}
+
+// CheckQuery validates the bounds of q, failing with MALFORMED_REQUEST
+func CheckQuery(q *CapabilityQuery) error {
+	for _, bound := range []string{q.GetVersionMin(), q.GetVersionMax()} {
+		if bound == "" {
+			continue
+		}
+		if _, err := parseVersion(bound); err != nil {
+			return err
+		}
+	}
+	if q.GetVersionMin() != "" && q.GetVersionMax() != "" {
+		if c, _ := CompareVersions(q.GetVersionMin(), q.GetVersionMax()); c > 0 {
+			return NewError(pb.ErrorCode_MALFORMED_REQUEST, "version_min %s above version_max %s", q.GetVersionMin(), q.GetVersionMax())
+		}
+	}
+	if q.GetMaxEpsilon() < 0 || q.GetMaxDelta() < 0 {
+		return NewError(pb.ErrorCode_MALFORMED_REQUEST, "negative dp bound")
+	}
+	return nil
+}
+
+// MatchCapability reports whether desc satisfies every filter of q, which
+// must have passed CheckQuery. A descriptor whose version cannot be parsed
+// matches no version bound; one without dp params matches no dp filter.
+func MatchCapability(q *CapabilityQuery, desc *Capability) bool {
+	if q.GetResourceHint() != "" && q.GetResourceHint() != desc.GetResourceHint() {
+		return false
+	}
+	for _, scope := range q.GetAuthScope() {
+		if !slices.Contains(desc.GetAuthScope(), scope) {
+			return false
+		}
+	}
+	if q.GetVersionMin() != "" {
+		if c, err := CompareVersions(desc.GetDescriptorVersion(), q.GetVersionMin()); err != nil || c < 0 {
+			return false
+		}
+	}
+	if q.GetVersionMax() != "" {
+		if c, err := CompareVersions(desc.GetDescriptorVersion(), q.GetVersionMax()); err != nil || c >= 0 {
+			return false
+		}
+	}
+
+	dpFiltered := q.GetDpRequired() || q.GetMaxEpsilon() > 0 || q.GetMaxDelta() > 0 || len(q.GetDpMech()) > 0
+	if !dpFiltered {
+		return true
+	}
+	dp := desc.GetDp()
+	switch {
+	case dp == nil:
+		return false
+	case q.GetMaxEpsilon() > 0 && dp.GetEpsilon() > q.GetMaxEpsilon():
+		return false
+	case q.GetMaxDelta() > 0 && dp.GetDelta() > q.GetMaxDelta():
+		return false
+	case len(q.GetDpMech()) > 0 && !slices.Contains(q.GetDpMech(), dp.GetMech()):
+		return false
+	}
+	return true
+}
+
+// QueryCatalog returns the page of catalog selected by q: the matching
+// descriptors ordered by tool_id, following page_token. The token is the
+// last tool_id of the previous page, so a catalog changing between pages
+// neither repeats nor skips the tools that stay.
+func QueryCatalog(catalog []*Capability, q *CapabilityQuery) (*CapabilityCatalog, error) {
+	if err := CheckQuery(q); err != nil {
+		return nil, err
+	}
+	size := int(q.GetPageSize())
+	switch {
+	case size == 0:
+		size = DefaultPageSize
+	case size > MaxPageSize:
+		size = MaxPageSize
+	}
+
+	var matched []*Capability
+	for _, desc := range catalog {
+		if desc.GetToolId() > q.GetPageToken() && MatchCapability(q, desc) {
+			matched = append(matched, desc)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].GetToolId() < matched[j].GetToolId() })
+
+	page := &CapabilityCatalog{}
+	if len(matched) > size {
+		matched = matched[:size]
+		page.NextPageToken = matched[size-1].GetToolId()
+	}
+	page.Tools = matched
+	return page, nil
+}
+
+// NewQueryEnvelope returns a discovery query, answered by a
+// CapabilityCatalog or an ErrorMessage with the same trace_id
+func NewQueryEnvelope(traceID string, q *CapabilityQuery) *Envelope {
+	env := NewEnvelope(traceID, 0)
+	env.Payload = &pb.AxcpEnvelope_CapabilityMsg{CapabilityMsg: &pb.CapabilityMessage{
+		Kind: &pb.CapabilityMessage_Query{Query: q},
+	}}
+	return env
+}
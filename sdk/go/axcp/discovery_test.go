@@ -0,0 +1,79 @@
+package axcp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.2", 0},
+		{"v1.10.0", "1.9.9", 1},
+		{"2.0.0-rc1", "2.0.0", -1},
+		{"2.0.0-rc1", "2.0.0-rc2", -1},
+		{"1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.01", 0},
+		{"1.0.0+build7", "1.0.0", 0},
+	} {
+		got, err := CompareVersions(tc.a, tc.b)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got, "%s vs %s", tc.a, tc.b)
+	}
+	_, err := CompareVersions("1.x", "1.0")
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, ErrorCodeOf(err))
+}
+
+func TestQueryCatalog(t *testing.T) {
+	catalog := []*Capability{
+		{ToolId: "translate", ResourceHint: "low-latency", DescriptorVersion: "1.4.0"},
+		{ToolId: "search", ResourceHint: "low-latency", DescriptorVersion: "2.1.0", AuthScope: []string{"web", "read"}},
+		{ToolId: "summarize", ResourceHint: "secure-env", DescriptorVersion: "1.0.0",
+			Dp: &pb.DpParams{Epsilon: 0.5, Mech: pb.DpMechanism_GAUSSIAN}},
+		{ToolId: "stats", ResourceHint: "secure-env", DescriptorVersion: "dev",
+			Dp: &pb.DpParams{Epsilon: 2, Mech: pb.DpMechanism_LAPLACE}},
+	}
+	ids := func(q *CapabilityQuery) []string {
+		t.Helper()
+		page, err := QueryCatalog(catalog, q)
+		require.NoError(t, err)
+		var out []string
+		for _, desc := range page.GetTools() {
+			out = append(out, desc.GetToolId())
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{"search", "stats", "summarize", "translate"}, ids(&CapabilityQuery{}))
+	assert.Equal(t, []string{"search", "translate"}, ids(&CapabilityQuery{ResourceHint: "low-latency"}))
+	assert.Equal(t, []string{"search"}, ids(&CapabilityQuery{AuthScope: []string{"read"}}))
+	assert.Empty(t, ids(&CapabilityQuery{AuthScope: []string{"read", "write"}}))
+	assert.Equal(t, []string{"summarize", "translate"}, ids(&CapabilityQuery{VersionMin: "1.0", VersionMax: "2"}))
+	assert.Equal(t, []string{"stats", "summarize"}, ids(&CapabilityQuery{DpRequired: true}))
+	assert.Equal(t, []string{"summarize"}, ids(&CapabilityQuery{MaxEpsilon: 1}))
+	assert.Equal(t, []string{"stats"}, ids(&CapabilityQuery{DpMech: []pb.DpMechanism{pb.DpMechanism_LAPLACE}}))
+
+	// Pages follow each other by tool_id
+	page, err := QueryCatalog(catalog, &CapabilityQuery{PageSize: 3})
+	require.NoError(t, err)
+	assert.Len(t, page.GetTools(), 3)
+	assert.Equal(t, "summarize", page.GetNextPageToken())
+	page, err = QueryCatalog(catalog, &CapabilityQuery{PageSize: 3, PageToken: page.GetNextPageToken()})
+	require.NoError(t, err)
+	require.Len(t, page.GetTools(), 1)
+	assert.Equal(t, "translate", page.GetTools()[0].GetToolId())
+	assert.Empty(t, page.GetNextPageToken())
+
+	_, err = QueryCatalog(catalog, &CapabilityQuery{VersionMin: "2", VersionMax: "1"})
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, ErrorCodeOf(err))
+	_, err = QueryCatalog(catalog, &CapabilityQuery{VersionMax: "latest"})
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, ErrorCodeOf(err))
+}
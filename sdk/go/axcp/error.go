@@ -0,0 +1,63 @@
+package axcp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+// Error is a protocol-level failure carrying an AXCP ErrorCode.
+// It converts to and from the ErrorMessage exchanged on the wire.
+type Error struct {
+	Code        pb.ErrorCode
+	Reason      string
+	Diagnostics []byte
+}
+
+// NewError returns an Error with a formatted reason
+func NewError(code pb.ErrorCode, format string, args ...any) *Error {
+	return &Error{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("axcp: %s", e.Code)
+	}
+	return fmt.Sprintf("axcp: %s: %s", e.Code, e.Reason)
+}
+
+// Message converts the error into its wire representation
+func (e *Error) Message() *pb.ErrorMessage {
+	return &pb.ErrorMessage{
+		Code:        uint32(e.Code),
+		Reason:      e.Reason,
+		Diagnostics: e.Diagnostics,
+	}
+}
+
+// ErrorFromMessage converts a received ErrorMessage into an Error
+func ErrorFromMessage(m *pb.ErrorMessage) *Error {
+	return &Error{
+		Code:        pb.ErrorCode(m.GetCode()),
+		Reason:      m.GetReason(),
+		Diagnostics: m.GetDiagnostics(),
+	}
+}
+
+// ErrorCodeOf returns the AXCP code carried by err, or UNKNOWN if err is not
+// (and does not wrap) an *Error.
+func ErrorCodeOf(err error) pb.ErrorCode {
+	var axErr *Error
+	if errors.As(err, &axErr) {
+		return axErr.Code
+	}
+	return pb.ErrorCode_UNKNOWN
+}
+
+// NewErrorEnvelope wraps err in an envelope replying to traceID
+func NewErrorEnvelope(traceID string, err *Error) *Envelope {
+	env := NewEnvelope(traceID, 0)
+	env.Payload = &pb.AxcpEnvelope_Error{Error: err.Message()}
+	return env
+}
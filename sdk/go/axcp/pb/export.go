@@ -10,6 +10,7 @@ type (
 	// Core envelope and message types
 	AxcpEnvelope         = internal.AxcpEnvelope
 	TelemetryDatagram    = internal.TelemetryDatagram
+	TelemetryBatch       = internal.TelemetryBatch
 	SystemStats          = internal.SystemStats
 	TokenUsage           = internal.TokenUsage
 	
@@ -19,11 +20,26 @@ type (
 	CapabilityRequest    = internal.CapabilityRequest
 	CapabilityAck        = internal.CapabilityAck
 	CapabilityMessage    = internal.CapabilityMessage
+	CapabilityQuery      = internal.CapabilityQuery
+	CapabilityCatalog    = internal.CapabilityCatalog
+	CapabilityBundle     = internal.CapabilityBundle
+	KeyEndorsement       = internal.KeyEndorsement
+	SignedBundle         = internal.SignedBundle
+	ToolInvoke           = internal.ToolInvoke
+	ToolResult           = internal.ToolResult
+	ToolProgress         = internal.ToolProgress
 	
 	// Context and patch types
 	ContextPatch         = internal.ContextPatch
 	DeltaOp              = internal.DeltaOp
+	DeltaOp_OpType       = internal.DeltaOp_OpType
 	RetryEnvelope        = internal.RetryEnvelope
+	ContextGraphVersion  = internal.ContextGraphVersion
+	ContextSnapshot      = internal.ContextSnapshot
+	ContextInvalidation  = internal.ContextInvalidation
+	ContextInvalidation_Reason = internal.ContextInvalidation_Reason
+	SyncSubscribe        = internal.SyncSubscribe
+	SyncRequest          = internal.SyncRequest
 	
 	// Profile and routing types
 	ProfileNegotiate     = internal.ProfileNegotiate
@@ -56,6 +72,16 @@ const (
 	ErrorCode_PROFILE_NEGOTIATION_FAILED  = internal.ErrorCode_PROFILE_NEGOTIATION_FAILED
 	ErrorCode_MISSING_PATCH_RANGE         = internal.ErrorCode_MISSING_PATCH_RANGE
 	ErrorCode_DP_POLICY_CONFLICT          = internal.ErrorCode_DP_POLICY_CONFLICT
+	ErrorCode_MERGE_CONFLICT              = internal.ErrorCode_MERGE_CONFLICT
+	
+	DeltaOp_ADD                           = internal.DeltaOp_ADD
+	DeltaOp_REPLACE                       = internal.DeltaOp_REPLACE
+	DeltaOp_REMOVE                        = internal.DeltaOp_REMOVE
+	DeltaOp_MERGE                         = internal.DeltaOp_MERGE
+	
+	ContextInvalidation_REMOVED           = internal.ContextInvalidation_REMOVED
+	ContextInvalidation_EXPIRED           = internal.ContextInvalidation_EXPIRED
+	ContextInvalidation_REVOKED           = internal.ContextInvalidation_REVOKED
 	
 	DpMechanism_LAPLACE                   = internal.DpMechanism_LAPLACE
 	DpMechanism_GAUSSIAN                  = internal.DpMechanism_GAUSSIAN
@@ -71,6 +97,12 @@ type (
 	AxcpEnvelope_ProfileAck     = internal.AxcpEnvelope_ProfileAck
 	AxcpEnvelope_RetryEnv       = internal.AxcpEnvelope_RetryEnv
 	AxcpEnvelope_Telemetry      = internal.AxcpEnvelope_Telemetry
+	AxcpEnvelope_SyncSub        = internal.AxcpEnvelope_SyncSub
+	AxcpEnvelope_SyncReq        = internal.AxcpEnvelope_SyncReq
+	AxcpEnvelope_ContextInval   = internal.AxcpEnvelope_ContextInval
+	AxcpEnvelope_ToolInvoke     = internal.AxcpEnvelope_ToolInvoke
+	AxcpEnvelope_ToolResult     = internal.AxcpEnvelope_ToolResult
+	AxcpEnvelope_ToolProgress   = internal.AxcpEnvelope_ToolProgress
 )
 
 // Re-export oneof wrapper types for TelemetryDatagram
@@ -84,4 +116,6 @@ type (
 	CapabilityMessage_Offer   = internal.CapabilityMessage_Offer
 	CapabilityMessage_Request = internal.CapabilityMessage_Request
 	CapabilityMessage_Ack     = internal.CapabilityMessage_Ack
+	CapabilityMessage_Query   = internal.CapabilityMessage_Query
+	CapabilityMessage_Catalog = internal.CapabilityMessage_Catalog
 )
\ No newline at end of file
@@ -0,0 +1,64 @@
+package axcp
+
+import (
+	"math/bits"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+const (
+	// MaxProfile is the highest profile defined by the spec (Enterprise-Privacy)
+	MaxProfile = 3
+	// AllProfiles is the supported mask of a node accepting Profile-0 … Profile-3
+	AllProfiles = 1<<(MaxProfile+1) - 1
+)
+
+// ProfileMask returns the supported_mask bitmask for the given profiles
+func ProfileMask(profiles ...uint32) uint32 {
+	var mask uint32
+	for _, p := range profiles {
+		mask |= 1 << p
+	}
+	return mask
+}
+
+// NewProfileNegotiate builds the handshake offer of the local node
+func NewProfileNegotiate(supportedMask, minRequired uint32) *pb.ProfileNegotiate {
+	return &pb.ProfileNegotiate{
+		SupportedMask: supportedMask,
+		MinRequired:   minRequired,
+	}
+}
+
+// NegotiateProfile implements the agreement algorithm of spec v0.2 §5.7.2:
+// the session profile is the highest profile supported by both peers, and
+// it must satisfy the stricter of the two minimums. The result does not
+// depend on which side is local, so both peers reach the same answer.
+func NegotiateProfile(local, remote *pb.ProfileNegotiate) (uint32, error) {
+	intersection := local.GetSupportedMask() & remote.GetSupportedMask()
+	required := max(local.GetMinRequired(), remote.GetMinRequired())
+
+	if intersection == 0 {
+		return 0, NewError(pb.ErrorCode_PROFILE_NEGOTIATION_FAILED,
+			"no common profile (local mask %#b, remote mask %#b)",
+			local.GetSupportedMask(), remote.GetSupportedMask())
+	}
+
+	highest := uint32(bits.Len32(intersection) - 1)
+	if highest < required {
+		return 0, NewError(pb.ErrorCode_PROFILE_NEGOTIATION_FAILED,
+			"highest common profile %d is below required profile %d", highest, required)
+	}
+	return highest, nil
+}
+
+// CheckProfile verifies that env does not claim a profile higher than the
+// negotiated session profile (spec v0.2 §5.6, rule 3).
+func CheckProfile(env *Envelope, sessionProfile uint32) error {
+	if env.GetProfile() > sessionProfile {
+		return NewError(pb.ErrorCode_PROFILE_MISMATCH,
+			"envelope %q claims profile %d above session profile %d",
+			env.GetTraceId(), env.GetProfile(), sessionProfile)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package axcp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+func TestNegotiateProfile(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  *pb.ProfileNegotiate
+		remote *pb.ProfileNegotiate
+		want   uint32
+		fail   bool
+	}{
+		{"highest common profile", NewProfileNegotiate(0b1111, 1), NewProfileNegotiate(0b1011, 0), 3, false},
+		{"partial overlap", NewProfileNegotiate(0b0111, 1), NewProfileNegotiate(0b1011, 0), 1, false},
+		{"no common profile", NewProfileNegotiate(0b0001, 0), NewProfileNegotiate(0b0100, 0), 0, true},
+		{"minimum not satisfied", NewProfileNegotiate(0b0011, 2), NewProfileNegotiate(0b0110, 1), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NegotiateProfile(tt.local, tt.remote)
+			if tt.fail {
+				require.Error(t, err)
+				assert.Equal(t, pb.ErrorCode_PROFILE_NEGOTIATION_FAILED, ErrorCodeOf(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			// Both peers must reach the same result
+			reverse, err := NegotiateProfile(tt.remote, tt.local)
+			require.NoError(t, err)
+			assert.Equal(t, got, reverse)
+		})
+	}
+}
+
+func TestProfileMask(t *testing.T) {
+	assert.Equal(t, uint32(0b1011), ProfileMask(0, 1, 3))
+	assert.Equal(t, uint32(AllProfiles), ProfileMask(0, 1, 2, 3))
+}
+
+func TestCheckProfile(t *testing.T) {
+	assert.NoError(t, CheckProfile(NewEnvelope("ok", 2), 2))
+
+	err := CheckProfile(NewEnvelope("too-high", 3), 2)
+	require.Error(t, err)
+	assert.Equal(t, pb.ErrorCode_PROFILE_MISMATCH, ErrorCodeOf(err))
+}
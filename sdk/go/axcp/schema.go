@@ -0,0 +1,156 @@
+package axcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+// Violation is one failed check listed in the diagnostics of a
+// MALFORMED_REQUEST
+type Violation struct {
+	// Path is the JSON Pointer of the offending value within the validated
+	// document, or the descriptor field holding an invalid schema
+	Path string `json:"path"`
+	// Keyword is the schema location of the failed keyword, if any
+	Keyword string `json:"keyword,omitempty"`
+	Message string `json:"message"`
+}
+
+// Diagnostics is the JSON carried in ErrorMessage.diagnostics when a
+// schema rejects a document
+type Diagnostics struct {
+	Violations []Violation `json:"violations"`
+}
+
+// DiagnosticsOf decodes the diagnostics carried by err, if any
+func DiagnosticsOf(err error) (*Diagnostics, bool) {
+	var axErr *Error
+	if !errors.As(err, &axErr) || len(axErr.Diagnostics) == 0 {
+		return nil, false
+	}
+	var d Diagnostics
+	if json.Unmarshal(axErr.Diagnostics, &d) != nil {
+		return nil, false
+	}
+	return &d, true
+}
+
+// malformed returns a MALFORMED_REQUEST carrying violations as diagnostics
+func malformed(reason string, violations []Violation) *Error {
+	err := NewError(pb.ErrorCode_MALFORMED_REQUEST, "%s", reason)
+	err.Diagnostics, _ = json.Marshal(Diagnostics{Violations: violations})
+	return err
+}
+
+// ToolSchemas holds the compiled input and output schemas of a
+// CapabilityDescriptor (spec v0.2 §7.2). An empty schema accepts any
+// document.
+type ToolSchemas struct {
+	ToolID string
+	input  *jsonschema.Schema
+	output *jsonschema.Schema
+}
+
+// CompileCapability compiles the schemas of desc. An invalid schema fails
+// with MALFORMED_REQUEST naming the descriptor field in its diagnostics.
+// Schemas are self-contained: a $ref can only point inside the schema.
+func CompileCapability(desc *Capability) (*ToolSchemas, error) {
+	s := &ToolSchemas{ToolID: desc.GetToolId()}
+	var violations []Violation
+	var err error
+	if s.input, err = compileSchema(desc.GetInputSchema()); err != nil {
+		violations = append(violations, Violation{Path: "/input_schema", Message: err.Error()})
+	}
+	if s.output, err = compileSchema(desc.GetOutputSchema()); err != nil {
+		violations = append(violations, Violation{Path: "/output_schema", Message: err.Error()})
+	}
+	if len(violations) > 0 {
+		return nil, malformed(fmt.Sprintf("invalid schema for tool %q", desc.GetToolId()), violations)
+	}
+	return s, nil
+}
+
+// noLoader refuses every schema reference outside the compiled schema
+type noLoader struct{}
+
+func (noLoader) Load(url string) (any, error) {
+	return nil, fmt.Errorf("external schema %s not allowed", url)
+}
+
+// compileSchema compiles a schema, nil for an empty one
+func compileSchema(src string) (*jsonschema.Schema, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, nil
+	}
+	doc, err := jsonschema.UnmarshalJSON(strings.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	const url = "axcp:schema.json"
+	c := jsonschema.NewCompiler()
+	c.UseLoader(noLoader{})
+	if err := c.AddResource(url, doc); err != nil {
+		return nil, err
+	}
+	return c.Compile(url)
+}
+
+// ValidateInput checks the invocation arguments of the tool
+func (s *ToolSchemas) ValidateInput(data []byte) error {
+	return validate(s.input, data, fmt.Sprintf("invalid input for tool %q", s.ToolID))
+}
+
+// ValidateOutput checks a result of the tool
+func (s *ToolSchemas) ValidateOutput(data []byte) error {
+	return validate(s.output, data, fmt.Sprintf("invalid output of tool %q", s.ToolID))
+}
+
+// validate checks data against sch, failing with MALFORMED_REQUEST and a
+// violation for each failed keyword
+func validate(sch *jsonschema.Schema, data []byte, reason string) error {
+	if sch == nil {
+		return nil
+	}
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return malformed(reason, []Violation{{Path: "", Message: "invalid JSON: " + err.Error()}})
+	}
+
+	err = sch.Validate(doc)
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+	var violations []Violation
+	for _, unit := range verr.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		violations = append(violations, Violation{
+			Path:    unit.InstanceLocation,
+			Keyword: unit.KeywordLocation,
+			Message: unit.Error.String(),
+		})
+	}
+	return malformed(reason, violations)
+}
+
+// NewOfferEnvelope returns a CapabilityOffer of desc, after checking that
+// its schemas compile
+func NewOfferEnvelope(traceID string, desc *Capability) (*Envelope, error) {
+	if _, err := CompileCapability(desc); err != nil {
+		return nil, err
+	}
+	env := NewEnvelope(traceID, 0)
+	env.Payload = &pb.AxcpEnvelope_CapabilityMsg{CapabilityMsg: &pb.CapabilityMessage{
+		Kind: &pb.CapabilityMessage_Offer{Offer: &pb.CapabilityOffer{Desc: desc}},
+	}}
+	return env, nil
+}
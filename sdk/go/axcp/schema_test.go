@@ -0,0 +1,62 @@
+package axcp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/internal/pb"
+)
+
+const searchInput = `{
+	"type": "object",
+	"properties": {
+		"query": {"type": "string", "minLength": 1},
+		"limit": {"type": "integer", "maximum": 50}
+	},
+	"required": ["query"]
+}`
+
+func TestCompileCapability(t *testing.T) {
+	s, err := CompileCapability(&Capability{ToolId: "search", InputSchema: searchInput})
+	require.NoError(t, err)
+	assert.NoError(t, s.ValidateInput([]byte(`{"query":"go","limit":10}`)))
+	assert.NoError(t, s.ValidateOutput([]byte(`["anything"]`)), "no output schema")
+
+	_, err = CompileCapability(&Capability{ToolId: "bad", InputSchema: `{"type":"strin"}`, OutputSchema: `{`})
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, ErrorCodeOf(err))
+	diag, ok := DiagnosticsOf(err)
+	require.True(t, ok)
+	require.Len(t, diag.Violations, 2)
+	assert.Equal(t, "/input_schema", diag.Violations[0].Path)
+	assert.Equal(t, "/output_schema", diag.Violations[1].Path)
+
+	_, err = CompileCapability(&Capability{ToolId: "remote", InputSchema: `{"$ref":"https://example.com/s.json"}`})
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, ErrorCodeOf(err), "external references are refused")
+}
+
+func TestValidateInputDiagnostics(t *testing.T) {
+	s, err := CompileCapability(&Capability{ToolId: "search", InputSchema: searchInput})
+	require.NoError(t, err)
+
+	err = s.ValidateInput([]byte(`{"query":"","limit":"ten"}`))
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, ErrorCodeOf(err))
+	diag, ok := DiagnosticsOf(err)
+	require.True(t, ok)
+	var paths []string
+	for _, v := range diag.Violations {
+		paths = append(paths, v.Path)
+		assert.NotEmpty(t, v.Message)
+	}
+	assert.ElementsMatch(t, []string{"/query", "/limit"}, paths)
+
+	err = s.ValidateInput([]byte(`{"limit":1}`))
+	diag, ok = DiagnosticsOf(err)
+	require.True(t, ok)
+	require.Len(t, diag.Violations, 1)
+	assert.Equal(t, "", diag.Violations[0].Path)
+	assert.Contains(t, diag.Violations[0].Message, "query")
+
+	err = s.ValidateInput([]byte(`{`))
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, ErrorCodeOf(err))
+}
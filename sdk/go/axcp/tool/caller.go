@@ -0,0 +1,192 @@
+// Package tool invokes the tools offered over AXCP (spec v0.2 §7.3). A
+// Caller sends ToolInvoke messages and waits for their ToolResult; a
+// Provider offers tools and runs the invocations it receives. The gateway
+// routes each invocation to the agent offering the tool, and a Caller can
+// search its catalog with Discover.
+package tool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Peer is the other end of a session. netquic.Conn and
+// netquic.ResilientClient satisfy it.
+type Peer interface {
+	SendEnvelope(env *axcp.Envelope) error
+}
+
+// Caller invokes remote tools through peer. Feed it the envelopes received
+// from peer with HandleEnvelope. It is safe for concurrent use.
+type Caller struct {
+	peer Peer
+
+	mu      sync.Mutex
+	calls   map[string]*call               // by call_id
+	queries map[string]chan *axcp.Envelope // by trace_id
+}
+
+// call is an invocation waiting for its result
+type call struct {
+	result   chan *pb.ToolResult
+	progress func(*pb.ToolProgress)
+}
+
+// NewCaller returns a caller sending invocations to peer
+func NewCaller(peer Peer) *Caller {
+	return &Caller{peer: peer, calls: make(map[string]*call), queries: make(map[string]chan *axcp.Envelope)}
+}
+
+// Call invokes toolID with args encoded as JSON and returns its output. The
+// deadline of ctx, if any, is sent as timeout_ms; otherwise the timeout of
+// the descriptor applies. A failed call returns the *axcp.Error of its
+// result, TIMEOUT when the deadline expired remotely.
+func (c *Caller) Call(ctx context.Context, toolID string, args any) (json.RawMessage, error) {
+	return c.CallWithProgress(ctx, toolID, args, nil)
+}
+
+// CallWithProgress is Call with fn called for each ToolProgress received
+// before the result
+func (c *Caller) CallWithProgress(ctx context.Context, toolID string, args any, fn func(*pb.ToolProgress)) (json.RawMessage, error) {
+	arguments, err := json.Marshal(args)
+	if err != nil {
+		return nil, axcp.NewError(pb.ErrorCode_MALFORMED_REQUEST, "arguments of %q: %v", toolID, err)
+	}
+	invoke := &pb.ToolInvoke{CallId: newCallID(), ToolId: toolID, Arguments: arguments}
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, ctx.Err()
+		}
+		invoke.TimeoutMs = uint32((left + time.Millisecond - 1) / time.Millisecond)
+	}
+
+	pending := &call{result: make(chan *pb.ToolResult, 1), progress: fn}
+	c.mu.Lock()
+	c.calls[invoke.CallId] = pending
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, invoke.CallId)
+		c.mu.Unlock()
+	}()
+
+	env := axcp.NewEnvelope(invoke.CallId, 0)
+	env.Payload = &pb.AxcpEnvelope_ToolInvoke{ToolInvoke: invoke}
+	if err := c.peer.SendEnvelope(env); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-pending.result:
+		if res.GetError() != nil {
+			return nil, axcp.ErrorFromMessage(res.GetError())
+		}
+		return json.RawMessage(res.GetOutput()), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Discover returns one page of the catalog of peer matching q. Pass its
+// next_page_token as the page_token of q for the following page.
+func (c *Caller) Discover(ctx context.Context, q *axcp.CapabilityQuery) (*axcp.CapabilityCatalog, error) {
+	if err := axcp.CheckQuery(q); err != nil {
+		return nil, err
+	}
+	env := axcp.NewQueryEnvelope(newCallID(), q)
+	reply := make(chan *axcp.Envelope, 1)
+	c.mu.Lock()
+	c.queries[env.GetTraceId()] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.queries, env.GetTraceId())
+		c.mu.Unlock()
+	}()
+
+	if err := c.peer.SendEnvelope(env); err != nil {
+		return nil, err
+	}
+	select {
+	case res := <-reply:
+		if res.GetError() != nil {
+			return nil, axcp.ErrorFromMessage(res.GetError())
+		}
+		return res.GetCapabilityMsg().GetCatalog(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// DiscoverAll returns every descriptor of the catalog of peer matching q,
+// walking through its pages from the page_token of q
+func (c *Caller) DiscoverAll(ctx context.Context, q *axcp.CapabilityQuery) ([]*axcp.Capability, error) {
+	q = proto.Clone(q).(*axcp.CapabilityQuery)
+	var tools []*axcp.Capability
+	for {
+		page, err := c.Discover(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		tools = append(tools, page.GetTools()...)
+		if page.GetNextPageToken() == "" {
+			return tools, nil
+		}
+		q.PageToken = page.GetNextPageToken()
+	}
+}
+
+// HandleEnvelope delivers the ToolResult and ToolProgress messages of
+// pending calls, and the CapabilityCatalog or ErrorMessage answering a
+// pending discovery. It reports whether env was one of them.
+func (c *Caller) HandleEnvelope(env *axcp.Envelope) bool {
+	if env.GetCapabilityMsg().GetCatalog() != nil || env.GetError() != nil {
+		c.mu.Lock()
+		reply, ok := c.queries[env.GetTraceId()]
+		delete(c.queries, env.GetTraceId())
+		c.mu.Unlock()
+		if ok {
+			reply <- env
+		}
+		return ok
+	}
+	switch {
+	case env.GetToolResult() != nil:
+		res := env.GetToolResult()
+		c.mu.Lock()
+		pending, ok := c.calls[res.GetCallId()]
+		delete(c.calls, res.GetCallId())
+		c.mu.Unlock()
+		if ok {
+			pending.result <- res
+		}
+		return true
+	case env.GetToolProgress() != nil:
+		progress := env.GetToolProgress()
+		c.mu.Lock()
+		pending, ok := c.calls[progress.GetCallId()]
+		c.mu.Unlock()
+		if ok && pending.progress != nil {
+			pending.progress(progress)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// newCallID returns a random call_id, also used as trace_id
+func newCallID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,178 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Handler runs an invocation of a tool with its JSON arguments and returns
+// the output, encoded as JSON. progress reports how far the call got. An
+// *axcp.Error is returned to the caller as is, other errors as UNKNOWN.
+type Handler func(ctx context.Context, args json.RawMessage, progress func(fraction float32, message string)) (any, error)
+
+// Provider offers tools to peer and runs the invocations it routes back.
+// Feed it the envelopes received from peer with HandleEnvelope. It is safe
+// for concurrent use.
+type Provider struct {
+	peer Peer
+
+	mu    sync.Mutex
+	tools map[string]*provided // by tool_id
+}
+
+// provided is a tool offered by the provider
+type provided struct {
+	desc    *axcp.Capability
+	schemas *axcp.ToolSchemas
+	handler Handler
+}
+
+// NewProvider returns a provider offering tools to peer
+func NewProvider(peer Peer) *Provider {
+	return &Provider{peer: peer, tools: make(map[string]*provided)}
+}
+
+// Register offers desc to peer, served by handler. Call it again after a
+// reconnect: offers do not outlive the session.
+func (p *Provider) Register(desc *axcp.Capability, handler Handler) error {
+	schemas, err := axcp.CompileCapability(desc)
+	if err != nil {
+		return err
+	}
+	env, err := axcp.NewOfferEnvelope(newCallID(), desc)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.tools[desc.GetToolId()] = &provided{desc: desc, schemas: schemas, handler: handler}
+	p.mu.Unlock()
+	return p.peer.SendEnvelope(env)
+}
+
+// RegisterBundle offers every tool of the signed bundle sb to peer, each
+// served by the handler of its tool_id. Gateways trusting signed offers
+// only accept tools offered this way.
+func (p *Provider) RegisterBundle(sb *axcp.SignedBundle, handlers map[string]Handler) error {
+	bundle, err := axcp.DecodeBundle(sb)
+	if err != nil {
+		return err
+	}
+	tools := make(map[string]*provided, len(bundle.GetTools()))
+	for _, desc := range bundle.GetTools() {
+		handler, ok := handlers[desc.GetToolId()]
+		if !ok {
+			return axcp.NewError(pb.ErrorCode_TOOL_NOT_FOUND, "no handler for %q", desc.GetToolId())
+		}
+		schemas, err := axcp.CompileCapability(desc)
+		if err != nil {
+			return err
+		}
+		tools[desc.GetToolId()] = &provided{desc: desc, schemas: schemas, handler: handler}
+	}
+	p.mu.Lock()
+	for id, tool := range tools {
+		p.tools[id] = tool
+	}
+	p.mu.Unlock()
+	return p.peer.SendEnvelope(axcp.NewBundleOfferEnvelope(newCallID(), sb))
+}
+
+// HandleEnvelope runs the ToolInvoke messages in their own goroutine,
+// bounded by timeout_ms or the timeout of the descriptor, and sends back
+// their ToolResult. It reports whether env was one of them.
+func (p *Provider) HandleEnvelope(env *axcp.Envelope) bool {
+	invoke := env.GetToolInvoke()
+	if invoke == nil {
+		return false
+	}
+	p.mu.Lock()
+	tool, ok := p.tools[invoke.GetToolId()]
+	p.mu.Unlock()
+	if !ok {
+		p.reply(env.GetTraceId(), &pb.ToolResult{
+			CallId: invoke.GetCallId(),
+			Error:  axcp.NewError(pb.ErrorCode_TOOL_NOT_FOUND, "tool %q not offered", invoke.GetToolId()).Message(),
+		})
+		return true
+	}
+	go p.run(env.GetTraceId(), invoke, tool)
+	return true
+}
+
+// run executes one invocation
+func (p *Provider) run(traceID string, invoke *pb.ToolInvoke, tool *provided) {
+	res := &pb.ToolResult{CallId: invoke.GetCallId()}
+	output, err := p.execute(traceID, invoke, tool)
+	if err != nil {
+		var axErr *axcp.Error
+		if !errors.As(err, &axErr) {
+			axErr = axcp.NewError(pb.ErrorCode_UNKNOWN, "%v", err)
+		}
+		res.Error = axErr.Message()
+	} else {
+		res.Output = output
+	}
+	p.reply(traceID, res)
+}
+
+// execute validates the arguments, runs the handler and validates its output
+func (p *Provider) execute(traceID string, invoke *pb.ToolInvoke, tool *provided) ([]byte, error) {
+	if err := tool.schemas.ValidateInput(invoke.GetArguments()); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if timeout := Timeout(invoke, tool.desc); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	progress := func(fraction float32, message string) {
+		env := axcp.NewEnvelope(traceID, 0)
+		env.Payload = &pb.AxcpEnvelope_ToolProgress{ToolProgress: &pb.ToolProgress{
+			CallId: invoke.GetCallId(), Fraction: fraction, Message: message,
+		}}
+		_ = p.peer.SendEnvelope(env)
+	}
+
+	value, err := tool.handler(ctx, invoke.GetArguments(), progress)
+	if errors.Is(err, context.DeadlineExceeded) || (err == nil && ctx.Err() != nil) {
+		return nil, axcp.NewError(pb.ErrorCode_TIMEOUT, "tool %q timed out", invoke.GetToolId())
+	}
+	if err != nil {
+		return nil, err
+	}
+	output, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := tool.schemas.ValidateOutput(output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// reply sends res to peer. A result lost with the session expires on the
+// caller side.
+func (p *Provider) reply(traceID string, res *pb.ToolResult) {
+	env := axcp.NewEnvelope(traceID, 0)
+	env.Payload = &pb.AxcpEnvelope_ToolResult{ToolResult: res}
+	_ = p.peer.SendEnvelope(env)
+}
+
+// Timeout returns the time allowed to an invocation: the smaller of its
+// timeout_ms and the timeout_ms of the descriptor, ignoring zeros. 0 means
+// no limit.
+func Timeout(invoke *pb.ToolInvoke, desc *axcp.Capability) time.Duration {
+	ms := invoke.GetTimeoutMs()
+	if d := desc.GetTimeoutMs(); d > 0 && (ms == 0 || d < ms) {
+		ms = d
+	}
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,92 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// funcPeer hands the envelopes sent to it to a function
+type funcPeer func(*axcp.Envelope) bool
+
+func (f funcPeer) SendEnvelope(env *axcp.Envelope) error {
+	f(env)
+	return nil
+}
+
+// connect returns a caller and a provider talking to each other directly
+func connect() (*Caller, *Provider) {
+	var caller *Caller
+	provider := NewProvider(funcPeer(func(env *axcp.Envelope) bool { return caller.HandleEnvelope(env) }))
+	caller = NewCaller(funcPeer(provider.HandleEnvelope))
+	return caller, provider
+}
+
+func TestCallProvider(t *testing.T) {
+	caller, provider := connect()
+	require.NoError(t, provider.Register(&axcp.Capability{
+		ToolId:       "echo",
+		InputSchema:  `{"type":"object","required":["text"]}`,
+		OutputSchema: `{"type":"string"}`,
+	}, func(ctx context.Context, args json.RawMessage, progress func(float32, string)) (any, error) {
+		var in struct{ Text string }
+		if err := json.Unmarshal(args, &in); err != nil {
+			return nil, err
+		}
+		progress(1, "done")
+		if in.Text == "" {
+			return 42, nil
+		}
+		return in.Text, nil
+	}))
+	require.NoError(t, provider.Register(&axcp.Capability{ToolId: "fail"},
+		func(ctx context.Context, args json.RawMessage, progress func(float32, string)) (any, error) {
+			return nil, errors.New("boom")
+		}))
+	require.NoError(t, provider.Register(&axcp.Capability{ToolId: "sleep", TimeoutMs: 20},
+		func(ctx context.Context, args json.RawMessage, progress func(float32, string)) (any, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var fractions []float32
+	out, err := caller.CallWithProgress(ctx, "echo", map[string]string{"text": "hi"}, func(p *pb.ToolProgress) {
+		fractions = append(fractions, p.GetFraction())
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `"hi"`, string(out))
+	assert.Equal(t, []float32{1}, fractions)
+
+	_, err = caller.Call(ctx, "echo", map[string]string{})
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, axcp.ErrorCodeOf(err), "missing argument")
+	_, err = caller.Call(ctx, "echo", map[string]string{"text": ""})
+	assert.Equal(t, pb.ErrorCode_MALFORMED_REQUEST, axcp.ErrorCodeOf(err), "output not matching its schema")
+
+	_, err = caller.Call(ctx, "fail", nil)
+	assert.Equal(t, pb.ErrorCode_UNKNOWN, axcp.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "boom")
+
+	_, err = caller.Call(ctx, "sleep", nil)
+	assert.Equal(t, pb.ErrorCode_TIMEOUT, axcp.ErrorCodeOf(err))
+
+	_, err = caller.Call(ctx, "missing", nil)
+	assert.Equal(t, pb.ErrorCode_TOOL_NOT_FOUND, axcp.ErrorCodeOf(err))
+}
+
+func TestTimeout(t *testing.T) {
+	desc := &axcp.Capability{TimeoutMs: 500}
+	assert.Equal(t, 500*time.Millisecond, Timeout(&pb.ToolInvoke{}, desc))
+	assert.Equal(t, 100*time.Millisecond, Timeout(&pb.ToolInvoke{TimeoutMs: 100}, desc))
+	assert.Equal(t, 500*time.Millisecond, Timeout(&pb.ToolInvoke{TimeoutMs: 900}, desc))
+	assert.Equal(t, time.Duration(0), Timeout(&pb.ToolInvoke{}, &axcp.Capability{}))
+}
@@ -93,7 +93,7 @@ func startServer(addr string) error {
 
 			// Handle incoming telemetry data
 			for {
-				td, err := client.ReceiveTelemetry()
+				td, err := client.ReceiveTelemetry(context.Background())
 				if err != nil {
 					log.Printf("Failed to receive telemetry: %v", err)
 					return
@@ -0,0 +1,213 @@
+package netquic
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// telemetryProbeSize is the optimistic datagram size tried before quic-go
+	// reports the real limit. Any value above the path MTU works: the first
+	// oversized send returns a DatagramTooLargeError with the current limit.
+	telemetryProbeSize = 1452
+	// telemetryProbeInterval is the number of datagrams sent with a learned
+	// limit before probing again, so batches grow when path MTU discovery
+	// raises the limit.
+	telemetryProbeInterval = 64
+	// DefaultBatchLinger is how long a TelemetryBatcher holds samples
+	DefaultBatchLinger = 100 * time.Millisecond
+)
+
+// telemetryChannel holds the per-connection telemetry state shared by
+// Client, Session and the loopback connection
+type telemetryChannel struct {
+	encoder TelemetryEncoder
+	tracker SeqTracker
+
+	// sendMu serialises batches so sequence numbers follow datagram order
+	sendMu sync.Mutex
+	limit  int // learned max datagram size, 0 until quic-go reports one
+	sent   int // datagrams sent since limit was learned
+
+	// recvMu guards the samples of a batch not yet handed out
+	recvMu  sync.Mutex
+	backlog []*pb.TelemetryDatagram
+}
+
+// TelemetryStats returns loss and reorder statistics for the telemetry
+// received on this connection. Counters are per datagram, not per sample.
+func (tc *telemetryChannel) TelemetryStats() TelemetryStats {
+	return tc.tracker.Stats()
+}
+
+// sendTelemetryBatch packs samples into as few datagrams as the current max
+// datagram size allows. The size is learned from the DatagramTooLargeError
+// returned by send. A sample too large for any datagram goes to fallback,
+// which delivers it on the reliable stream.
+func (tc *telemetryChannel) sendTelemetryBatch(samples []*pb.TelemetryDatagram,
+	send func([]byte) error, fallback func(*pb.TelemetryDatagram) error) error {
+	tc.sendMu.Lock()
+	defer tc.sendMu.Unlock()
+
+	for len(samples) > 0 {
+		limit := tc.limit
+		if limit == 0 || tc.sent >= telemetryProbeInterval {
+			limit = telemetryProbeSize
+		}
+
+		n := fitTelemetry(samples, limit)
+		if n == 0 {
+			if err := fallback(samples[0]); err != nil {
+				return err
+			}
+			samples = samples[1:]
+			continue
+		}
+
+		seq := uint16(tc.encoder.next.Load())
+		data, err := MarshalTelemetryBatch(seq, samples[:n])
+		if err != nil {
+			return err
+		}
+
+		var tooLarge *quic.DatagramTooLargeError
+		if err := send(data); errors.As(err, &tooLarge) {
+			// Never retry with the same size, so the loop always terminates
+			tc.limit = min(int(tooLarge.MaxDatagramPayloadSize), len(data)-1)
+			tc.sent = 0
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		tc.encoder.next.Add(1)
+		if tc.limit != 0 {
+			tc.sent++
+		}
+		samples = samples[n:]
+	}
+	return nil
+}
+
+// fitTelemetry returns how many leading samples fit in one datagram of at
+// most limit bytes, or 0 if even the first one does not
+func fitTelemetry(samples []*pb.TelemetryDatagram, limit int) int {
+	if TelemetryHeaderSize+proto.Size(samples[0]) > limit {
+		return 0
+	}
+
+	// A batch of one is sent as a plain 0xA0 datagram, which is smaller
+	size, n := TelemetryHeaderSize, 0
+	for _, td := range samples {
+		size += protowire.SizeTag(1) + protowire.SizeBytes(proto.Size(td))
+		if size > limit {
+			break
+		}
+		n++
+	}
+	return max(n, 1)
+}
+
+// telemetryEnvelope wraps a sample that does not fit in a datagram
+func telemetryEnvelope(td *pb.TelemetryDatagram) *axcp.Envelope {
+	env := axcp.NewEnvelope(newTraceID(), 0)
+	env.Payload = &pb.AxcpEnvelope_Telemetry{Telemetry: td}
+	return env
+}
+
+// receiveTelemetry returns the next sample, reading a new datagram with recv
+// once the samples of the previous batch are used up
+func (tc *telemetryChannel) receiveTelemetry(ctx context.Context,
+	recv func(context.Context) ([]byte, error)) (*pb.TelemetryDatagram, error) {
+	tc.recvMu.Lock()
+	if len(tc.backlog) > 0 {
+		td := tc.backlog[0]
+		tc.backlog = tc.backlog[1:]
+		tc.recvMu.Unlock()
+		return td, nil
+	}
+	tc.recvMu.Unlock()
+
+	data, err := recv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seq, samples, err := UnmarshalTelemetrySamples(data)
+	if err != nil {
+		return nil, err
+	}
+	tc.tracker.Observe(seq)
+
+	tc.recvMu.Lock()
+	tc.backlog = append(tc.backlog, samples[1:]...)
+	tc.recvMu.Unlock()
+	return samples[0], nil
+}
+
+// TelemetryBatcher collects samples and sends them together once the linger
+// time has passed since the first pending sample, trading a little latency
+// for fewer packets on constrained links.
+type TelemetryBatcher struct {
+	conn   Conn
+	linger time.Duration
+
+	mu      sync.Mutex
+	pending []*pb.TelemetryDatagram
+	timer   *time.Timer
+	err     error
+}
+
+// NewTelemetryBatcher returns a batcher sending on conn. A linger of zero
+// uses DefaultBatchLinger.
+func NewTelemetryBatcher(conn Conn, linger time.Duration) *TelemetryBatcher {
+	if linger <= 0 {
+		linger = DefaultBatchLinger
+	}
+	return &TelemetryBatcher{conn: conn, linger: linger}
+}
+
+// Add queues td for the next batch. It returns the error of the last
+// background flush, if any.
+func (b *TelemetryBatcher) Add(td *pb.TelemetryDatagram) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.err
+	b.err = nil
+	b.pending = append(b.pending, td)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.linger, func() {
+			if err := b.Flush(); err != nil {
+				b.mu.Lock()
+				b.err = err
+				b.mu.Unlock()
+			}
+		})
+	}
+	return err
+}
+
+// Flush sends the pending samples now
+func (b *TelemetryBatcher) Flush() error {
+	b.mu.Lock()
+	samples := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	if len(samples) == 0 {
+		return nil
+	}
+	return b.conn.SendTelemetryBatch(samples)
+}
@@ -0,0 +1,114 @@
+package netquic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// limitedLink records datagrams and refuses those above limit like quic-go
+type limitedLink struct {
+	limit     int
+	datagrams [][]byte
+	envelopes []*pb.TelemetryDatagram
+}
+
+func (l *limitedLink) send(data []byte) error {
+	if len(data) > l.limit {
+		return &quic.DatagramTooLargeError{MaxDatagramPayloadSize: int64(l.limit)}
+	}
+	l.datagrams = append(l.datagrams, data)
+	return nil
+}
+
+func (l *limitedLink) fallback(td *pb.TelemetryDatagram) error {
+	l.envelopes = append(l.envelopes, td)
+	return nil
+}
+
+func samples(n int) []*pb.TelemetryDatagram {
+	out := make([]*pb.TelemetryDatagram, n)
+	for i := range out {
+		out[i] = axcp.WithSystemStats(axcp.NewTelemetryDatagram(), uint32(i), 1<<30, 50)
+	}
+	return out
+}
+
+func TestSendTelemetryBatchPacksUpToLimit(t *testing.T) {
+	link := &limitedLink{limit: 100}
+	var tc telemetryChannel
+	require.NoError(t, tc.sendTelemetryBatch(samples(20), link.send, link.fallback))
+
+	assert.Empty(t, link.envelopes)
+	assert.Greater(t, len(link.datagrams), 1)
+	assert.Less(t, len(link.datagrams), 20, "samples are packed together")
+
+	var got []*pb.TelemetryDatagram
+	for i, data := range link.datagrams {
+		assert.LessOrEqual(t, len(data), link.limit)
+		seq, batch, err := UnmarshalTelemetrySamples(data)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(i), seq, "sequence numbers count datagrams")
+		got = append(got, batch...)
+	}
+	require.Len(t, got, 20)
+	for i, td := range got {
+		assert.Equal(t, uint32(i), td.GetSystem().GetCpuPercent())
+	}
+}
+
+func TestSendTelemetryBatchFallsBackToStream(t *testing.T) {
+	link := &limitedLink{limit: 10}
+	small := &pb.TelemetryDatagram{TimestampMs: 1}
+	big := samples(1)[0]
+
+	var tc telemetryChannel
+	require.NoError(t, tc.sendTelemetryBatch([]*pb.TelemetryDatagram{big, small}, link.send, link.fallback))
+
+	require.Len(t, link.envelopes, 1)
+	assert.Same(t, big, link.envelopes[0])
+	require.Len(t, link.datagrams, 1)
+	assert.Equal(t, DatagramTelemetry, link.datagrams[0][0])
+	assert.Equal(t, uint16(0), uint16(link.datagrams[0][2]), "the stream fallback takes no sequence number")
+}
+
+func TestLoopbackTelemetryBatch(t *testing.T) {
+	client, server := loopbackPair(t, NewLoopbackNetwork(LoopbackOptions{}))
+
+	require.NoError(t, client.SendTelemetryBatch(samples(50)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 50; i++ {
+		td, err := server.ReceiveTelemetry(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i), td.GetSystem().GetCpuPercent())
+	}
+
+	stats := server.TelemetryStats()
+	assert.Less(t, stats.Received, uint64(50), "fewer datagrams than samples")
+	assert.Zero(t, stats.Lost)
+}
+
+func TestTelemetryBatcher(t *testing.T) {
+	client, server := loopbackPair(t, NewLoopbackNetwork(LoopbackOptions{}))
+	batcher := NewTelemetryBatcher(client, 10*time.Millisecond)
+
+	for _, td := range samples(5) {
+		require.NoError(t, batcher.Add(td))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		_, err := server.ReceiveTelemetry(ctx)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, uint64(1), server.TelemetryStats().Received, "one datagram after the linger time")
+}
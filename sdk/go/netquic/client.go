@@ -5,8 +5,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
-	"sync"
+	"net"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -14,7 +13,9 @@ import (
 
 const (
 	defaultTimeout = 8 * time.Second
-	// MaxDatagramSize is the maximum size of a QUIC datagram we'll accept
+	// MaxDatagramSize is the smallest datagram payload every QUIC path
+	// carries. The actual limit is enforced by quic-go, which returns a
+	// *quic.DatagramTooLargeError with the current value.
 	MaxDatagramSize = 1200 // Standard QUIC MTU
 )
 
@@ -27,25 +28,38 @@ var (
 
 // Client represents a QUIC client connection to an AXCP server
 type Client struct {
-	conn      quic.Connection
-	stream    quic.Stream
-	recvMutex sync.Mutex
-	sendMutex sync.Mutex
+	conn quic.Connection
+	controlStream
+	telemetryChannel
+	telemetryPath
+	rpcMux
 }
 
 // Dial establishes a new QUIC connection to the server at the given address
 func Dial(addr string, tlsConf *tls.Config) (*Client, error) {
+	return DialWithConfig(addr, tlsConf, nil)
+}
+
+// DialWithConfig is like Dial but applies the given configuration.
+// A nil cfg uses the defaults.
+func DialWithConfig(addr string, tlsConf *tls.Config, cfg *Config) (*Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
 	defer cancel()
+	return dial(ctx, addr, tlsConf, cfg, false)
+}
 
-	// Configure QUIC transport with datagram support
-	config := &quic.Config{
-		EnableDatagrams: true,             // Enable QUIC datagram support
-		KeepAlivePeriod: 30 * time.Second, // Send a PING every 30 seconds
-	}
-
+// dial connects to addr and runs the profile handshake. With early set the
+// connection is established with quic.DialAddrEarly, so a client resuming a
+// TLS session can send the handshake as 0-RTT data.
+func dial(ctx context.Context, addr string, tlsConf *tls.Config, cfg *Config, early bool) (*Client, error) {
 	// Establish QUIC connection
-	conn, err := quic.DialAddr(ctx, addr, tlsConf, config)
+	var conn quic.Connection
+	var err error
+	if early {
+		conn, err = quic.DialAddrEarly(ctx, addr, tlsConf, newQUICConfig(cfg))
+	} else {
+		conn, err = quic.DialAddr(ctx, addr, tlsConf, newQUICConfig(cfg))
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial QUIC server: %w", err)
 	}
@@ -57,10 +71,42 @@ func Dial(addr string, tlsConf *tls.Config) (*Client, error) {
 		return nil, fmt.Errorf("failed to open control stream: %w", err)
 	}
 
-	return &Client{
-		conn:   conn,
-		stream: stream,
-	}, nil
+	// Agree on the session profile before any other traffic
+	codec := cfg.frameCodec()
+	profile, acks, err := negotiateProfile(stream, codec, cfg.profileOffer())
+	if err != nil {
+		closeWithError(conn, err)
+		return nil, fmt.Errorf("profile negotiation failed: %w", err)
+	}
+
+	c := &Client{
+		conn: conn,
+		controlStream: controlStream{
+			stream:  stream,
+			codec:   codec,
+			profile: profile,
+			acks:    acks,
+			ackCh:   make(chan struct{}, 1),
+		},
+	}
+	c.startRPC(conn, &c.controlStream)
+	c.startTelemetry(conn, codec, cfg)
+	return c, nil
+}
+
+// RemoteAddr returns the address of the server
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Context returns a context that is cancelled when the connection is closed
+func (c *Client) Context() context.Context {
+	return c.conn.Context()
+}
+
+// Used0RTT reports whether the connection resumed a TLS session with 0-RTT
+func (c *Client) Used0RTT() bool {
+	return c.conn.ConnectionState().Used0RTT
 }
 
 // Close terminates the QUIC connection
@@ -74,7 +120,7 @@ func (c *Client) Close() error {
 	return nil
 }
 
-// SendMessage sends a message over the QUIC stream
+// SendMessage sends an opaque message frame over the QUIC stream
 func (c *Client) SendMessage(data []byte) error {
 	if c.stream == nil {
 		return ErrNotConnected
@@ -82,29 +128,10 @@ func (c *Client) SendMessage(data []byte) error {
 
 	c.sendMutex.Lock()
 	defer c.sendMutex.Unlock()
-
-	// Write message length as a 4-byte big-endian integer
-	msgLen := uint32(len(data))
-	header := []byte{
-		byte(msgLen >> 24),
-		byte(msgLen >> 16),
-		byte(msgLen >> 8),
-		byte(msgLen),
-	}
-
-	// Write header and data
-	if _, err := c.stream.Write(header); err != nil {
-		return fmt.Errorf("failed to write message header: %w", err)
-	}
-
-	if _, err := c.stream.Write(data); err != nil {
-		return fmt.Errorf("failed to write message data: %w", err)
-	}
-
-	return nil
+	return c.codec.WriteFrame(c.stream, FrameMessage, data)
 }
 
-// ReceiveMessage receives a message from the QUIC stream
+// ReceiveMessage receives an opaque message frame from the QUIC stream
 func (c *Client) ReceiveMessage() ([]byte, error) {
 	if c.stream == nil {
 		return nil, ErrNotConnected
@@ -112,30 +139,7 @@ func (c *Client) ReceiveMessage() ([]byte, error) {
 
 	c.recvMutex.Lock()
 	defer c.recvMutex.Unlock()
-
-	// Read message length (4 bytes)
-	header := make([]byte, 4)
-	if _, err := io.ReadFull(c.stream, header); err != nil {
-		return nil, fmt.Errorf("failed to read message header: %w", err)
-	}
-
-	msgLen := uint32(header[0])<<24 |
-		uint32(header[1])<<16 |
-		uint32(header[2])<<8 |
-		uint32(header[3])
-
-	// Prevent allocating an excessively large buffer
-	if msgLen > 10*1024*1024 { // 10MB max message size
-		return nil, fmt.Errorf("message too large: %d bytes", msgLen)
-	}
-
-	// Read message data
-	data := make([]byte, msgLen)
-	if _, err := io.ReadFull(c.stream, data); err != nil {
-		return nil, fmt.Errorf("failed to read message data: %w", err)
-	}
-
-	return data, nil
+	return c.readFrame(FrameMessage)
 }
 
 // SendDatagram sends a datagram using QUIC's unreliable datagram transport
@@ -143,22 +147,23 @@ func (c *Client) SendDatagram(data []byte) error {
 	if c.conn == nil {
 		return ErrNotConnected
 	}
+	return sendDatagram(c.conn, data)
+}
 
-	if len(data) > MaxDatagramSize {
-		return fmt.Errorf("datagram too large: %d > %d", len(data), MaxDatagramSize)
-	}
-
+// sendDatagram checks peer support before handing data to QUIC. Oversized
+// data fails with a *quic.DatagramTooLargeError.
+func sendDatagram(conn quic.Connection, data []byte) error {
 	// Check if datagram is supported
-	if !c.conn.ConnectionState().SupportsDatagrams {
+	if !conn.ConnectionState().SupportsDatagrams {
 		return ErrDatagramNotSupported
 	}
 
 	// Send the datagram using the datagram writer
-	return c.conn.SendDatagram(data)
+	return conn.SendDatagram(data)
 }
 
-// ReceiveDatagram receives a datagram using QUIC's unreliable datagram transport
-func (c *Client) ReceiveDatagram() ([]byte, error) {
+// ReceiveDatagram blocks until a datagram arrives or ctx is done
+func (c *Client) ReceiveDatagram(ctx context.Context) ([]byte, error) {
 	if c.conn == nil {
 		return nil, ErrNotConnected
 	}
@@ -168,11 +173,6 @@ func (c *Client) ReceiveDatagram() ([]byte, error) {
 		return nil, ErrDatagramNotSupported
 	}
 
-	// Receive the datagram with a context timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Use the datagram reader to receive the message
 	msg, err := c.conn.ReceiveDatagram(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to receive datagram: %w", err)
@@ -0,0 +1,63 @@
+package netquic
+
+import (
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Config holds the optional settings shared by Client and Server
+type Config struct {
+	// MaxFrameSize limits stream frame payloads; zero means DefaultMaxFrameSize
+	MaxFrameSize uint32
+	// SupportedProfiles is the bitmask of profiles this node accepts
+	// (bit 0 = Profile-0 … bit 3 = Profile-3); zero means axcp.AllProfiles
+	SupportedProfiles uint32
+	// MinProfile is the lowest profile this node accepts for a session
+	MinProfile uint32
+	// Allow0RTT lets a server accept 0-RTT data from clients resuming a
+	// TLS session. 0-RTT data can be replayed, so only enable it when the
+	// first envelopes of a session are idempotent.
+	Allow0RTT bool
+	// DisableDatagrams turns off QUIC datagram support, as a datagram-hostile
+	// path would. Telemetry then travels on the telemetry stream.
+	DisableDatagrams bool
+}
+
+// frameCodec returns the codec configured by cfg, which may be nil
+func (cfg *Config) frameCodec() *FrameCodec {
+	if cfg == nil {
+		return NewFrameCodec(DefaultMaxFrameSize)
+	}
+	return NewFrameCodec(cfg.MaxFrameSize)
+}
+
+// profileOffer returns the ProfileNegotiate sent during the handshake
+func (cfg *Config) profileOffer() *pb.ProfileNegotiate {
+	mask, minProfile := uint32(axcp.AllProfiles), uint32(0)
+	if cfg != nil {
+		if cfg.SupportedProfiles != 0 {
+			mask = cfg.SupportedProfiles
+		}
+		minProfile = cfg.MinProfile
+	}
+	offer := axcp.NewProfileNegotiate(mask, minProfile)
+	offer.DeliveryAcks = true
+	return offer
+}
+
+// allow0RTT reports whether cfg, which may be nil, enables 0-RTT
+func (cfg *Config) allow0RTT() bool {
+	return cfg != nil && cfg.Allow0RTT
+}
+
+// newQUICConfig returns the QUIC transport settings shared by Dial and
+// Listen. cfg may be nil.
+func newQUICConfig(cfg *Config) *quic.Config {
+	return &quic.Config{
+		EnableDatagrams: cfg == nil || !cfg.DisableDatagrams, // Enable QUIC datagram support
+		KeepAlivePeriod: 30 * time.Second,                    // Send a PING every 30 seconds
+	}
+}
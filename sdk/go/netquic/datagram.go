@@ -1,66 +1,63 @@
 package netquic
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
 	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
-	"google.golang.org/protobuf/proto"
 )
 
 // SendTelemetry sends a telemetry datagram over the QUIC connection.
-// It wraps the TelemetryDatagram in an AxcpEnvelope with the appropriate profile
-// and sends it as a datagram.
+// The datagram is framed as in spec v0.2 §5.8.1 with the next sequence
+// number of this connection.
 func (c *Client) SendTelemetry(d *pb.TelemetryDatagram) error {
+	return c.SendTelemetryBatch([]*pb.TelemetryDatagram{d})
+}
+
+// SendTelemetryBatch packs samples into as few datagrams as the current max
+// datagram size reported by quic-go allows. A sample that never fits in a
+// datagram is sent as an envelope on the control stream.
+func (c *Client) SendTelemetryBatch(samples []*pb.TelemetryDatagram) error {
 	if c == nil || c.conn == nil {
 		return fmt.Errorf("client is not connected")
 	}
 
-	// Create an envelope for the telemetry data
-	envelope := &pb.AxcpEnvelope{
-		Version: 1, // Current protocol version
-		Profile: 0, // Basic profile for telemetry
-		Payload: &pb.AxcpEnvelope_Telemetry{
-			Telemetry: d,
-		},
-	}
-
-	// Marshal the envelope to protobuf
-	payload, err := proto.Marshal(envelope)
-	if err != nil {
-		return fmt.Errorf("failed to marshal telemetry envelope: %w", err)
-	}
-
-	// Send as a datagram (unreliable but faster)
-	return c.SendDatagram(payload)
+	return c.sendTelemetryBatch(samples, c.sendTelemetryData, func(td *pb.TelemetryDatagram) error {
+		return c.SendEnvelope(telemetryEnvelope(td))
+	})
 }
 
-// ReceiveTelemetry waits for and receives a telemetry datagram from the QUIC connection.
-// It returns the received TelemetryDatagram or an error if the operation fails.
-func (c *Client) ReceiveTelemetry() (*pb.TelemetryDatagram, error) {
+// ReceiveTelemetry blocks until a telemetry sample arrives or ctx is done.
+// Batched datagrams are unpacked and their samples returned one by one.
+// Telemetry is accepted from datagrams and from the telemetry stream; after
+// the first call, ReceiveDatagram must not be used on the same client.
+// Malformed datagrams are reported with an error wrapping ErrInvalidDatagram.
+func (c *Client) ReceiveTelemetry(ctx context.Context) (*pb.TelemetryDatagram, error) {
 	if c == nil || c.conn == nil {
 		return nil, fmt.Errorf("client is not connected")
 	}
 
-	// Receive a datagram
-	data, err := c.ReceiveDatagram()
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive datagram: %w", err)
-	}
+	return c.receiveTelemetry(ctx, c.receiveTelemetryData)
+}
 
-	// Unmarshal the envelope
-	envelope := &pb.AxcpEnvelope{}
-	if err := proto.Unmarshal(data, envelope); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal envelope: %w", err)
-	}
+// SendTelemetry sends a telemetry datagram to the connected client
+func (s *Session) SendTelemetry(d *pb.TelemetryDatagram) error {
+	return s.SendTelemetryBatch([]*pb.TelemetryDatagram{d})
+}
 
-	// Extract the telemetry data from the envelope
-	telemetry, ok := envelope.Payload.(*pb.AxcpEnvelope_Telemetry)
-	if !ok {
-		return nil, fmt.Errorf("received message is not a telemetry datagram")
-	}
+// SendTelemetryBatch packs samples into as few datagrams as possible, see
+// Client.SendTelemetryBatch
+func (s *Session) SendTelemetryBatch(samples []*pb.TelemetryDatagram) error {
+	return s.sendTelemetryBatch(samples, s.sendTelemetryData, func(td *pb.TelemetryDatagram) error {
+		return s.SendEnvelope(telemetryEnvelope(td))
+	})
+}
 
-	return telemetry.Telemetry, nil
+// ReceiveTelemetry blocks until a telemetry sample arrives or ctx is done.
+// Malformed datagrams are reported with an error wrapping ErrInvalidDatagram.
+func (s *Session) ReceiveTelemetry(ctx context.Context) (*pb.TelemetryDatagram, error) {
+	return s.receiveTelemetry(ctx, s.receiveTelemetryData)
 }
 
 // WithSystemStats is a helper function to create and send a system stats telemetry datagram.
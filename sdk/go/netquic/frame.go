@@ -0,0 +1,180 @@
+package netquic
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+)
+
+// Every AXCP stream carries a sequence of frames with a fixed 6-byte header:
+//
+//	+--------+---------+------------------+-----------------+
+//	| type   | version | length (u32, BE) | payload         |
+//	| 1 byte | 1 byte  | 4 bytes          | length bytes    |
+//	+--------+---------+------------------+-----------------+
+const (
+	// FrameVersion is the framing version written by this package
+	FrameVersion = 1
+	// FrameHeaderSize is the size of the frame header in bytes
+	FrameHeaderSize = 6
+	// DefaultMaxFrameSize is the payload limit used when none is configured
+	DefaultMaxFrameSize = 10 * 1024 * 1024 // 10MB
+)
+
+// FrameType identifies the payload carried by a frame
+type FrameType uint8
+
+const (
+	// FrameEnvelope carries a protobuf-encoded AxcpEnvelope
+	FrameEnvelope FrameType = 0x01
+	// FrameMessage carries opaque application bytes (SendMessage/ReceiveMessage)
+	FrameMessage FrameType = 0x02
+	// FrameTelemetry carries a telemetry datagram (spec §5.8.1) on the
+	// telemetry stream used when the peer does not support QUIC datagrams
+	FrameTelemetry FrameType = 0x03
+	// FrameAck carries the big-endian u64 count of envelope frames received
+	// on the control stream since the handshake, when delivery acks were
+	// negotiated
+	FrameAck FrameType = 0x04
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameEnvelope:
+		return "envelope"
+	case FrameMessage:
+		return "message"
+	case FrameTelemetry:
+		return "telemetry"
+	case FrameAck:
+		return "ack"
+	default:
+		return fmt.Sprintf("0x%02x", uint8(t))
+	}
+}
+
+var (
+	// ErrUnsupportedFrameVersion is returned when a frame header carries an unknown version
+	ErrUnsupportedFrameVersion = errors.New("unsupported frame version")
+	// ErrUnexpectedFrame is returned when a frame of a different type than requested arrives
+	ErrUnexpectedFrame = errors.New("unexpected frame type")
+)
+
+// FrameTooLargeError is returned when a frame payload exceeds the codec limit,
+// either on the sending side or as announced by a received header.
+// After a receive-side error the stream is out of sync and should be closed.
+type FrameTooLargeError struct {
+	Size uint64
+	Max  uint32
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("frame too large: %d > %d bytes", e.Size, e.Max)
+}
+
+// FrameCodec reads and writes AXCP stream frames
+type FrameCodec struct {
+	// MaxSize is the largest accepted payload; zero means DefaultMaxFrameSize
+	MaxSize uint32
+}
+
+// NewFrameCodec returns a codec enforcing the given payload limit
+func NewFrameCodec(maxSize uint32) *FrameCodec {
+	return &FrameCodec{MaxSize: maxSize}
+}
+
+var defaultFrameCodec = NewFrameCodec(DefaultMaxFrameSize)
+
+// WriteFrame writes a frame using the default codec
+func WriteFrame(w io.Writer, t FrameType, payload []byte) error {
+	return defaultFrameCodec.WriteFrame(w, t, payload)
+}
+
+// ReadFrame reads a frame using the default codec
+func ReadFrame(r io.Reader) (FrameType, []byte, error) {
+	return defaultFrameCodec.ReadFrame(r)
+}
+
+func (c *FrameCodec) maxSize() uint32 {
+	if c == nil || c.MaxSize == 0 {
+		return DefaultMaxFrameSize
+	}
+	return c.MaxSize
+}
+
+// WriteFrame writes header and payload with a single Write call so that
+// concurrent writers on different streams never interleave partial frames.
+func (c *FrameCodec) WriteFrame(w io.Writer, t FrameType, payload []byte) error {
+	if uint64(len(payload)) > uint64(c.maxSize()) {
+		return &FrameTooLargeError{Size: uint64(len(payload)), Max: c.maxSize()}
+	}
+
+	buf := make([]byte, FrameHeaderSize+len(payload))
+	buf[0] = byte(t)
+	buf[1] = FrameVersion
+	binary.BigEndian.PutUint32(buf[2:FrameHeaderSize], uint32(len(payload)))
+	copy(buf[FrameHeaderSize:], payload)
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write %s frame: %w", t, err)
+	}
+	return nil
+}
+
+// ReadFrame reads the next frame. The payload buffer is only allocated once
+// the announced length has been checked against the limit.
+func (c *FrameCodec) ReadFrame(r io.Reader) (FrameType, []byte, error) {
+	var header [FrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	t := FrameType(header[0])
+	if header[1] != FrameVersion {
+		return t, nil, fmt.Errorf("%w: %d", ErrUnsupportedFrameVersion, header[1])
+	}
+
+	size := binary.BigEndian.Uint32(header[2:])
+	if size > c.maxSize() {
+		return t, nil, &FrameTooLargeError{Size: uint64(size), Max: c.maxSize()}
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return t, nil, fmt.Errorf("failed to read %s frame: %w", t, err)
+	}
+	return t, payload, nil
+}
+
+// ReadFrameOf reads the next frame and checks that it has the expected type
+func (c *FrameCodec) ReadFrameOf(r io.Reader, want FrameType) ([]byte, error) {
+	t, payload, err := c.ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if t != want {
+		return nil, fmt.Errorf("%w: got %s, want %s", ErrUnexpectedFrame, t, want)
+	}
+	return payload, nil
+}
+
+// WriteEnvelope encodes env and writes it as a FrameEnvelope
+func (c *FrameCodec) WriteEnvelope(w io.Writer, env *axcp.Envelope) error {
+	raw, err := axcp.ToBytes(env)
+	if err != nil {
+		return err
+	}
+	return c.WriteFrame(w, FrameEnvelope, raw)
+}
+
+// ReadEnvelope reads a FrameEnvelope and decodes it
+func (c *FrameCodec) ReadEnvelope(r io.Reader) (*axcp.Envelope, error) {
+	raw, err := c.ReadFrameOf(r, FrameEnvelope)
+	if err != nil {
+		return nil, err
+	}
+	return axcp.FromBytes(raw)
+}
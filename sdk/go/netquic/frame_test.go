@@ -0,0 +1,92 @@
+package netquic
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+)
+
+func TestWriteFrameGolden(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteFrame(&buf, FrameMessage, []byte("hi")))
+
+	golden := []byte{
+		0x02,                   // type: message
+		0x01,                   // version
+		0x00, 0x00, 0x00, 0x02, // length (big-endian)
+		'h', 'i',
+	}
+	assert.Equal(t, golden, buf.Bytes())
+}
+
+func TestWriteEnvelopeGolden(t *testing.T) {
+	var buf bytes.Buffer
+	codec := NewFrameCodec(0)
+	require.NoError(t, codec.WriteEnvelope(&buf, axcp.NewEnvelope("t", 1)))
+
+	golden := []byte{
+		0x01,                   // type: envelope
+		0x01,                   // version
+		0x00, 0x00, 0x00, 0x07, // length (big-endian)
+		0x08, 0x01, // version = 1
+		0x12, 0x01, 't', // trace_id = "t"
+		0x18, 0x01, // profile = 1
+	}
+	assert.Equal(t, golden, buf.Bytes())
+
+	env, err := codec.ReadEnvelope(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "t", env.GetTraceId())
+	assert.Equal(t, uint32(1), env.GetProfile())
+}
+
+func TestReadFrameEmptyPayload(t *testing.T) {
+	typ, payload, err := ReadFrame(bytes.NewReader([]byte{0x02, 0x01, 0, 0, 0, 0}))
+	require.NoError(t, err)
+	assert.Equal(t, FrameMessage, typ)
+	assert.Empty(t, payload)
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	codec := NewFrameCodec(4)
+
+	// Header announces 5 bytes; the payload must never be allocated or read
+	_, _, err := codec.ReadFrame(bytes.NewReader([]byte{0x02, 0x01, 0, 0, 0, 5}))
+
+	var tooLarge *FrameTooLargeError
+	require.True(t, errors.As(err, &tooLarge))
+	assert.Equal(t, uint64(5), tooLarge.Size)
+	assert.Equal(t, uint32(4), tooLarge.Max)
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	err := NewFrameCodec(4).WriteFrame(&buf, FrameMessage, []byte("hello"))
+
+	var tooLarge *FrameTooLargeError
+	require.True(t, errors.As(err, &tooLarge))
+	assert.Zero(t, buf.Len(), "nothing must be written for an oversize frame")
+}
+
+func TestReadFrameUnsupportedVersion(t *testing.T) {
+	_, _, err := ReadFrame(bytes.NewReader([]byte{0x02, 0x02, 0, 0, 0, 0}))
+	assert.ErrorIs(t, err, ErrUnsupportedFrameVersion)
+}
+
+func TestReadFrameOfUnexpectedType(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteFrame(&buf, FrameMessage, []byte("x")))
+
+	_, err := NewFrameCodec(0).ReadFrameOf(&buf, FrameEnvelope)
+	assert.ErrorIs(t, err, ErrUnexpectedFrame)
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	_, _, err := ReadFrame(bytes.NewReader([]byte{0x02, 0x01, 0, 0, 0, 3, 'a'}))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
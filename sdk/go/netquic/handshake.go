@@ -0,0 +1,99 @@
+package netquic
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// negotiateProfile runs the dynamic profile handshake of spec v0.2 §5.7 on
+// the control stream. Both peers run the same steps:
+//
+//  1. send ProfileNegotiate with the local mask and minimum
+//  2. read the peer's ProfileNegotiate and compute the session profile
+//  3. send ProfileAck, or an ErrorMessage if no profile is acceptable
+//  4. read the peer's ProfileAck and check that both sides agree
+//
+// Delivery acks are enabled when both offers ask for them.
+func negotiateProfile(stream quic.Stream, codec *FrameCodec, local *pb.ProfileNegotiate) (uint32, bool, error) {
+	_ = stream.SetDeadline(time.Now().Add(defaultTimeout))
+	defer stream.SetDeadline(time.Time{})
+
+	offer := axcp.NewEnvelope("", 0)
+	offer.Payload = &pb.AxcpEnvelope_ProfileNeg{ProfileNeg: local}
+	if err := codec.WriteEnvelope(stream, offer); err != nil {
+		return 0, false, peerCloseError(err, "failed to send profile offer")
+	}
+
+	peer, err := readHandshakeEnvelope(stream, codec)
+	if err != nil {
+		return 0, false, err
+	}
+	remote := peer.GetProfileNeg()
+	if remote == nil {
+		return 0, false, axcp.NewError(pb.ErrorCode_PROFILE_NEGOTIATION_FAILED, "expected ProfileNegotiate from peer")
+	}
+
+	profile, err := axcp.NegotiateProfile(local, remote)
+	if err != nil {
+		// Tell the peer why the session is being torn down
+		var axErr *axcp.Error
+		if errors.As(err, &axErr) {
+			_ = codec.WriteEnvelope(stream, axcp.NewErrorEnvelope("", axErr))
+		}
+		return 0, false, err
+	}
+
+	ack := axcp.NewEnvelope("", 0)
+	ack.Payload = &pb.AxcpEnvelope_ProfileAck{ProfileAck: &pb.ProfileAck{AgreedProfile: profile}}
+	if err := codec.WriteEnvelope(stream, ack); err != nil {
+		return 0, false, peerCloseError(err, "failed to send profile ack")
+	}
+
+	peer, err = readHandshakeEnvelope(stream, codec)
+	if err != nil {
+		return 0, false, err
+	}
+	if peer.GetProfileAck() == nil {
+		return 0, false, axcp.NewError(pb.ErrorCode_PROFILE_NEGOTIATION_FAILED, "expected ProfileAck from peer")
+	}
+	if agreed := peer.GetProfileAck().GetAgreedProfile(); agreed != profile {
+		return 0, false, axcp.NewError(pb.ErrorCode_PROFILE_NEGOTIATION_FAILED,
+			"peer agreed on profile %d, expected %d", agreed, profile)
+	}
+	return profile, local.GetDeliveryAcks() && remote.GetDeliveryAcks(), nil
+}
+
+// readHandshakeEnvelope reads the next handshake envelope, turning an
+// ErrorMessage or connection close sent by the peer into an *axcp.Error.
+func readHandshakeEnvelope(stream quic.Stream, codec *FrameCodec) (*axcp.Envelope, error) {
+	env, err := codec.ReadEnvelope(stream)
+	if err != nil {
+		return nil, peerCloseError(err, "failed to read handshake")
+	}
+	if msg := env.GetError(); msg != nil {
+		return nil, axcp.ErrorFromMessage(msg)
+	}
+	return env, nil
+}
+
+// peerCloseError turns a connection closed by the peer through
+// closeWithError back into an *axcp.Error. The peer may tear the connection
+// down before its ErrorMessage is read, so the application error code is the
+// only trace of the failure.
+func peerCloseError(err error, op string) error {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode != 0 {
+		return axcp.NewError(pb.ErrorCode(appErr.ErrorCode), "%s", appErr.ErrorMessage)
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// closeWithError closes conn, using the AXCP code of err as application error code
+func closeWithError(conn quic.Connection, err error) {
+	conn.CloseWithError(quic.ApplicationErrorCode(axcp.ErrorCodeOf(err)), err.Error())
+}
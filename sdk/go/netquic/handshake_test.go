@@ -0,0 +1,87 @@
+package netquic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+func TestProfileNegotiation(t *testing.T) {
+	server, err := ListenWithConfig("127.0.0.1:0", InsecureTLSConfig(), &Config{
+		SupportedProfiles: axcp.ProfileMask(0, 1, 2),
+	})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := DialWithConfig(server.Addr().String(), InsecureTLSConfig(), &Config{
+		SupportedProfiles: axcp.AllProfiles,
+		MinProfile:        1,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := server.Accept(ctx)
+	require.NoError(t, err)
+	defer session.Close()
+
+	assert.Equal(t, uint32(2), client.Profile())
+	assert.Equal(t, uint32(2), session.Profile())
+}
+
+func TestProfileNegotiationFailed(t *testing.T) {
+	server, err := ListenWithConfig("127.0.0.1:0", InsecureTLSConfig(), &Config{
+		SupportedProfiles: axcp.ProfileMask(0, 1),
+	})
+	require.NoError(t, err)
+	defer server.Close()
+
+	_, err = DialWithConfig(server.Addr().String(), InsecureTLSConfig(), &Config{
+		MinProfile: 2,
+	})
+	require.Error(t, err)
+	assert.Equal(t, pb.ErrorCode_PROFILE_NEGOTIATION_FAILED, axcp.ErrorCodeOf(err))
+
+	// The server never hands out a session for the failed connection
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = server.Accept(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestProfileMismatchRejected(t *testing.T) {
+	server, sessions := startTestServer(t)
+
+	client, err := DialWithConfig(server.Addr().String(), InsecureTLSConfig(), &Config{
+		SupportedProfiles: axcp.ProfileMask(0, 1),
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	session := acceptSession(t, sessions)
+
+	// The sender refuses to claim a profile above the session profile
+	err = client.SendEnvelope(axcp.NewEnvelope("too-high", 3))
+	assert.Equal(t, pb.ErrorCode_PROFILE_MISMATCH, axcp.ErrorCodeOf(err))
+
+	// A misbehaving peer is answered with ErrorMessage{PROFILE_MISMATCH}
+	require.NoError(t, client.codec.WriteEnvelope(client.stream, axcp.NewEnvelope("too-high", 3)))
+	_, err = session.RecvEnvelope()
+	assert.Equal(t, pb.ErrorCode_PROFILE_MISMATCH, axcp.ErrorCodeOf(err))
+
+	reply, err := client.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "too-high", reply.GetTraceId())
+	assert.Equal(t, uint32(pb.ErrorCode_PROFILE_MISMATCH), reply.GetError().GetCode())
+
+	// The stream stays usable afterwards
+	require.NoError(t, client.SendEnvelope(axcp.NewEnvelope("ok", 1)))
+	env, err := session.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "ok", env.GetTraceId())
+}
@@ -0,0 +1,427 @@
+package netquic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+const (
+	loopbackEnvelopeBuffer = 1024
+	loopbackDatagramBuffer = 256
+)
+
+var (
+	// ErrConnectionRefused is returned when dialing a loopback address
+	// nobody listens on
+	ErrConnectionRefused = errors.New("connection refused")
+	// errLoopbackClosed is the cause of a closed loopback connection
+	errLoopbackClosed = errors.New("loopback connection closed")
+)
+
+// LoopbackOptions shapes the traffic of a LoopbackNetwork
+type LoopbackOptions struct {
+	// DatagramLoss is the probability (0..1) that a datagram is dropped.
+	// Envelopes are never lost, as on a QUIC stream.
+	DatagramLoss float64
+	// Latency delays every envelope and datagram by the same amount, so
+	// ordering is preserved
+	Latency time.Duration
+	// Seed makes the loss pattern reproducible
+	Seed uint64
+	// DisableDatagrams makes SendDatagram fail with ErrDatagramNotSupported,
+	// so telemetry takes the reliable telemetry stream as over QUIC
+	DisableDatagrams bool
+}
+
+// LoopbackNetwork is an in-process network implementing Transport without
+// sockets or certificates. Whole gateway and agent flows can run in a
+// single test with controlled datagram loss and latency.
+type LoopbackNetwork struct {
+	opts LoopbackOptions
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	listeners map[string]*loopbackListener
+	nextPort  int
+}
+
+// NewLoopbackNetwork returns an empty network
+func NewLoopbackNetwork(opts LoopbackOptions) *LoopbackNetwork {
+	return &LoopbackNetwork{
+		opts:      opts,
+		rng:       rand.New(rand.NewPCG(opts.Seed, opts.Seed)),
+		listeners: make(map[string]*loopbackListener),
+	}
+}
+
+// Transport returns an endpoint of the network using cfg for its side of
+// the profile handshake (nil uses the defaults)
+func (n *LoopbackNetwork) Transport(cfg *Config) Transport {
+	return &loopbackTransport{network: n, config: cfg}
+}
+
+// drop decides whether the next datagram is lost
+func (n *LoopbackNetwork) drop() bool {
+	if n.opts.DatagramLoss <= 0 {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rng.Float64() < n.opts.DatagramLoss
+}
+
+// clientAddr returns a unique address for a dialing endpoint
+func (n *LoopbackNetwork) clientAddr() loopbackAddr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nextPort++
+	return loopbackAddr(fmt.Sprintf("client-%d", n.nextPort))
+}
+
+// loopbackAddr is the net.Addr of a loopback endpoint
+type loopbackAddr string
+
+func (a loopbackAddr) Network() string { return "loopback" }
+func (a loopbackAddr) String() string  { return string(a) }
+
+type loopbackTransport struct {
+	network *LoopbackNetwork
+	config  *Config
+}
+
+// Listen registers a listener under addr
+func (t *loopbackTransport) Listen(addr string) (Listener, error) {
+	n := t.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("failed to listen on %s: address already in use", addr)
+	}
+
+	l := &loopbackListener{
+		network: n,
+		addr:    loopbackAddr(addr),
+		config:  t.config,
+		conns:   make(chan *loopbackConn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects to the listener at addr. The profile handshake runs
+// in-process with the same rules as over QUIC; on failure the error is an
+// *axcp.Error and the listener never sees the connection.
+func (t *loopbackTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	n := t.network
+	n.mu.Lock()
+	l := n.listeners[addr]
+	n.mu.Unlock()
+	if l == nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", addr, ErrConnectionRefused)
+	}
+
+	profile, err := axcp.NegotiateProfile(t.config.profileOffer(), l.config.profileOffer())
+	if err != nil {
+		return nil, fmt.Errorf("profile negotiation failed: %w", err)
+	}
+
+	client, server := newLoopbackPair(n, profile, n.clientAddr(), l.addr)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("failed to dial %s: %w", addr, ErrConnectionRefused)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type loopbackListener struct {
+	network *LoopbackNetwork
+	addr    loopbackAddr
+	config  *Config
+	conns   chan *loopbackConn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Accept waits for the next dialer
+func (l *loopbackListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Addr returns the address the listener is registered under
+func (l *loopbackListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close unregisters the listener. Accepted connections stay open.
+func (l *loopbackListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+// loopbackPacket is an envelope or datagram in flight
+type loopbackPacket struct {
+	data []byte
+	at   time.Time
+}
+
+// loopbackQueue is a FIFO of packets. A packet taken by a receiver giving
+// up before it is due goes back to the head, so reliable links never lose
+// it.
+type loopbackQueue struct {
+	ch chan loopbackPacket
+
+	mu       sync.Mutex
+	returned []loopbackPacket // delivered before ch, first one first
+}
+
+func newLoopbackQueue(size int) *loopbackQueue {
+	return &loopbackQueue{ch: make(chan loopbackPacket, size)}
+}
+
+// takeReturned pops the first returned packet, if any
+func (q *loopbackQueue) takeReturned() (loopbackPacket, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.returned) == 0 {
+		return loopbackPacket{}, false
+	}
+	p := q.returned[0]
+	q.returned = q.returned[1:]
+	return p, true
+}
+
+// giveBack puts p back at the head of the queue
+func (q *loopbackQueue) giveBack(p loopbackPacket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.returned = append([]loopbackPacket{p}, q.returned...)
+}
+
+// loopbackPipe carries one direction of a connection
+type loopbackPipe struct {
+	envelopes *loopbackQueue
+	datagrams *loopbackQueue
+	telemetry *loopbackQueue // telemetry stream, without datagrams
+}
+
+func newLoopbackPipe() *loopbackPipe {
+	return &loopbackPipe{
+		envelopes: newLoopbackQueue(loopbackEnvelopeBuffer),
+		datagrams: newLoopbackQueue(loopbackDatagramBuffer),
+		telemetry: newLoopbackQueue(loopbackEnvelopeBuffer),
+	}
+}
+
+// loopbackConn is one end of an in-memory connection
+type loopbackConn struct {
+	network *LoopbackNetwork
+	profile uint32
+	local   loopbackAddr
+	remote  loopbackAddr
+	in      *loopbackPipe
+	out     *loopbackPipe
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	telemetryChannel
+}
+
+// newLoopbackPair returns the two connected ends of a connection. Closing
+// either end closes both, as a QUIC CONNECTION_CLOSE would.
+func newLoopbackPair(n *LoopbackNetwork, profile uint32, clientAddr, serverAddr loopbackAddr) (*loopbackConn, *loopbackConn) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	up, down := newLoopbackPipe(), newLoopbackPipe()
+	client := &loopbackConn{network: n, profile: profile, local: clientAddr, remote: serverAddr,
+		in: down, out: up, ctx: ctx, cancel: cancel}
+	server := &loopbackConn{network: n, profile: profile, local: serverAddr, remote: clientAddr,
+		in: up, out: down, ctx: ctx, cancel: cancel}
+	return client, server
+}
+
+// SendEnvelope queues env for the peer. Envelopes claiming a profile above
+// the session profile are refused with PROFILE_MISMATCH.
+func (c *loopbackConn) SendEnvelope(env *axcp.Envelope) error {
+	if err := axcp.CheckProfile(env, c.profile); err != nil {
+		return err
+	}
+	// Encode to mimic the wire and keep the peer from sharing our message
+	raw, err := axcp.ToBytes(env)
+	if err != nil {
+		return err
+	}
+	return c.send(c.out.envelopes, raw, true)
+}
+
+// RecvEnvelope reads the next envelope. An envelope claiming a profile
+// above the session profile is answered with ErrorMessage{PROFILE_MISMATCH}.
+func (c *loopbackConn) RecvEnvelope() (*axcp.Envelope, error) {
+	raw, err := c.receive(context.Background(), c.in.envelopes)
+	if err != nil {
+		return nil, err
+	}
+	env, err := axcp.FromBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var axErr *axcp.Error
+	if err := axcp.CheckProfile(env, c.profile); errors.As(err, &axErr) {
+		if reply, err := axcp.ToBytes(axcp.NewErrorEnvelope(env.GetTraceId(), axErr)); err == nil {
+			_ = c.send(c.out.envelopes, reply, true)
+		}
+		return nil, axErr
+	}
+	return env, nil
+}
+
+// SendDatagram delivers data unless the network drops it. Datagrams above
+// MaxDatagramSize are refused with a quic.DatagramTooLargeError, as quic-go
+// does for datagrams above the path limit.
+func (c *loopbackConn) SendDatagram(data []byte) error {
+	if c.network.opts.DisableDatagrams {
+		return ErrDatagramNotSupported
+	}
+	if len(data) > MaxDatagramSize {
+		return &quic.DatagramTooLargeError{MaxDatagramPayloadSize: MaxDatagramSize}
+	}
+	if c.network.drop() {
+		return nil
+	}
+	return c.send(c.out.datagrams, append([]byte(nil), data...), false)
+}
+
+// ReceiveDatagram blocks until a datagram arrives or ctx is done
+func (c *loopbackConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	if c.network.opts.DisableDatagrams {
+		return nil, ErrDatagramNotSupported
+	}
+	return c.receive(ctx, c.in.datagrams)
+}
+
+// SendTelemetry sends td with the next sequence number
+func (c *loopbackConn) SendTelemetry(td *pb.TelemetryDatagram) error {
+	return c.SendTelemetryBatch([]*pb.TelemetryDatagram{td})
+}
+
+// SendTelemetryBatch packs samples into datagrams of at most MaxDatagramSize
+func (c *loopbackConn) SendTelemetryBatch(samples []*pb.TelemetryDatagram) error {
+	return c.sendTelemetryBatch(samples, c.sendTelemetryData, func(td *pb.TelemetryDatagram) error {
+		return c.SendEnvelope(telemetryEnvelope(td))
+	})
+}
+
+// ReceiveTelemetry blocks until a telemetry sample arrives or ctx is done
+func (c *loopbackConn) ReceiveTelemetry(ctx context.Context) (*pb.TelemetryDatagram, error) {
+	if c.network.opts.DisableDatagrams {
+		return c.receiveTelemetry(ctx, func(ctx context.Context) ([]byte, error) {
+			return c.receive(ctx, c.in.telemetry)
+		})
+	}
+	return c.receiveTelemetry(ctx, c.ReceiveDatagram)
+}
+
+// sendTelemetryData sends a telemetry datagram, on the reliable telemetry
+// stream when datagrams are disabled
+func (c *loopbackConn) sendTelemetryData(data []byte) error {
+	if c.network.opts.DisableDatagrams {
+		return c.send(c.out.telemetry, data, true)
+	}
+	return c.SendDatagram(data)
+}
+
+// Profile returns the session profile
+func (c *loopbackConn) Profile() uint32 {
+	return c.profile
+}
+
+// RemoteAddr returns the address of the peer
+func (c *loopbackConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Context is cancelled when either end is closed
+func (c *loopbackConn) Context() context.Context {
+	return c.ctx
+}
+
+// Close closes both ends of the connection
+func (c *loopbackConn) Close() error {
+	c.cancel(errLoopbackClosed)
+	return nil
+}
+
+// send queues a packet. Reliable sends wait for room like a stream under
+// flow control; datagrams are dropped when the peer's buffer is full.
+func (c *loopbackConn) send(q *loopbackQueue, data []byte, reliable bool) error {
+	if c.ctx.Err() != nil {
+		return context.Cause(c.ctx)
+	}
+
+	p := loopbackPacket{data: data, at: time.Now().Add(c.network.opts.Latency)}
+	if !reliable {
+		select {
+		case q.ch <- p:
+		default:
+		}
+		return nil
+	}
+	select {
+	case q.ch <- p:
+		return nil
+	case <-c.ctx.Done():
+		return context.Cause(c.ctx)
+	}
+}
+
+// receive takes the next packet and waits until it is due. If ctx ends
+// first the packet is given back, to be delivered by the next receive.
+func (c *loopbackConn) receive(ctx context.Context, q *loopbackQueue) ([]byte, error) {
+	p, ok := q.takeReturned()
+	if !ok {
+		select {
+		case p = <-q.ch:
+		case <-c.ctx.Done():
+			return nil, context.Cause(c.ctx)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if wait := time.Until(p.at); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			return nil, context.Cause(c.ctx)
+		case <-ctx.Done():
+			q.giveBack(p)
+			return nil, ctx.Err()
+		}
+	}
+	return p.data, nil
+}
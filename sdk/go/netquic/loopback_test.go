@@ -0,0 +1,169 @@
+package netquic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// loopbackPair dials a fresh listener and returns both ends
+func loopbackPair(t *testing.T, network *LoopbackNetwork) (Conn, Conn) {
+	t.Helper()
+	listener, err := network.Transport(nil).Listen("gateway")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	accepted := make(chan Conn, 1)
+	go func() {
+		conn, err := listener.Accept(ctx)
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	client, err := network.Transport(nil).Dial(ctx, "gateway")
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case server := <-accepted:
+		return client, server
+	case <-ctx.Done():
+		t.Fatal("listener did not accept the connection")
+		return nil, nil
+	}
+}
+
+func TestLoopbackEnvelopes(t *testing.T) {
+	client, server := loopbackPair(t, NewLoopbackNetwork(LoopbackOptions{}))
+	assert.Equal(t, uint32(axcp.MaxProfile), client.Profile())
+
+	require.NoError(t, client.SendEnvelope(axcp.NewEnvelope("ping", 0)))
+	env, err := server.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "ping", env.GetTraceId())
+
+	require.NoError(t, server.SendEnvelope(axcp.NewEnvelope("pong", 0)))
+	env, err = client.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "pong", env.GetTraceId())
+	assert.Equal(t, "gateway", client.RemoteAddr().String())
+}
+
+func TestLoopbackProfileNegotiation(t *testing.T) {
+	network := NewLoopbackNetwork(LoopbackOptions{})
+	listener, err := network.Transport(&Config{SupportedProfiles: axcp.ProfileMask(0, 1)}).Listen("gateway")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	_, err = network.Transport(&Config{MinProfile: 2}).Dial(context.Background(), "gateway")
+	assert.Equal(t, pb.ErrorCode_PROFILE_NEGOTIATION_FAILED, axcp.ErrorCodeOf(err))
+
+	_, err = network.Transport(nil).Dial(context.Background(), "nobody")
+	assert.ErrorIs(t, err, ErrConnectionRefused)
+}
+
+func TestLoopbackDatagramLossIsReproducible(t *testing.T) {
+	run := func() TelemetryStats {
+		client, server := loopbackPair(t, NewLoopbackNetwork(LoopbackOptions{DatagramLoss: 0.3, Seed: 42}))
+		for i := 0; i < 100; i++ {
+			require.NoError(t, client.SendTelemetry(axcp.NewTelemetryDatagram()))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		for {
+			if _, err := server.ReceiveTelemetry(ctx); err != nil {
+				break
+			}
+		}
+		return server.TelemetryStats()
+	}
+
+	first := run()
+	assert.Less(t, first.Received, uint64(100))
+	assert.Greater(t, first.Received, uint64(0))
+	assert.Positive(t, first.Lost)
+	assert.Equal(t, first, run(), "the same seed drops the same datagrams")
+}
+
+func TestLoopbackLatency(t *testing.T) {
+	client, server := loopbackPair(t, NewLoopbackNetwork(LoopbackOptions{Latency: 50 * time.Millisecond}))
+
+	start := time.Now()
+	require.NoError(t, client.SendEnvelope(axcp.NewEnvelope("slow", 0)))
+	_, err := server.RecvEnvelope()
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestLoopbackCloseReachesPeer(t *testing.T) {
+	client, server := loopbackPair(t, NewLoopbackNetwork(LoopbackOptions{}))
+
+	require.NoError(t, client.Close())
+	_, err := server.RecvEnvelope()
+	assert.Error(t, err)
+	assert.Error(t, server.Context().Err())
+}
+
+func TestLoopbackProfileMismatch(t *testing.T) {
+	network := NewLoopbackNetwork(LoopbackOptions{})
+	listener, err := network.Transport(&Config{SupportedProfiles: axcp.ProfileMask(0, 1)}).Listen("gateway")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		_, _ = network.Transport(nil).Dial(context.Background(), "gateway")
+	}()
+	server, err := listener.Accept(context.Background())
+	require.NoError(t, err)
+
+	err = server.SendEnvelope(axcp.NewEnvelope("too-high", 3))
+	assert.Equal(t, pb.ErrorCode_PROFILE_MISMATCH, axcp.ErrorCodeOf(err))
+}
+
+func TestLoopbackTelemetryWithoutDatagrams(t *testing.T) {
+	client, server := loopbackPair(t, NewLoopbackNetwork(LoopbackOptions{DisableDatagrams: true, DatagramLoss: 1}))
+	assert.ErrorIs(t, client.SendDatagram([]byte{0xA0}), ErrDatagramNotSupported)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, client.SendTelemetry(axcp.NewTelemetryDatagram()))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		_, err := server.ReceiveTelemetry(ctx)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, TelemetryStats{Received: 10}, server.TelemetryStats(), "the telemetry stream is never lossy")
+}
+
+func TestLoopbackCancelledReceiveKeepsPacket(t *testing.T) {
+	client, server := loopbackPair(t, NewLoopbackNetwork(LoopbackOptions{DisableDatagrams: true, Latency: 50 * time.Millisecond}))
+
+	for i := 0; i < 2; i++ {
+		td := axcp.NewTelemetryDatagram()
+		td.TimestampMs = uint64(i + 1)
+		require.NoError(t, client.SendTelemetry(td))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := server.ReceiveTelemetry(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The sample waiting out its latency is delivered by the next receive
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		td, err := server.ReceiveTelemetry(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i+1), td.GetTimestampMs())
+	}
+	assert.Equal(t, TelemetryStats{Received: 2}, server.TelemetryStats())
+}
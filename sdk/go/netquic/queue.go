@@ -0,0 +1,232 @@
+package netquic
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.etcd.io/bbolt"
+)
+
+// DefaultQueueSize is the number of envelopes a ResilientClient buffers
+// while disconnected when no queue is configured
+const DefaultQueueSize = 1024
+
+var (
+	// ErrQueueFull is returned when the outbound queue has no room left
+	ErrQueueFull = errors.New("outbound queue full")
+	// ErrQueueEmpty is returned by Peek and Pop on an empty queue
+	ErrQueueEmpty = errors.New("outbound queue empty")
+)
+
+// OutboundQueue is a bounded FIFO of encoded envelopes waiting to be sent.
+// Peek and Pop are split so that an envelope leaves the queue only once the
+// peer has acknowledged it.
+type OutboundQueue interface {
+	// Push appends msg, or returns ErrQueueFull
+	Push(msg []byte) error
+	// Peek returns the oldest message without removing it
+	Peek() ([]byte, error)
+	// PeekN returns up to n of the oldest messages without removing them
+	PeekN(n int) ([][]byte, error)
+	// Pop removes the oldest message
+	Pop() error
+	// Len returns the number of queued messages
+	Len() int
+	// Close releases the resources held by the queue
+	Close() error
+}
+
+// MemoryQueue is an in-memory OutboundQueue. Its content is lost when the
+// process exits.
+type MemoryQueue struct {
+	mu       sync.Mutex
+	items    [][]byte
+	capacity int
+}
+
+// NewMemoryQueue returns a queue holding at most capacity messages.
+// A capacity <= 0 means DefaultQueueSize.
+func NewMemoryQueue(capacity int) *MemoryQueue {
+	if capacity <= 0 {
+		capacity = DefaultQueueSize
+	}
+	return &MemoryQueue{capacity: capacity}
+}
+
+// Push appends msg to the queue
+func (q *MemoryQueue) Push(msg []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) >= q.capacity {
+		return ErrQueueFull
+	}
+	q.items = append(q.items, msg)
+	return nil
+}
+
+// Peek returns the oldest message
+func (q *MemoryQueue) Peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	return q.items[0], nil
+}
+
+// PeekN returns up to n of the oldest messages
+func (q *MemoryQueue) PeekN(n int) ([][]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([][]byte(nil), q.items[:min(n, len(q.items))]...), nil
+}
+
+// Pop removes the oldest message
+func (q *MemoryQueue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return ErrQueueEmpty
+	}
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return nil
+}
+
+// Len returns the number of queued messages
+func (q *MemoryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Close is a no-op for the in-memory queue
+func (q *MemoryQueue) Close() error {
+	return nil
+}
+
+const boltQueueBucket = "outbound_queue"
+
+// BoltQueue is an OutboundQueue persisted in a bbolt database, so envelopes
+// queued while offline survive a restart of the agent. Keys are the bucket
+// sequence in big-endian order, which keeps the cursor in FIFO order.
+type BoltQueue struct {
+	db       *bbolt.DB
+	mu       sync.Mutex
+	count    int
+	capacity int
+}
+
+// OpenBoltQueue opens (or creates) the queue database at path.
+// A capacity <= 0 means DefaultQueueSize.
+func OpenBoltQueue(path string, capacity int) (*BoltQueue, error) {
+	if capacity <= 0 {
+		capacity = DefaultQueueSize
+	}
+
+	db, err := bbolt.Open(path, 0o600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open queue %s: %w", path, err)
+	}
+
+	q := &BoltQueue{db: db, capacity: capacity}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(boltQueueBucket))
+		if err != nil {
+			return err
+		}
+		q.count = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise queue %s: %w", path, err)
+	}
+	return q, nil
+}
+
+// Push appends msg to the queue
+func (q *BoltQueue) Push(msg []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.count >= q.capacity {
+		return ErrQueueFull
+	}
+
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(boltQueueBucket))
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, msg)
+	})
+	if err != nil {
+		return err
+	}
+	q.count++
+	return nil
+}
+
+// Peek returns the oldest message
+func (q *BoltQueue) Peek() ([]byte, error) {
+	var msg []byte
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		_, v := tx.Bucket([]byte(boltQueueBucket)).Cursor().First()
+		if v == nil {
+			return ErrQueueEmpty
+		}
+		// Values are only valid inside the transaction
+		msg = append([]byte(nil), v...)
+		return nil
+	})
+	return msg, err
+}
+
+// PeekN returns up to n of the oldest messages
+func (q *BoltQueue) PeekN(n int) ([][]byte, error) {
+	var msgs [][]byte
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(boltQueueBucket)).Cursor()
+		for k, v := c.First(); k != nil && len(msgs) < n; k, v = c.Next() {
+			msgs = append(msgs, append([]byte(nil), v...))
+		}
+		return nil
+	})
+	return msgs, err
+}
+
+// Pop removes the oldest message
+func (q *BoltQueue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(boltQueueBucket)).Cursor()
+		if k, _ := c.First(); k == nil {
+			return ErrQueueEmpty
+		}
+		return c.Delete()
+	})
+	if err != nil {
+		return err
+	}
+	q.count--
+	return nil
+}
+
+// Len returns the number of queued messages
+func (q *BoltQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Close closes the underlying database
+func (q *BoltQueue) Close() error {
+	return q.db.Close()
+}
@@ -0,0 +1,396 @@
+package netquic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+	// sendWindow is the number of envelopes sent ahead of the peer's acks
+	sendWindow = 64
+)
+
+// ErrClientClosed is returned by a ResilientClient after Close
+var ErrClientClosed = errors.New("client closed")
+
+// ConnState is the connection state reported by a ResilientClient
+type ConnState int
+
+const (
+	// StateConnecting means a dial and profile handshake are in progress
+	StateConnecting ConnState = iota
+	// StateConnected means envelopes are flowing on a live connection
+	StateConnected
+	// StateDisconnected means the last attempt failed and the client is
+	// waiting for the next one
+	StateDisconnected
+	// StateClosed means Close was called; the client will not reconnect
+	StateClosed
+)
+
+// String returns a human readable name for the state
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ReconnectConfig holds the settings of a ResilientClient.
+// The zero value is usable.
+type ReconnectConfig struct {
+	// Config is applied to every connection; nil uses the defaults
+	Config *Config
+	// MinBackoff is the first reconnect delay; zero means 500ms
+	MinBackoff time.Duration
+	// MaxBackoff caps the exponential backoff; zero means 30s
+	MaxBackoff time.Duration
+	// Queue buffers outbound envelopes; nil means an in-memory queue of
+	// DefaultQueueSize envelopes. Use OpenBoltQueue to survive restarts.
+	// The client owns the queue and closes it on Close.
+	Queue OutboundQueue
+	// OnStateChange is called on every state transition with the error
+	// that caused it, if any. It runs on the reconnect goroutine and must
+	// not block.
+	OnStateChange func(state ConnState, err error)
+	// OnDrop is called for queued envelopes the peer refuses for good
+	// (for example with PROFILE_MISMATCH). They are removed from the queue
+	// so they do not block the envelopes behind them.
+	OnDrop func(env *axcp.Envelope, err error)
+}
+
+// ResilientClient is a Client that survives connection loss.
+// SendEnvelope never waits for the network: envelopes go to a bounded
+// outbound queue that is drained in order whenever a connection is up.
+// Lost connections are re-established with jittered exponential backoff,
+// resuming the TLS session (and using 0-RTT when the server allows it).
+//
+// When the server supports delivery acks, an envelope leaves the queue only
+// once the server has read it. Envelopes in flight when a connection drops
+// are sent again on the next one, so delivery is at-least-once. Without
+// acks an envelope leaves the queue once written and may be lost.
+type ResilientClient struct {
+	addr     string
+	tlsConf  *tls.Config
+	cfg      ReconnectConfig
+	queue    OutboundQueue
+	incoming chan *axcp.Envelope
+	wake     chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+	closeErr error
+
+	mu     sync.Mutex
+	state  ConnState
+	client *Client
+}
+
+// NewResilientClient starts connecting to addr in the background.
+// A nil cfg uses the defaults.
+func NewResilientClient(addr string, tlsConf *tls.Config, cfg *ReconnectConfig) *ResilientClient {
+	r := &ResilientClient{
+		addr:     addr,
+		tlsConf:  tlsConf.Clone(),
+		incoming: make(chan *axcp.Envelope, 64),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if cfg != nil {
+		r.cfg = *cfg
+	}
+	if r.cfg.MinBackoff <= 0 {
+		r.cfg.MinBackoff = defaultMinBackoff
+	}
+	if r.cfg.MaxBackoff < r.cfg.MinBackoff {
+		r.cfg.MaxBackoff = max(defaultMaxBackoff, r.cfg.MinBackoff)
+	}
+	r.queue = r.cfg.Queue
+	if r.queue == nil {
+		r.queue = NewMemoryQueue(DefaultQueueSize)
+	}
+	// Session tickets let reconnections resume TLS and send 0-RTT data
+	if r.tlsConf == nil {
+		r.tlsConf = &tls.Config{}
+	}
+	if r.tlsConf.ClientSessionCache == nil {
+		r.tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+// SendEnvelope queues env for delivery. It returns ErrQueueFull when the
+// queue has no room left and ErrClientClosed after Close.
+func (r *ResilientClient) SendEnvelope(env *axcp.Envelope) error {
+	select {
+	case <-r.done:
+		return ErrClientClosed
+	default:
+	}
+
+	raw, err := axcp.ToBytes(env)
+	if err != nil {
+		return err
+	}
+	if err := r.queue.Push(raw); err != nil {
+		return err
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// RecvEnvelope returns the next envelope received on any connection
+func (r *ResilientClient) RecvEnvelope(ctx context.Context) (*axcp.Envelope, error) {
+	select {
+	case env := <-r.incoming:
+		return env, nil
+	case <-r.done:
+		return nil, ErrClientClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// State returns the current connection state
+func (r *ResilientClient) State() ConnState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// Pending returns the number of envelopes waiting to be sent
+func (r *ResilientClient) Pending() int {
+	return r.queue.Len()
+}
+
+// Close stops reconnecting, closes the current connection and the queue.
+// Envelopes still queued stay in a persistent queue for the next run.
+func (r *ResilientClient) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+		r.mu.Lock()
+		if r.client != nil {
+			r.client.Close()
+		}
+		r.mu.Unlock()
+		r.wg.Wait()
+		r.setState(StateClosed, nil)
+		r.closeErr = r.queue.Close()
+	})
+	return r.closeErr
+}
+
+// run is the reconnect loop
+func (r *ResilientClient) run() {
+	defer r.wg.Done()
+
+	backoff := r.cfg.MinBackoff
+	for {
+		r.setState(StateConnecting, nil)
+		client, err := r.connect()
+		if err == nil {
+			backoff = r.cfg.MinBackoff
+			err = r.serve(client)
+		}
+		if r.isClosed() {
+			return
+		}
+		r.setState(StateDisconnected, err)
+
+		// Equal jitter: wait between half and the whole backoff, so a fleet
+		// that lost the same access point does not reconnect in lockstep
+		delay := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-time.After(delay):
+		case <-r.done:
+			return
+		}
+		backoff = min(2*backoff, r.cfg.MaxBackoff)
+	}
+}
+
+// connect dials the server, giving up early if the client is closed
+func (r *ResilientClient) connect() (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	client, err := dial(ctx, r.addr, r.tlsConf, r.cfg.Config, true)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// The handshake sent as 0-RTT data was discarded; send it again
+		// once the connection is established
+		client, err = dial(ctx, r.addr, r.tlsConf, r.cfg.Config, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.isClosed() {
+		client.Close()
+		return nil, ErrClientClosed
+	}
+	r.client = client
+	return client, nil
+}
+
+// serve drains the queue on client until the connection fails
+func (r *ResilientClient) serve(client *Client) error {
+	r.setState(StateConnected, nil)
+
+	recvDone := make(chan struct{})
+	var recvErr error
+	go func() {
+		defer close(recvDone)
+		recvErr = r.recvLoop(client)
+	}()
+	defer func() {
+		r.mu.Lock()
+		r.client = nil
+		r.mu.Unlock()
+		client.Close()
+		<-recvDone
+	}()
+
+	// Positions of the envelopes sent but not yet acknowledged, oldest first
+	var inflight []uint64
+	for {
+		if err := r.drain(client, &inflight); err != nil {
+			return err
+		}
+		select {
+		case <-r.wake:
+		case <-client.ackSignal():
+		case <-recvDone:
+			return recvErr
+		case <-client.Context().Done():
+			return context.Cause(client.Context())
+		case <-r.done:
+			return nil
+		}
+	}
+}
+
+// drain sends the queued envelopes in order, up to sendWindow ahead of the
+// server's acks. inflight holds the position of each envelope sent on client
+// and not yet acknowledged; those envelopes stay at the head of the queue,
+// so a transport error leaves them for the next connection. Without
+// delivery acks envelopes are removed as soon as they are written.
+func (r *ResilientClient) drain(client *Client, inflight *[]uint64) error {
+	for {
+		for acked := client.ackedCount(); len(*inflight) > 0 && (*inflight)[0] <= acked; {
+			if err := r.queue.Pop(); err != nil {
+				return err
+			}
+			*inflight = (*inflight)[1:]
+		}
+
+		batch, err := r.queue.PeekN(sendWindow)
+		if err != nil {
+			return err
+		}
+		if len(batch) <= len(*inflight) {
+			return nil
+		}
+
+		for _, raw := range batch[len(*inflight):] {
+			var seq uint64
+			env, err := axcp.FromBytes(raw)
+			if err == nil {
+				seq, err = client.sendEnvelope(env)
+			}
+			// Undecodable entries and envelopes refused with an AXCP error would
+			// fail again on the next connection, so they are dropped once the
+			// envelopes sent before them are acknowledged
+			var axErr *axcp.Error
+			if err != nil && env != nil && !errors.As(err, &axErr) {
+				return err
+			}
+			if err != nil {
+				seq = client.sentCount()
+				if r.cfg.OnDrop != nil {
+					r.cfg.OnDrop(env, err)
+				}
+			}
+			if !client.acks {
+				seq = 0
+			}
+			*inflight = append(*inflight, seq)
+		}
+	}
+}
+
+// recvLoop forwards envelopes from client to RecvEnvelope
+func (r *ResilientClient) recvLoop(client *Client) error {
+	for {
+		env, err := client.RecvEnvelope()
+		if axcp.ErrorCodeOf(err) == pb.ErrorCode_PROFILE_MISMATCH {
+			// The peer has been told; the connection stays usable
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case r.incoming <- env:
+		case <-client.Context().Done():
+			return nil
+		case <-r.done:
+			return nil
+		}
+	}
+}
+
+// setState records the new state and notifies OnStateChange
+func (r *ResilientClient) setState(state ConnState, err error) {
+	r.mu.Lock()
+	changed := r.state != state
+	r.state = state
+	r.mu.Unlock()
+
+	if (changed || err != nil) && r.cfg.OnStateChange != nil {
+		r.cfg.OnStateChange(state, err)
+	}
+}
+
+func (r *ResilientClient) isClosed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,220 @@
+package netquic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+)
+
+// freeUDPAddr returns a loopback address nobody is listening on
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := conn.LocalAddr().String()
+	require.NoError(t, conn.Close())
+	return addr
+}
+
+// stateRecorder collects the states reported through OnStateChange
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []ConnState
+}
+
+func (r *stateRecorder) record(state ConnState, _ error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, state)
+}
+
+func (r *stateRecorder) count(state ConnState) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, s := range r.states {
+		if s == state {
+			n++
+		}
+	}
+	return n
+}
+
+func TestResilientClientQueuesWhileOffline(t *testing.T) {
+	addr := freeUDPAddr(t)
+	var states stateRecorder
+	client := NewResilientClient(addr, InsecureTLSConfig(), &ReconnectConfig{
+		MinBackoff:    10 * time.Millisecond,
+		MaxBackoff:    50 * time.Millisecond,
+		OnStateChange: states.record,
+	})
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, client.SendEnvelope(axcp.NewEnvelope(fmt.Sprintf("msg-%d", i), 0)))
+	}
+	assert.Equal(t, 3, client.Pending())
+
+	// The server comes up later; the queue drains in order
+	server, err := Listen(addr, InsecureTLSConfig())
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	session, err := server.Accept(ctx)
+	require.NoError(t, err)
+	defer session.Close()
+
+	for i := 0; i < 3; i++ {
+		env, err := session.RecvEnvelope()
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("msg-%d", i), env.GetTraceId())
+	}
+	// Envelopes leave the queue once the server acknowledges them
+	assert.Eventually(t, func() bool { return client.Pending() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, StateConnected, client.State())
+	assert.Equal(t, 1, states.count(StateConnected))
+}
+
+func TestResilientClientReconnects(t *testing.T) {
+	server, err := ListenWithConfig("127.0.0.1:0", InsecureTLSConfig(), &Config{Allow0RTT: true})
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := NewResilientClient(server.Addr().String(), InsecureTLSConfig(), &ReconnectConfig{
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.NoError(t, client.SendEnvelope(axcp.NewEnvelope("first", 0)))
+	session, err := server.Accept(ctx)
+	require.NoError(t, err)
+	env, err := session.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "first", env.GetTraceId())
+
+	// Replies reach the application through RecvEnvelope
+	require.NoError(t, session.SendEnvelope(axcp.NewEnvelope("reply", 0)))
+	reply, err := client.RecvEnvelope(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", reply.GetTraceId())
+
+	// The server drops the connection; the client comes back on its own
+	require.NoError(t, session.Close())
+	session, err = server.Accept(ctx)
+	require.NoError(t, err)
+	defer session.Close()
+
+	require.NoError(t, client.SendEnvelope(axcp.NewEnvelope("second", 0)))
+	env, err = session.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "second", env.GetTraceId())
+
+	// The second connection resumed the TLS session and sent the handshake
+	// as 0-RTT data
+	client.mu.Lock()
+	used0RTT := client.client != nil && client.client.Used0RTT()
+	client.mu.Unlock()
+	assert.True(t, used0RTT)
+
+	require.NoError(t, client.Close())
+	assert.Equal(t, StateClosed, client.State())
+	assert.ErrorIs(t, client.SendEnvelope(axcp.NewEnvelope("late", 0)), ErrClientClosed)
+}
+
+func TestResilientClientResendsUnacknowledged(t *testing.T) {
+	server, err := Listen("127.0.0.1:0", InsecureTLSConfig())
+	require.NoError(t, err)
+	defer server.Close()
+
+	client := NewResilientClient(server.Addr().String(), InsecureTLSConfig(), &ReconnectConfig{
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.NoError(t, client.SendEnvelope(axcp.NewEnvelope("unacked", 0)))
+	session, err := server.Accept(ctx)
+	require.NoError(t, err)
+
+	// The envelope reaches the server, which drops the connection before
+	// reading it through RecvEnvelope, so it is never acknowledged
+	session.recvMutex.Lock()
+	_, err = session.readFrame(FrameEnvelope)
+	session.recvMutex.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, 1, client.Pending())
+	require.NoError(t, session.Close())
+
+	session, err = server.Accept(ctx)
+	require.NoError(t, err)
+	defer session.Close()
+
+	env, err := session.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "unacked", env.GetTraceId())
+	assert.Eventually(t, func() bool { return client.Pending() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryQueueBounded(t *testing.T) {
+	q := NewMemoryQueue(2)
+	require.NoError(t, q.Push([]byte("a")))
+	require.NoError(t, q.Push([]byte("b")))
+	assert.ErrorIs(t, q.Push([]byte("c")), ErrQueueFull)
+
+	msgs, err := q.PeekN(3)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, msgs)
+
+	msg, err := q.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), msg)
+	require.NoError(t, q.Pop())
+	require.NoError(t, q.Pop())
+	assert.ErrorIs(t, q.Pop(), ErrQueueEmpty)
+}
+
+func TestBoltQueuePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	q, err := OpenBoltQueue(path, 2)
+	require.NoError(t, err)
+	require.NoError(t, q.Push([]byte("a")))
+	require.NoError(t, q.Push([]byte("b")))
+	assert.ErrorIs(t, q.Push([]byte("c")), ErrQueueFull)
+	require.NoError(t, q.Close())
+
+	q, err = OpenBoltQueue(path, 2)
+	require.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 2, q.Len())
+
+	msgs, err := q.PeekN(1)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, msgs)
+
+	for _, want := range []string{"a", "b"} {
+		msg, err := q.Peek()
+		require.NoError(t, err)
+		assert.Equal(t, want, string(msg))
+		require.NoError(t, q.Pop())
+	}
+	_, err = q.Peek()
+	assert.ErrorIs(t, err, ErrQueueEmpty)
+}
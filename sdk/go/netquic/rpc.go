@@ -0,0 +1,195 @@
+package netquic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Request/response calls run on their own bidirectional stream, so a slow
+// reply never holds up other calls or the control stream:
+//
+//	caller                          callee
+//	  | open stream, envelope frame ->  |
+//	  | <- reply envelope frame, FIN    |
+//
+// Either side may call the other; a server uses the same mechanism to push
+// to a client. The reply carries the trace_id of the request.
+
+// streamCancelled is the stream error code sent when a caller gives up
+const streamCancelled = quic.StreamErrorCode(pb.ErrorCode_TIMEOUT)
+
+// Request is an envelope received on a per-request stream.
+// The caller waits for exactly one Reply.
+type Request struct {
+	// Envelope is the request sent by the peer
+	Envelope *axcp.Envelope
+
+	stream  quic.Stream
+	codec   *FrameCodec
+	profile uint32
+}
+
+// Reply sends env as the answer to the request and closes the stream.
+// An empty trace_id is filled in with the one of the request.
+func (r *Request) Reply(env *axcp.Envelope) error {
+	if env.GetTraceId() == "" {
+		env.TraceId = r.Envelope.GetTraceId()
+	}
+	if err := axcp.CheckProfile(env, r.profile); err != nil {
+		return err
+	}
+	if err := r.codec.WriteEnvelope(r.stream, env); err != nil {
+		return err
+	}
+	return r.stream.Close()
+}
+
+// ReplyError answers the request with an ErrorMessage
+func (r *Request) ReplyError(err *axcp.Error) error {
+	return r.Reply(axcp.NewErrorEnvelope(r.Envelope.GetTraceId(), err))
+}
+
+// rpcMux implements Call and AcceptRequest for Client and Session
+type rpcMux struct {
+	rpcConn  quic.Connection
+	cs       *controlStream
+	requests chan *Request
+}
+
+// startRPC accepts request streams opened by the peer until conn closes.
+// It must run after the control stream has been opened or accepted, and
+// shares its codec and session profile.
+func (m *rpcMux) startRPC(conn quic.Connection, cs *controlStream) {
+	m.rpcConn = conn
+	m.cs = cs
+	m.requests = make(chan *Request)
+	go m.acceptStreams()
+}
+
+// Call sends env on a new stream and waits for the reply.
+// A missing trace_id is generated. If ctx is done before the reply
+// arrives the stream is reset and ctx.Err() is returned. A reply carrying
+// an ErrorMessage is returned as an *axcp.Error.
+func (m *rpcMux) Call(ctx context.Context, env *axcp.Envelope) (*axcp.Envelope, error) {
+	if m.rpcConn == nil {
+		return nil, ErrNotConnected
+	}
+	if err := axcp.CheckProfile(env, m.cs.profile); err != nil {
+		return nil, err
+	}
+	if env.GetTraceId() == "" {
+		env.TraceId = newTraceID()
+	}
+
+	stream, err := m.rpcConn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open request stream: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelWrite(streamCancelled)
+		stream.CancelRead(streamCancelled)
+	})
+	defer stop()
+
+	reply, err := m.exchange(stream, env)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if msg := reply.GetError(); msg != nil {
+		return nil, axcp.ErrorFromMessage(msg)
+	}
+	if reply.GetTraceId() != env.GetTraceId() {
+		return nil, fmt.Errorf("reply trace_id %q does not match request %q", reply.GetTraceId(), env.GetTraceId())
+	}
+	if err := axcp.CheckProfile(reply, m.cs.profile); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// exchange writes the request, half-closes the stream and reads the reply
+func (m *rpcMux) exchange(stream quic.Stream, env *axcp.Envelope) (*axcp.Envelope, error) {
+	if err := m.cs.codec.WriteEnvelope(stream, env); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+	reply, err := m.cs.codec.ReadEnvelope(stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply: %w", err)
+	}
+	return reply, nil
+}
+
+// AcceptRequest waits for the next request opened by the peer
+func (m *rpcMux) AcceptRequest(ctx context.Context) (*Request, error) {
+	if m.rpcConn == nil {
+		return nil, ErrNotConnected
+	}
+
+	select {
+	case req := <-m.requests:
+		return req, nil
+	case <-m.rpcConn.Context().Done():
+		return nil, context.Cause(m.rpcConn.Context())
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acceptStreams reads each incoming request on its own goroutine, so a
+// peer that is slow to send its request does not delay the others
+func (m *rpcMux) acceptStreams() {
+	for {
+		stream, err := m.rpcConn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go m.readRequest(stream)
+	}
+}
+
+// readRequest reads the request envelope and hands it to AcceptRequest.
+// Requests above the session profile are answered with PROFILE_MISMATCH.
+func (m *rpcMux) readRequest(stream quic.Stream) {
+	_ = stream.SetReadDeadline(time.Now().Add(defaultTimeout))
+	env, err := m.cs.codec.ReadEnvelope(stream)
+	if err != nil {
+		stream.CancelRead(streamCancelled)
+		stream.CancelWrite(streamCancelled)
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	req := &Request{Envelope: env, stream: stream, codec: m.cs.codec, profile: m.cs.profile}
+	var axErr *axcp.Error
+	if err := axcp.CheckProfile(env, m.cs.profile); errors.As(err, &axErr) {
+		_ = req.ReplyError(axErr)
+		return
+	}
+
+	select {
+	case m.requests <- req:
+	case <-m.rpcConn.Context().Done():
+	}
+}
+
+// newTraceID returns a random 128-bit trace_id in hex
+func newTraceID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,139 @@
+package netquic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+func TestCallRoundTrip(t *testing.T) {
+	server, sessions := startTestServer(t)
+	client, err := Dial(server.Addr().String(), InsecureTLSConfig())
+	require.NoError(t, err)
+	defer client.Close()
+	session := acceptSession(t, sessions)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		req, err := session.AcceptRequest(ctx)
+		if err != nil {
+			return
+		}
+		_ = req.Reply(axcp.NewEnvelope("", 0))
+	}()
+
+	reply, err := client.Call(ctx, axcp.NewEnvelope("", 0))
+	require.NoError(t, err)
+	assert.NotEmpty(t, reply.GetTraceId(), "trace_id is generated and echoed")
+}
+
+func TestCallSlowReplyDoesNotBlockOthers(t *testing.T) {
+	server, sessions := startTestServer(t)
+	client, err := Dial(server.Addr().String(), InsecureTLSConfig())
+	require.NoError(t, err)
+	defer client.Close()
+	session := acceptSession(t, sessions)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Answer "fast" at once and "slow" only after "fast" has been answered
+	go func() {
+		var slow *Request
+		for i := 0; i < 2; i++ {
+			req, err := session.AcceptRequest(ctx)
+			if err != nil {
+				return
+			}
+			if req.Envelope.GetTraceId() == "slow" {
+				slow = req
+				continue
+			}
+			_ = req.Reply(axcp.NewEnvelope("", 0))
+		}
+		if slow != nil {
+			_ = slow.Reply(axcp.NewEnvelope("", 0))
+		}
+	}()
+
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := client.Call(ctx, axcp.NewEnvelope("slow", 0))
+		slowDone <- err
+	}()
+
+	reply, err := client.Call(ctx, axcp.NewEnvelope("fast", 0))
+	require.NoError(t, err)
+	assert.Equal(t, "fast", reply.GetTraceId())
+	require.NoError(t, <-slowDone)
+}
+
+func TestCallHonoursDeadline(t *testing.T) {
+	server, sessions := startTestServer(t)
+	client, err := Dial(server.Addr().String(), InsecureTLSConfig())
+	require.NoError(t, err)
+	defer client.Close()
+	session := acceptSession(t, sessions)
+
+	// The server accepts the request but never answers
+	go func() {
+		_, _ = session.AcceptRequest(context.Background())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.Call(ctx, axcp.NewEnvelope("no-reply", 0))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCallErrorReply(t *testing.T) {
+	server, sessions := startTestServer(t)
+	client, err := Dial(server.Addr().String(), InsecureTLSConfig())
+	require.NoError(t, err)
+	defer client.Close()
+	session := acceptSession(t, sessions)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		req, err := session.AcceptRequest(ctx)
+		if err != nil {
+			return
+		}
+		_ = req.ReplyError(axcp.NewError(pb.ErrorCode_TOOL_NOT_FOUND, "no such tool"))
+	}()
+
+	_, err = client.Call(ctx, axcp.NewEnvelope("tool", 0))
+	assert.Equal(t, pb.ErrorCode_TOOL_NOT_FOUND, axcp.ErrorCodeOf(err))
+}
+
+func TestServerPush(t *testing.T) {
+	server, sessions := startTestServer(t)
+	client, err := Dial(server.Addr().String(), InsecureTLSConfig())
+	require.NoError(t, err)
+	defer client.Close()
+	session := acceptSession(t, sessions)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		req, err := client.AcceptRequest(ctx)
+		if err != nil {
+			return
+		}
+		_ = req.Reply(axcp.NewEnvelope("", 0))
+	}()
+
+	reply, err := session.Call(ctx, axcp.NewEnvelope("push", 0))
+	require.NoError(t, err)
+	assert.Equal(t, "push", reply.GetTraceId())
+}
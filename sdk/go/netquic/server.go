@@ -0,0 +1,167 @@
+package netquic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Server listens for incoming AXCP connections over QUIC.
+// Connections are handshaken in the background, so a slow or silent client
+// never delays the sessions of other clients.
+type Server struct {
+	listener *quic.EarlyListener
+	config   *Config
+	sessions chan *Session
+	done     chan struct{}
+	err      error
+}
+
+// Session is the server side of a single AXCP connection.
+// It mirrors Client: envelopes travel on the control stream opened by the
+// client, telemetry travels as QUIC datagrams or, when the client does not
+// support them, on a unidirectional telemetry stream.
+type Session struct {
+	conn quic.Connection
+	controlStream
+	telemetryChannel
+	telemetryPath
+	rpcMux
+}
+
+// Listen starts accepting QUIC connections on the given address
+func Listen(addr string, tlsConf *tls.Config) (*Server, error) {
+	return ListenWithConfig(addr, tlsConf, nil)
+}
+
+// ListenWithConfig is like Listen but applies the given configuration to
+// every accepted session. A nil cfg uses the defaults.
+func ListenWithConfig(addr string, tlsConf *tls.Config, cfg *Config) (*Server, error) {
+	qconf := newQUICConfig(cfg)
+	qconf.Allow0RTT = cfg.allow0RTT()
+	listener, err := quic.ListenAddrEarly(addr, tlsConf, qconf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	s := &Server{
+		listener: listener,
+		config:   cfg,
+		sessions: make(chan *Session),
+		done:     make(chan struct{}),
+	}
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Accept waits for the next client that completed the profile handshake
+func (s *Server) Accept(ctx context.Context) (*Session, error) {
+	select {
+	case session := <-s.sessions:
+		return session, nil
+	case <-s.done:
+		return nil, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the listener. Sessions that were already accepted stay open.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+func (s *Server) acceptLoop() {
+	defer close(s.done)
+	for {
+		conn, err := s.listener.Accept(context.Background())
+		if err != nil {
+			s.err = err
+			return
+		}
+		go s.handshake(conn)
+	}
+}
+
+// handshake waits for the client's control stream and negotiates the
+// session profile. Connections that fail are closed with the AXCP error
+// code as QUIC application error code.
+func (s *Server) handshake(conn quic.EarlyConnection) {
+	ctx, cancel := context.WithTimeout(conn.Context(), defaultTimeout)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "control stream not opened")
+		return
+	}
+
+	codec := s.config.frameCodec()
+	profile, acks, err := negotiateProfile(stream, codec, s.config.profileOffer())
+	if err != nil {
+		closeWithError(conn, err)
+		return
+	}
+
+	session := &Session{
+		conn: conn,
+		controlStream: controlStream{
+			stream:  stream,
+			codec:   codec,
+			profile: profile,
+			acks:    acks,
+			ackCh:   make(chan struct{}, 1),
+		},
+	}
+	session.startRPC(conn, &session.controlStream)
+	session.startTelemetry(conn, codec, s.config)
+	select {
+	case s.sessions <- session:
+	case <-s.done:
+		session.Close()
+	}
+}
+
+// RemoteAddr returns the address of the connected client
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Context returns a context that is cancelled when the session is closed
+func (s *Session) Context() context.Context {
+	return s.conn.Context()
+}
+
+// Close terminates the QUIC connection
+func (s *Session) Close() error {
+	if s.stream != nil {
+		_ = s.stream.Close()
+	}
+	return s.conn.CloseWithError(0, "server closed")
+}
+
+// SendDatagram sends a datagram using QUIC's unreliable datagram transport
+func (s *Session) SendDatagram(data []byte) error {
+	return sendDatagram(s.conn, data)
+}
+
+// ReceiveDatagram blocks until a datagram arrives or ctx is done
+func (s *Session) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	if !s.conn.ConnectionState().SupportsDatagrams {
+		return nil, ErrDatagramNotSupported
+	}
+
+	msg, err := s.conn.ReceiveDatagram(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive datagram: %w", err)
+	}
+	return msg, nil
+}
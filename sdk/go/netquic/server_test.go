@@ -0,0 +1,143 @@
+package netquic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+)
+
+// startTestServer listens on a random loopback port and returns the first
+// accepted session through a channel.
+func startTestServer(t *testing.T) (*Server, <-chan *Session) {
+	t.Helper()
+
+	server, err := Listen("127.0.0.1:0", InsecureTLSConfig())
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	sessions := make(chan *Session, 1)
+	go func() {
+		s, err := server.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		sessions <- s
+	}()
+	return server, sessions
+}
+
+func acceptSession(t *testing.T, sessions <-chan *Session) *Session {
+	t.Helper()
+
+	select {
+	case s := <-sessions:
+		t.Cleanup(func() { s.Close() })
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for session")
+		return nil
+	}
+}
+
+func TestServerEnvelopeRoundTrip(t *testing.T) {
+	server, sessions := startTestServer(t)
+
+	client, err := Dial(server.Addr().String(), InsecureTLSConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.SendEnvelope(axcp.NewEnvelope("ping", 0)))
+
+	session := acceptSession(t, sessions)
+	got, err := session.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "ping", got.GetTraceId())
+
+	require.NoError(t, session.SendEnvelope(axcp.NewEnvelope("pong", 0)))
+	reply, err := client.RecvEnvelope()
+	require.NoError(t, err)
+	assert.Equal(t, "pong", reply.GetTraceId())
+}
+
+func TestServerTelemetryDatagram(t *testing.T) {
+	server, sessions := startTestServer(t)
+
+	client, err := Dial(server.Addr().String(), InsecureTLSConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	session := acceptSession(t, sessions)
+
+	td := axcp.WithTokenUsage(axcp.NewTelemetryDatagram(), 12, 34)
+	require.NoError(t, client.SendTelemetry(td))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := session.ReceiveTelemetry(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(12), axcp.GetTokenUsage(got).GetPromptTokens())
+	assert.Equal(t, uint32(34), axcp.GetTokenUsage(got).GetCompletionTokens())
+	assert.Equal(t, TelemetryStats{Received: 1}, session.TelemetryStats())
+}
+
+func TestServerTelemetryBatchLearnsDatagramLimit(t *testing.T) {
+	server, sessions := startTestServer(t)
+
+	client, err := Dial(server.Addr().String(), InsecureTLSConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	session := acceptSession(t, sessions)
+
+	require.NoError(t, client.SendTelemetryBatch(samples(100)))
+	assert.Positive(t, client.limit, "limit reported by quic-go")
+	assert.Less(t, client.limit, telemetryProbeSize)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 100; i++ {
+		td, err := session.ReceiveTelemetry(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i), td.GetSystem().GetCpuPercent())
+	}
+	assert.Less(t, session.TelemetryStats().Received, uint64(10))
+}
+
+func TestServerTelemetryStreamFallback(t *testing.T) {
+	server, sessions := startTestServer(t)
+
+	// Datagrams are only used when both peers enable them
+	client, err := DialWithConfig(server.Addr().String(), InsecureTLSConfig(), &Config{DisableDatagrams: true})
+	require.NoError(t, err)
+	defer client.Close()
+
+	session := acceptSession(t, sessions)
+	assert.ErrorIs(t, session.SendDatagram([]byte{0xA0}), ErrDatagramNotSupported)
+
+	require.NoError(t, client.SendTelemetry(axcp.WithTokenUsage(axcp.NewTelemetryDatagram(), 1, 2)))
+	require.NoError(t, client.SendTelemetryBatch(samples(100)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := session.ReceiveTelemetry(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), axcp.GetTokenUsage(got).GetPromptTokens())
+	for i := 0; i < 100; i++ {
+		td, err := session.ReceiveTelemetry(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i), td.GetSystem().GetCpuPercent())
+	}
+	stats := session.TelemetryStats()
+	assert.Zero(t, stats.Lost, "sequence numbers are kept on the stream")
+	assert.Greater(t, stats.Received, uint64(1))
+
+	// And the other way round
+	require.NoError(t, session.SendTelemetry(axcp.WithTokenUsage(axcp.NewTelemetryDatagram(), 3, 4)))
+	got, err = client.ReceiveTelemetry(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), axcp.GetTokenUsage(got).GetPromptTokens())
+}
@@ -2,34 +2,174 @@ package netquic
 
 import (
 	"encoding/binary"
-	"io"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 
+	"github.com/quic-go/quic-go"
 	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
 )
 
-func (c *Client) SendEnvelope(env *axcp.Envelope) error {
-	raw, err := axcp.ToBytes(env)
-	if err != nil {
-		return err
+// controlStream is the framed envelope stream shared by Client and Session.
+// It enforces the profile agreed during the handshake in both directions.
+//
+// When both peers negotiated delivery acks, every envelope frame read is
+// answered with a FrameAck carrying the number of envelope frames read so
+// far, and acked holds the highest count the peer reported for ours.
+type controlStream struct {
+	stream    quic.Stream
+	codec     *FrameCodec
+	profile   uint32
+	acks      bool
+	recvMutex sync.Mutex
+	sendMutex sync.Mutex
+	sent      uint64 // envelope frames written, guarded by sendMutex
+	received  uint64 // envelope frames read, guarded by recvMutex
+	acked     atomic.Uint64
+	ackCh     chan struct{}
+}
+
+// Profile returns the session profile agreed during the handshake
+func (cs *controlStream) Profile() uint32 {
+	return cs.profile
+}
+
+// SendEnvelope writes an envelope frame on the control stream.
+// Envelopes claiming a profile above the session profile are refused
+// locally with a PROFILE_MISMATCH error.
+func (cs *controlStream) SendEnvelope(env *axcp.Envelope) error {
+	_, err := cs.sendEnvelope(env)
+	return err
+}
+
+// sendEnvelope is SendEnvelope returning the position of env among the
+// envelope frames written since the handshake, which the peer's acks refer to
+func (cs *controlStream) sendEnvelope(env *axcp.Envelope) (uint64, error) {
+	if cs.stream == nil {
+		return 0, ErrNotConnected
 	}
-	var lenBuf [4]byte
-	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(raw)))
-	if _, err = c.stream.Write(lenBuf[:]); err != nil {
-		return err
+	if err := axcp.CheckProfile(env, cs.profile); err != nil {
+		return 0, err
 	}
-	_, err = c.stream.Write(raw)
-	return err
+
+	cs.sendMutex.Lock()
+	defer cs.sendMutex.Unlock()
+	return cs.writeEnvelope(env)
 }
 
-func (c *Client) RecvEnvelope() (*axcp.Envelope, error) {
-	var lenBuf [4]byte
-	if _, err := io.ReadFull(c.stream, lenBuf[:]); err != nil {
+// writeEnvelope writes env and counts it; the caller holds sendMutex
+func (cs *controlStream) writeEnvelope(env *axcp.Envelope) (uint64, error) {
+	if err := cs.codec.WriteEnvelope(cs.stream, env); err != nil {
+		return 0, err
+	}
+	cs.sent++
+	return cs.sent, nil
+}
+
+// sentCount returns the number of envelope frames written so far
+func (cs *controlStream) sentCount() uint64 {
+	cs.sendMutex.Lock()
+	defer cs.sendMutex.Unlock()
+	return cs.sent
+}
+
+// ackedCount returns the number of envelope frames the peer acknowledged
+func (cs *controlStream) ackedCount() uint64 {
+	return cs.acked.Load()
+}
+
+// ackSignal is ready after the peer acknowledged more envelopes. It is never
+// ready when delivery acks were not negotiated.
+func (cs *controlStream) ackSignal() <-chan struct{} {
+	return cs.ackCh
+}
+
+// RecvEnvelope reads the next envelope frame from the control stream.
+// An envelope claiming a profile above the session profile is answered
+// with ErrorMessage{PROFILE_MISMATCH} and returned as an *axcp.Error; the
+// stream stays usable.
+func (cs *controlStream) RecvEnvelope() (*axcp.Envelope, error) {
+	if cs.stream == nil {
+		return nil, ErrNotConnected
+	}
+
+	cs.recvMutex.Lock()
+	raw, err := cs.readFrame(FrameEnvelope)
+	if err == nil {
+		cs.received++
+	}
+	received := cs.received
+	cs.recvMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if cs.acks {
+		cs.sendAck(received)
+	}
+
+	env, err := axcp.FromBytes(raw)
+	if err != nil {
 		return nil, err
 	}
-	n := binary.LittleEndian.Uint32(lenBuf[:])
-	buf := make([]byte, n)
-	if _, err := io.ReadFull(c.stream, buf); err != nil {
+	if err := axcp.CheckProfile(env, cs.profile); err != nil {
+		cs.sendError(env.GetTraceId(), err)
 		return nil, err
 	}
-	return axcp.FromBytes(buf)
+	return env, nil
+}
+
+// readFrame reads the next frame of type want, consuming the acks sent by
+// the peer on the way. The caller holds recvMutex.
+func (cs *controlStream) readFrame(want FrameType) ([]byte, error) {
+	for {
+		t, payload, err := cs.codec.ReadFrame(cs.stream)
+		if err != nil {
+			return nil, err
+		}
+		if t == want {
+			return payload, nil
+		}
+		if t != FrameAck || !cs.acks {
+			return nil, fmt.Errorf("%w: got %s, want %s", ErrUnexpectedFrame, t, want)
+		}
+		if len(payload) != 8 {
+			return nil, fmt.Errorf("malformed ack frame of %d bytes", len(payload))
+		}
+
+		// Acks written by concurrent readers may arrive out of order
+		count := binary.BigEndian.Uint64(payload)
+		for {
+			acked := cs.acked.Load()
+			if count <= acked || cs.acked.CompareAndSwap(acked, count) {
+				break
+			}
+		}
+		select {
+		case cs.ackCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sendAck tells the peer that count envelope frames have been read
+func (cs *controlStream) sendAck(count uint64) {
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], count)
+
+	cs.sendMutex.Lock()
+	defer cs.sendMutex.Unlock()
+	_ = cs.codec.WriteFrame(cs.stream, FrameAck, payload[:])
+}
+
+// sendError answers traceID with the AXCP error carried by err, if any
+func (cs *controlStream) sendError(traceID string, err error) {
+	var axErr *axcp.Error
+	if !errors.As(err, &axErr) {
+		return
+	}
+
+	cs.sendMutex.Lock()
+	defer cs.sendMutex.Unlock()
+	_, _ = cs.writeEnvelope(axcp.NewErrorEnvelope(traceID, axErr))
 }
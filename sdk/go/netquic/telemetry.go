@@ -0,0 +1,204 @@
+package netquic
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Telemetry datagram layout (spec v0.2 §5.8.1):
+//
+//	+--------+-----------+--------------+
+//	| 1 byte | 2 bytes   | N bytes      |
+//	| type   | seq (u16) | protobuf TLV |
+//	+--------+-----------+--------------+
+//
+// type is DatagramTelemetry, seq is big endian and wraps around, the body is
+// a TelemetryDatagram. A DatagramTelemetryBatch has the same header and a
+// TelemetryBatch body, packing several samples in one datagram.
+const (
+	// DatagramTelemetry is the QUIC DATAGRAM type reserved for telemetry
+	DatagramTelemetry byte = 0xA0
+	// DatagramTelemetryBatch carries several telemetry samples
+	DatagramTelemetryBatch byte = 0xA1
+	// TelemetryHeaderSize is the size of the type byte plus the sequence number
+	TelemetryHeaderSize = 3
+)
+
+// ErrInvalidDatagram is returned for datagrams that are not well-formed
+// telemetry datagrams. Receivers can skip them and keep reading.
+var ErrInvalidDatagram = errors.New("invalid telemetry datagram")
+
+// MarshalTelemetryDatagram encodes td with the given sequence number
+func MarshalTelemetryDatagram(seq uint16, td *pb.TelemetryDatagram) ([]byte, error) {
+	buf := make([]byte, TelemetryHeaderSize, TelemetryHeaderSize+proto.Size(td))
+	buf[0] = DatagramTelemetry
+	binary.BigEndian.PutUint16(buf[1:], seq)
+
+	buf, err := proto.MarshalOptions{}.MarshalAppend(buf, td)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal telemetry: %w", err)
+	}
+	return buf, nil
+}
+
+// UnmarshalTelemetryDatagram decodes a telemetry datagram and returns its
+// sequence number. Errors wrap ErrInvalidDatagram.
+func UnmarshalTelemetryDatagram(data []byte) (uint16, *pb.TelemetryDatagram, error) {
+	if len(data) < TelemetryHeaderSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes is shorter than the header", ErrInvalidDatagram, len(data))
+	}
+	if data[0] != DatagramTelemetry {
+		return 0, nil, fmt.Errorf("%w: unknown type 0x%02X", ErrInvalidDatagram, data[0])
+	}
+
+	seq := binary.BigEndian.Uint16(data[1:])
+	td := &pb.TelemetryDatagram{}
+	if err := proto.Unmarshal(data[TelemetryHeaderSize:], td); err != nil {
+		return seq, nil, fmt.Errorf("%w: %v", ErrInvalidDatagram, err)
+	}
+	return seq, td, nil
+}
+
+// MarshalTelemetryBatch encodes samples in one datagram with the given
+// sequence number. A single sample uses the plain DatagramTelemetry layout.
+func MarshalTelemetryBatch(seq uint16, samples []*pb.TelemetryDatagram) ([]byte, error) {
+	if len(samples) == 1 {
+		return MarshalTelemetryDatagram(seq, samples[0])
+	}
+
+	batch := &pb.TelemetryBatch{Samples: samples}
+	buf := make([]byte, TelemetryHeaderSize, TelemetryHeaderSize+proto.Size(batch))
+	buf[0] = DatagramTelemetryBatch
+	binary.BigEndian.PutUint16(buf[1:], seq)
+
+	buf, err := proto.MarshalOptions{}.MarshalAppend(buf, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal telemetry batch: %w", err)
+	}
+	return buf, nil
+}
+
+// UnmarshalTelemetrySamples decodes a telemetry datagram of either type and
+// returns its sequence number and samples. Errors wrap ErrInvalidDatagram.
+func UnmarshalTelemetrySamples(data []byte) (uint16, []*pb.TelemetryDatagram, error) {
+	if len(data) == 0 || data[0] != DatagramTelemetryBatch {
+		seq, td, err := UnmarshalTelemetryDatagram(data)
+		if err != nil {
+			return seq, nil, err
+		}
+		return seq, []*pb.TelemetryDatagram{td}, nil
+	}
+	if len(data) < TelemetryHeaderSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes is shorter than the header", ErrInvalidDatagram, len(data))
+	}
+
+	seq := binary.BigEndian.Uint16(data[1:])
+	batch := &pb.TelemetryBatch{}
+	if err := proto.Unmarshal(data[TelemetryHeaderSize:], batch); err != nil {
+		return seq, nil, fmt.Errorf("%w: %v", ErrInvalidDatagram, err)
+	}
+	if len(batch.GetSamples()) == 0 {
+		return seq, nil, fmt.Errorf("%w: empty batch", ErrInvalidDatagram)
+	}
+	return seq, batch.GetSamples(), nil
+}
+
+// TelemetryEncoder numbers outgoing telemetry datagrams.
+// The zero value starts at sequence 0 and is safe for concurrent use.
+type TelemetryEncoder struct {
+	next atomic.Uint32
+}
+
+// Encode marshals td with the next sequence number
+func (e *TelemetryEncoder) Encode(td *pb.TelemetryDatagram) ([]byte, error) {
+	seq := uint16(e.next.Add(1) - 1)
+	return MarshalTelemetryDatagram(seq, td)
+}
+
+// TelemetryStats summarises the sequence numbers seen by a receiver
+type TelemetryStats struct {
+	// Received counts every accepted datagram, including late ones
+	Received uint64
+	// Lost counts sequence numbers skipped and not (yet) seen
+	Lost uint64
+	// Reordered counts datagrams older than the highest sequence seen
+	Reordered uint64
+	// Duplicates counts repeats of one of the last 64 sequences seen
+	Duplicates uint64
+}
+
+// seqWindow is the number of sequences below the highest one a SeqTracker
+// remembers, to tell late arrivals from duplicates
+const seqWindow = 64
+
+// SeqTracker derives loss and reorder statistics from the wrap-around
+// sequence numbers of incoming telemetry. Sequence numbers are compared
+// with serial number arithmetic, so a forward jump of up to 32767 is a gap
+// and anything else is a late arrival. A late arrival is taken off Lost
+// only if its sequence was skipped within the last seqWindow sequences;
+// older ones are counted as reordered but cannot be told from duplicates.
+// The zero value is ready to use and safe for concurrent use.
+type SeqTracker struct {
+	mu      sync.Mutex
+	started bool
+	highest uint16
+	seen    uint64 // bit i set: highest-i has been received
+	skipped uint64 // bit i set: highest-i was jumped over, counted in Lost
+	stats   TelemetryStats
+}
+
+// Observe records the arrival of seq
+func (t *SeqTracker) Observe(seq uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.Received++
+	if !t.started {
+		t.started = true
+		t.highest = seq
+		t.seen = 1
+		return
+	}
+
+	delta := int16(seq - t.highest)
+	if delta > 0 {
+		t.stats.Lost += uint64(delta - 1)
+		t.highest = seq
+		if delta < seqWindow {
+			t.seen = t.seen<<uint(delta) | 1
+			t.skipped = t.skipped<<uint(delta) | (1<<uint(delta) - 2)
+		} else {
+			t.seen = 1
+			t.skipped = ^uint64(1)
+		}
+		return
+	}
+
+	age := uint(-int(delta))
+	switch {
+	case age < seqWindow && t.seen&(1<<age) != 0:
+		t.stats.Duplicates++
+	case age < seqWindow && t.skipped&(1<<age) != 0:
+		// A late datagram fills a gap that was counted as lost
+		t.seen |= 1 << age
+		t.skipped &^= 1 << age
+		t.stats.Reordered++
+		t.stats.Lost--
+	default:
+		// Sent before the first datagram seen, or too old to tell
+		t.stats.Reordered++
+	}
+}
+
+// Stats returns a snapshot of the statistics
+func (t *SeqTracker) Stats() TelemetryStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
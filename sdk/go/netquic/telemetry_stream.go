@@ -0,0 +1,139 @@
+package netquic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// telemetryInboxSize bounds the telemetry read ahead of ReceiveTelemetry
+const telemetryInboxSize = 256
+
+// telemetryData is a telemetry datagram taken from either path
+type telemetryData struct {
+	data []byte
+	err  error
+}
+
+// telemetryPath carries telemetry over QUIC datagrams when both peers
+// enable them and over a dedicated unidirectional stream otherwise.
+// Both paths carry the same bytes: each datagram becomes one FrameTelemetry
+// frame on the stream, with its sequence number unchanged.
+type telemetryPath struct {
+	telConn   quic.Connection
+	telCodec  *FrameCodec
+	datagrams bool // both peers enabled QUIC datagrams
+
+	sendMu sync.Mutex
+	out    quic.SendStream // opened on the first telemetry sent on the stream
+
+	startRecv sync.Once
+	inbox     chan telemetryData
+}
+
+// startTelemetry picks the telemetry path and accepts the telemetry
+// streams opened by the peer. quic-go reports peer support for datagrams
+// even when they are disabled locally, so cfg is consulted as well.
+func (p *telemetryPath) startTelemetry(conn quic.Connection, codec *FrameCodec, cfg *Config) {
+	p.telConn = conn
+	p.telCodec = codec
+	p.datagrams = newQUICConfig(cfg).EnableDatagrams && conn.ConnectionState().SupportsDatagrams
+	p.inbox = make(chan telemetryData, telemetryInboxSize)
+	go p.acceptTelemetryStreams()
+}
+
+// sendTelemetryData sends one telemetry datagram on the best available path
+func (p *telemetryPath) sendTelemetryData(data []byte) error {
+	if p.datagrams {
+		return sendDatagram(p.telConn, data)
+	}
+
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	if p.out == nil {
+		stream, err := p.telConn.OpenUniStream()
+		if err != nil {
+			return fmt.Errorf("failed to open telemetry stream: %w", err)
+		}
+		p.out = stream
+	}
+	return p.telCodec.WriteFrame(p.out, FrameTelemetry, data)
+}
+
+// receiveTelemetryData returns the next telemetry datagram from either
+// path. Datagrams are read in the background from the first call on, so
+// ReceiveDatagram must not be used on the same connection afterwards.
+func (p *telemetryPath) receiveTelemetryData(ctx context.Context) ([]byte, error) {
+	p.startRecv.Do(func() {
+		if p.datagrams {
+			go p.readDatagrams()
+		}
+	})
+
+	select {
+	case in := <-p.inbox:
+		return in.data, in.err
+	case <-p.telConn.Context().Done():
+		return nil, fmt.Errorf("failed to receive telemetry: %w", context.Cause(p.telConn.Context()))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readDatagrams moves incoming datagrams to the inbox, dropping them when
+// it is full as the network would
+func (p *telemetryPath) readDatagrams() {
+	for {
+		data, err := p.telConn.ReceiveDatagram(p.telConn.Context())
+		if err != nil {
+			return
+		}
+		select {
+		case p.inbox <- telemetryData{data: data}:
+		default:
+		}
+	}
+}
+
+func (p *telemetryPath) acceptTelemetryStreams() {
+	for {
+		stream, err := p.telConn.AcceptUniStream(p.telConn.Context())
+		if err != nil {
+			return
+		}
+		go p.readTelemetryStream(stream)
+	}
+}
+
+// readTelemetryStream moves the frames of a telemetry stream to the inbox.
+// The stream is reliable, so a full inbox applies backpressure instead of
+// dropping. A malformed frame is reported once and ends the stream.
+func (p *telemetryPath) readTelemetryStream(stream quic.ReceiveStream) {
+	for {
+		data, err := p.telCodec.ReadFrameOf(stream, FrameTelemetry)
+		if err != nil {
+			var tooLarge *FrameTooLargeError
+			if errors.Is(err, ErrUnexpectedFrame) || errors.As(err, &tooLarge) {
+				p.deliver(telemetryData{err: fmt.Errorf("%w: %v", ErrInvalidDatagram, err)})
+			}
+			stream.CancelRead(0)
+			return
+		}
+		if !p.deliver(telemetryData{data: data}) {
+			return
+		}
+	}
+}
+
+// deliver waits for room in the inbox until the connection is closed
+func (p *telemetryPath) deliver(in telemetryData) bool {
+	select {
+	case p.inbox <- in:
+		return true
+	case <-p.telConn.Context().Done():
+		return false
+	}
+}
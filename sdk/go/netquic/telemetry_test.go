@@ -0,0 +1,164 @@
+package netquic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+func TestMarshalTelemetryDatagramGolden(t *testing.T) {
+	data, err := MarshalTelemetryDatagram(0x0102, &pb.TelemetryDatagram{TimestampMs: 5})
+	require.NoError(t, err)
+
+	golden := []byte{
+		0xA0,       // type: telemetry
+		0x01, 0x02, // seq (big-endian)
+		0x08, 0x05, // timestamp_ms = 5
+	}
+	assert.Equal(t, golden, data)
+
+	seq, td, err := UnmarshalTelemetryDatagram(data)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(0x0102), seq)
+	assert.Equal(t, uint64(5), td.GetTimestampMs())
+}
+
+func TestUnmarshalTelemetryDatagramInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":        {},
+		"short header": {0xA0, 0x00},
+		"unknown type": {0x01, 0x00, 0x00},
+		"bad body":     {0xA0, 0x00, 0x00, 0xFF},
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := UnmarshalTelemetryDatagram(data)
+			assert.ErrorIs(t, err, ErrInvalidDatagram)
+		})
+	}
+}
+
+func TestMarshalTelemetryBatchGolden(t *testing.T) {
+	data, err := MarshalTelemetryBatch(0x0001, []*pb.TelemetryDatagram{{TimestampMs: 1}, {TimestampMs: 2}})
+	require.NoError(t, err)
+
+	golden := []byte{
+		0xA1,       // type: telemetry batch
+		0x00, 0x01, // seq (big-endian)
+		0x0A, 0x02, 0x08, 0x01, // samples[0].timestamp_ms = 1
+		0x0A, 0x02, 0x08, 0x02, // samples[1].timestamp_ms = 2
+	}
+	assert.Equal(t, golden, data)
+
+	seq, samples, err := UnmarshalTelemetrySamples(data)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(1), seq)
+	require.Len(t, samples, 2)
+	assert.Equal(t, uint64(2), samples[1].GetTimestampMs())
+
+	// A single sample keeps the plain 0xA0 layout
+	data, err = MarshalTelemetryBatch(7, []*pb.TelemetryDatagram{{TimestampMs: 5}})
+	require.NoError(t, err)
+	assert.Equal(t, DatagramTelemetry, data[0])
+	_, samples, err = UnmarshalTelemetrySamples(data)
+	require.NoError(t, err)
+	assert.Len(t, samples, 1)
+}
+
+func TestUnmarshalTelemetrySamplesInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":        {},
+		"short header": {0xA1, 0x00},
+		"empty batch":  {0xA1, 0x00, 0x00},
+		"bad body":     {0xA1, 0x00, 0x00, 0xFF},
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := UnmarshalTelemetrySamples(data)
+			assert.ErrorIs(t, err, ErrInvalidDatagram)
+		})
+	}
+}
+
+func TestTelemetryEncoderWrapsAround(t *testing.T) {
+	var enc TelemetryEncoder
+	enc.next.Store(0xFFFF)
+
+	for _, want := range []uint16{0xFFFF, 0x0000, 0x0001} {
+		data, err := enc.Encode(&pb.TelemetryDatagram{})
+		require.NoError(t, err)
+		seq, _, err := UnmarshalTelemetryDatagram(data)
+		require.NoError(t, err)
+		assert.Equal(t, want, seq)
+	}
+}
+
+func TestSeqTracker(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint16
+		want TelemetryStats
+	}{
+		{
+			name: "in order",
+			seqs: []uint16{1, 2, 3},
+			want: TelemetryStats{Received: 3},
+		},
+		{
+			name: "gap",
+			seqs: []uint16{17, 19},
+			want: TelemetryStats{Received: 2, Lost: 1},
+		},
+		{
+			name: "late arrival fills the gap",
+			seqs: []uint16{1, 3, 2, 4},
+			want: TelemetryStats{Received: 4, Reordered: 1},
+		},
+		{
+			name: "duplicate",
+			seqs: []uint16{1, 1, 2},
+			want: TelemetryStats{Received: 3, Duplicates: 1},
+		},
+		{
+			name: "wrap around",
+			seqs: []uint16{0xFFFE, 0xFFFF, 0x0001},
+			want: TelemetryStats{Received: 3, Lost: 1},
+		},
+		{
+			name: "late arrival across wrap",
+			seqs: []uint16{0xFFFF, 0x0001, 0x0000},
+			want: TelemetryStats{Received: 3, Reordered: 1},
+		},
+		{
+			name: "late duplicate keeps the gap",
+			seqs: []uint16{1, 2, 4, 2, 1},
+			want: TelemetryStats{Received: 5, Lost: 1, Duplicates: 2},
+		},
+		{
+			name: "late arrival fills the gap once",
+			seqs: []uint16{1, 4, 2, 2, 3},
+			want: TelemetryStats{Received: 5, Reordered: 2, Duplicates: 1},
+		},
+		{
+			name: "older than the first datagram",
+			seqs: []uint16{5, 4},
+			want: TelemetryStats{Received: 2, Reordered: 1},
+		},
+		{
+			name: "beyond the window",
+			seqs: []uint16{1, 3, 100, 2},
+			want: TelemetryStats{Received: 4, Lost: 97, Reordered: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tracker SeqTracker
+			for _, seq := range tt.seqs {
+				tracker.Observe(seq)
+			}
+			assert.Equal(t, tt.want, tracker.Stats())
+		})
+	}
+}
@@ -6,16 +6,216 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
+	"fmt"
 	"math/big"
+	"os"
+	"sync"
 	"time"
 )
 
+// ALPN is the application protocol every AXCP connection must negotiate
+const ALPN = "axcp/1"
+
+// DefaultReloadInterval is how often certificate files are checked for rotation
+const DefaultReloadInterval = time.Minute
+
+// TLSOptions describes the PEM files used by NewServerTLSConfig and
+// NewClientTLSConfig.
+type TLSOptions struct {
+	// CertFile and KeyFile hold the certificate chain and private key of
+	// this node. They are required for a server; a client presents them
+	// for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// CAFile is a bundle of the CAs trusted to sign the peer certificate.
+	// When set only these CAs are trusted, the system pool is ignored.
+	// On a server it enables client certificate verification.
+	CAFile string
+	// RequireClientCert makes a server refuse clients without a
+	// certificate signed by CAFile
+	RequireClientCert bool
+	// ServerName overrides the name checked against the server certificate
+	ServerName string
+	// ReloadInterval is how often CertFile and KeyFile are checked for
+	// rotation; zero means DefaultReloadInterval, negative disables it
+	ReloadInterval time.Duration
+}
+
+// NewServerTLSConfig builds the TLS configuration of an AXCP server.
+// Rotated certificates are picked up on the next handshake without a
+// restart; a half-written pair is ignored until it loads cleanly.
+func NewServerTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("tls: server requires a certificate and a key")
+	}
+	if opts.RequireClientCert && opts.CAFile == "" {
+		return nil, errors.New("tls: client certificate verification requires a CA file")
+	}
+
+	certs, err := newCertReloader(opts.CertFile, opts.KeyFile, opts.ReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := baseTLSConfig()
+	conf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return certs.current(), nil
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if opts.RequireClientCert {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return conf, nil
+}
+
+// NewClientTLSConfig builds the TLS configuration of an AXCP client.
+// With CertFile and KeyFile set the client authenticates itself (mutual
+// TLS) and reloads the pair when it is rotated.
+func NewClientTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("tls: certificate and key must be given together")
+	}
+
+	conf := baseTLSConfig()
+	conf.ServerName = opts.ServerName
+	if opts.CertFile != "" {
+		certs, err := newCertReloader(opts.CertFile, opts.KeyFile, opts.ReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.current(), nil
+		}
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
+
+// baseTLSConfig returns the settings shared by clients and servers:
+// TLS 1.3 (required by QUIC) and the axcp/1 ALPN. Peers that do not
+// negotiate axcp/1 are refused.
+func baseTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{ALPN},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if cs.NegotiatedProtocol != ALPN {
+				return fmt.Errorf("tls: peer negotiated ALPN %q, want %q", cs.NegotiatedProtocol, ALPN)
+			}
+			return nil
+		},
+	}
+}
+
+// loadCertPool reads a PEM CA bundle
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tls: failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("tls: no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certReloader serves a certificate pair and reloads it when the files
+// change. Files are checked lazily, at most once per interval, during
+// handshakes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	if interval == 0 {
+		interval = DefaultReloadInterval
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: failed to load key pair: %w", err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return r, nil
+}
+
+// current returns the latest certificate that loaded successfully
+func (r *certReloader) current() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.interval < 0 || time.Since(r.checked) < r.interval {
+		return r.cert
+	}
+	r.checked = time.Now()
+
+	modTime, err := r.latestModTime()
+	if err != nil || !modTime.After(r.modTime) {
+		return r.cert
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// Keep serving the old pair while the rotation is in progress
+		return r.cert
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return r.cert
+}
+
+// latestModTime returns the newest modification time of the pair
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// InsecureTLSConfig returns a configuration with a throwaway self-signed
+// certificate that skips peer verification. It is meant for tests and local
+// experiments only; use NewServerTLSConfig and NewClientTLSConfig otherwise.
 func InsecureTLSConfig() *tls.Config {
 	cert, _ := generateCert()
 	return &tls.Config{
 		Certificates:       []tls.Certificate{cert},
 		InsecureSkipVerify: true,
-		NextProtos:         []string{"axcp/1"},
+		NextProtos:         []string{ALPN},
 	}
 }
 
@@ -0,0 +1,182 @@
+package netquic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "AXCP Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	ca := &testCA{cert: cert, key: key, dir: dir}
+	writePEM(t, ca.path("ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// issue writes name.pem and name-key.pem for a leaf certificate
+func (ca *testCA) issue(t *testing.T, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath, keyPath := ca.path(name+".pem"), ca.path(name+"-key.pem")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+	return certPath, keyPath
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+// dialTLS runs a full handshake between the two configurations
+func dialTLS(t *testing.T, serverConf, clientConf *tls.Config) error {
+	t.Helper()
+	server, err := Listen("127.0.0.1:0", serverConf)
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := Dial(server.Addr().String(), clientConf)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := server.Accept(ctx)
+	if err != nil {
+		return err
+	}
+	return session.Close()
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	serverCert, serverKey := ca.issue(t, "gateway", 2, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "agent", 3, x509.ExtKeyUsageClientAuth)
+
+	serverConf, err := NewServerTLSConfig(TLSOptions{
+		CertFile:          serverCert,
+		KeyFile:           serverKey,
+		CAFile:            ca.path("ca.pem"),
+		RequireClientCert: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{ALPN}, serverConf.NextProtos)
+
+	clientConf, err := NewClientTLSConfig(TLSOptions{
+		CertFile:   clientCert,
+		KeyFile:    clientKey,
+		CAFile:     ca.path("ca.pem"),
+		ServerName: "localhost",
+	})
+	require.NoError(t, err)
+	require.NoError(t, dialTLS(t, serverConf, clientConf))
+
+	// Without a client certificate the server refuses the handshake
+	anonymous, err := NewClientTLSConfig(TLSOptions{CAFile: ca.path("ca.pem"), ServerName: "localhost"})
+	require.NoError(t, err)
+	assert.Error(t, dialTLS(t, serverConf, anonymous))
+}
+
+func TestClientRejectsUnpinnedCA(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	serverCert, serverKey := ca.issue(t, "gateway", 2, x509.ExtKeyUsageServerAuth)
+	other := newTestCA(t, t.TempDir())
+
+	serverConf, err := NewServerTLSConfig(TLSOptions{CertFile: serverCert, KeyFile: serverKey})
+	require.NoError(t, err)
+	clientConf, err := NewClientTLSConfig(TLSOptions{CAFile: other.path("ca.pem"), ServerName: "localhost"})
+	require.NoError(t, err)
+
+	assert.Error(t, dialTLS(t, serverConf, clientConf))
+}
+
+func TestTLSOptionsValidation(t *testing.T) {
+	_, err := NewServerTLSConfig(TLSOptions{})
+	assert.Error(t, err)
+
+	_, err = NewServerTLSConfig(TLSOptions{CertFile: "c.pem", KeyFile: "k.pem", RequireClientCert: true})
+	assert.Error(t, err)
+
+	_, err = NewClientTLSConfig(TLSOptions{CertFile: "c.pem"})
+	assert.Error(t, err)
+}
+
+func TestCertReloaderPicksUpRotation(t *testing.T) {
+	ca := newTestCA(t, t.TempDir())
+	certPath, keyPath := ca.issue(t, "gateway", 2, x509.ExtKeyUsageServerAuth)
+
+	reloader, err := newCertReloader(certPath, keyPath, time.Nanosecond)
+	require.NoError(t, err)
+	first := reloader.current()
+
+	// Rotate the pair in place with a newer modification time
+	ca.issue(t, "gateway", 3, x509.ExtKeyUsageServerAuth)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, future, future))
+	require.NoError(t, os.Chtimes(keyPath, future, future))
+
+	rotated := reloader.current()
+	assert.NotEqual(t, first.Certificate[0], rotated.Certificate[0])
+
+	leaf, err := x509.ParseCertificate(rotated.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), leaf.SerialNumber.Int64())
+}
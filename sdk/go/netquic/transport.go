@@ -0,0 +1,106 @@
+package netquic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/tradephantom/axcp-spec/sdk/go/axcp"
+	pb "github.com/tradephantom/axcp-spec/sdk/go/axcp/pb"
+)
+
+// Conn is one AXCP connection seen from either peer: envelopes on the
+// control stream and telemetry as datagrams. Client and Session implement
+// it over QUIC; LoopbackNetwork implements it in memory for tests.
+type Conn interface {
+	// SendEnvelope writes an envelope on the control stream
+	SendEnvelope(env *axcp.Envelope) error
+	// RecvEnvelope reads the next envelope from the control stream
+	RecvEnvelope() (*axcp.Envelope, error)
+	// SendDatagram sends an unreliable datagram
+	SendDatagram(data []byte) error
+	// ReceiveDatagram blocks until a datagram arrives or ctx is done
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+	// SendTelemetry sends a sequenced telemetry datagram (spec §5.8.1)
+	SendTelemetry(td *pb.TelemetryDatagram) error
+	// SendTelemetryBatch packs samples into as few datagrams as fit the
+	// current max datagram size
+	SendTelemetryBatch(samples []*pb.TelemetryDatagram) error
+	// ReceiveTelemetry blocks until a telemetry sample arrives or ctx is done,
+	// unpacking batched datagrams
+	ReceiveTelemetry(ctx context.Context) (*pb.TelemetryDatagram, error)
+	// TelemetryStats returns loss and reorder statistics of received telemetry
+	TelemetryStats() TelemetryStats
+	// Profile returns the session profile agreed during the handshake
+	Profile() uint32
+	// RemoteAddr returns the address of the peer
+	RemoteAddr() net.Addr
+	// Context is cancelled when the connection is closed
+	Context() context.Context
+	// Close terminates the connection
+	Close() error
+}
+
+// Listener accepts AXCP connections that completed the profile handshake
+type Listener interface {
+	// Accept waits for the next connection
+	Accept(ctx context.Context) (Conn, error)
+	// Addr returns the address the listener is bound to
+	Addr() net.Addr
+	// Close stops accepting connections
+	Close() error
+}
+
+// Transport creates AXCP connections. Code written against Transport runs
+// unchanged over QUIC and over the in-memory loopback.
+type Transport interface {
+	// Dial connects to the listener at addr
+	Dial(ctx context.Context, addr string) (Conn, error)
+	// Listen accepts connections on addr
+	Listen(addr string) (Listener, error)
+}
+
+var (
+	_ Conn = (*Client)(nil)
+	_ Conn = (*Session)(nil)
+)
+
+// quicTransport is the Transport backed by quic-go
+type quicTransport struct {
+	tlsConf *tls.Config
+	config  *Config
+}
+
+// NewQUICTransport returns a Transport that dials and listens over QUIC
+// with the given TLS configuration and options (nil cfg uses the defaults).
+func NewQUICTransport(tlsConf *tls.Config, cfg *Config) Transport {
+	return &quicTransport{tlsConf: tlsConf, config: cfg}
+}
+
+// Dial connects to addr and negotiates the session profile
+func (t *quicTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	return dial(ctx, addr, t.tlsConf, t.config, false)
+}
+
+// Listen starts a Server on addr
+func (t *quicTransport) Listen(addr string) (Listener, error) {
+	server, err := ListenWithConfig(addr, t.tlsConf, t.config)
+	if err != nil {
+		return nil, err
+	}
+	return &quicListener{server}, nil
+}
+
+// quicListener adapts Server to the Listener interface
+type quicListener struct {
+	*Server
+}
+
+// Accept waits for the next session
+func (l *quicListener) Accept(ctx context.Context) (Conn, error) {
+	session, err := l.Server.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
@@ -37,9 +37,9 @@ def send_td(count=1, profile=3):
             )
         )
     )
-    # Serialize and prepend the 0xA0 header
+    # Serialize and prepend the 0xA0 type byte and the u16 sequence (spec §5.8.1)
     raw = td.SerializeToString()
-    return b'\xA0' + raw
+    return b'\xA0' + (count & 0xFFFF).to_bytes(2, "big") + raw
 
 async def run():
     """Send a test telemetry datagram to the gateway."""